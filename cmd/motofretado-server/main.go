@@ -1,20 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cd1/motofretado-server/data"
 	"github.com/cd1/motofretado-server/web"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
+const (
+	memoryScheme = "memory://"
+	sqliteScheme = "sqlite://"
+)
+
 func main() {
 	var dbURL string
 	var debug bool
+	var disableAuth bool
+	var jwtKeyFile string
+	var migrate bool
 	var port int
+	var maxClockSkew time.Duration
+	var queryTimeout time.Duration
+	var readTimeout time.Duration
+	var writeTimeout time.Duration
+	var idleTimeout time.Duration
+	var shutdownTimeout time.Duration
+	var readLimit web.RateLimit
+	var writeLimit web.RateLimit
+	var trustForwardedFor bool
+	var corsMaxAge time.Duration
 
 	app := cli.NewApp()
 	app.Name = "Moto Fretado server"
@@ -29,7 +55,7 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:        "database-url, u",
-			Usage:       "database `URL`",
+			Usage:       "database `URL` (\"postgres://...\", \"sqlite://path\" or \"memory://\")",
 			Destination: &dbURL,
 			EnvVar:      "DATABASE_URL",
 		},
@@ -38,6 +64,24 @@ func main() {
 			Usage:       "enable debug logs",
 			Destination: &debug,
 		},
+		cli.BoolFlag{
+			Name:        "disable-auth",
+			Usage:       "let anyone change the buses without an API key or a bus token (for local development only)",
+			Destination: &disableAuth,
+			EnvVar:      "DISABLE_AUTH",
+		},
+		cli.StringFlag{
+			Name:        "jwt-key-file",
+			Usage:       "authenticate requests with JWTs verified by the key in `FILE` (an RSA public key in PEM for RS256, or a secret for HS256) instead of API keys",
+			Destination: &jwtKeyFile,
+			EnvVar:      "JWT_KEY_FILE",
+		},
+		cli.BoolFlag{
+			Name:        "migrate",
+			Usage:       "apply the pending database migrations before starting the server",
+			Destination: &migrate,
+			EnvVar:      "MIGRATE",
+		},
 		cli.IntFlag{
 			Name:        "port, p",
 			Value:       8080,
@@ -45,34 +89,376 @@ func main() {
 			Destination: &port,
 			EnvVar:      "PORT",
 		},
+		cli.DurationFlag{
+			Name:        "max-clock-skew",
+			Value:       data.DefaultMaxClockSkew,
+			Usage:       "accept bus positions recorded up to `DURATION` into the future",
+			Destination: &maxClockSkew,
+			EnvVar:      "MAX_CLOCK_SKEW",
+		},
+		cli.DurationFlag{
+			Name:        "query-timeout",
+			Value:       data.DefaultQueryTimeout,
+			Usage:       "abort requests which wait for the database longer than `DURATION` (0 disables it)",
+			Destination: &queryTimeout,
+			EnvVar:      "QUERY_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:        "read-timeout",
+			Value:       15 * time.Second,
+			Usage:       "abort requests whose body takes longer than `DURATION` to be read (0 disables it)",
+			Destination: &readTimeout,
+			EnvVar:      "READ_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:        "write-timeout",
+			Usage:       "abort responses which take longer than `DURATION` to be written, including event streams (0 disables it)",
+			Destination: &writeTimeout,
+			EnvVar:      "WRITE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:        "idle-timeout",
+			Value:       2 * time.Minute,
+			Usage:       "close keep-alive connections after `DURATION` without requests (0 uses the read timeout)",
+			Destination: &idleTimeout,
+			EnvVar:      "IDLE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-timeout",
+			Value:       25 * time.Second,
+			Usage:       "wait up to `DURATION` for the active requests to finish when the server is stopped",
+			Destination: &shutdownTimeout,
+			EnvVar:      "SHUTDOWN_TIMEOUT",
+		},
+		cli.Float64Flag{
+			Name:        "read-rate-limit",
+			Value:       20,
+			Usage:       "let each client read the buses up to `N` times per second (0 disables it)",
+			Destination: &readLimit.Rate,
+			EnvVar:      "READ_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:        "read-burst",
+			Value:       40,
+			Usage:       "let each client read the buses up to `N` times at once, before the rate limit applies",
+			Destination: &readLimit.Burst,
+			EnvVar:      "READ_BURST",
+		},
+		cli.Float64Flag{
+			Name:        "write-rate-limit",
+			Value:       2,
+			Usage:       "let each client change the buses up to `N` times per second (0 disables it)",
+			Destination: &writeLimit.Rate,
+			EnvVar:      "WRITE_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:        "write-burst",
+			Value:       10,
+			Usage:       "let each client change the buses up to `N` times at once, before the rate limit applies",
+			Destination: &writeLimit.Burst,
+			EnvVar:      "WRITE_BURST",
+		},
+		cli.BoolFlag{
+			Name:        "trust-forwarded-for",
+			Usage:       "identify the clients by the \"X-Forwarded-For\" header (only behind a proxy which sets it, e.g. on Heroku)",
+			Destination: &trustForwardedFor,
+			EnvVar:      "TRUST_FORWARDED_FOR",
+		},
+		cli.StringSliceFlag{
+			Name:   "cors-origin",
+			Usage:  "let browser apps from `ORIGIN` (e.g. \"https://dashboard.example.com\", or \"*\" for any) use the API; it may be repeated",
+			EnvVar: "CORS_ORIGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "cors-method",
+			Usage:  fmt.Sprintf("let browser apps from other origins send the HTTP `METHOD`; it may be repeated (default: %v)", strings.Join(web.DefaultCORSMethods, ", ")),
+			EnvVar: "CORS_METHODS",
+		},
+		cli.StringSliceFlag{
+			Name:   "cors-header",
+			Usage:  fmt.Sprintf("let browser apps from other origins send the HTTP `HEADER`; it may be repeated (default: %v)", strings.Join(web.DefaultCORSHeaders, ", ")),
+			EnvVar: "CORS_HEADERS",
+		},
+		cli.DurationFlag{
+			Name:        "cors-max-age",
+			Value:       10 * time.Minute,
+			Usage:       "let browsers cache the CORS preflight responses for `DURATION`",
+			Destination: &corsMaxAge,
+			EnvVar:      "CORS_MAX_AGE",
+		},
 	}
 
-	app.Action = func(c *cli.Context) error {
+	app.Before = func(c *cli.Context) error {
 		if debug {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
 
-		repo, err := data.NewPostgresRepository(dbURL)
+		return nil
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "migrate",
+			Usage: "change the database schema",
+			Subcommands: []cli.Command{
+				{
+					Name:  "up",
+					Usage: "apply the pending migrations, up to the latest version or the one specified by --to",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "to",
+							Usage: "migrate up to `VERSION`",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return runMigrator(dbURL, func(m *data.Migrator) error {
+							version := m.LatestVersion()
+							if c.IsSet("to") {
+								version = c.Int("to")
+							}
+
+							return migrateUp(m, version)
+						})
+					},
+				},
+				{
+					Name:  "down",
+					Usage: "revert the last migration, or down to the version specified by --to",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "to",
+							Usage: "migrate down to `VERSION`",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return runMigrator(dbURL, func(m *data.Migrator) error {
+							currentVersion, err := m.Version()
+							if err != nil {
+								return err
+							}
+
+							version := currentVersion - 1
+							if c.IsSet("to") {
+								version = c.Int("to")
+							}
+
+							if version > currentVersion {
+								return fmt.Errorf("cannot migrate down from version %v to %v", currentVersion, version)
+							}
+
+							return m.MigrateTo(version)
+						})
+					},
+				},
+				{
+					Name:  "status",
+					Usage: "show the current and the latest schema versions",
+					Action: func(c *cli.Context) error {
+						return runMigrator(dbURL, func(m *data.Migrator) error {
+							version, err := m.Version()
+							if err != nil {
+								return err
+							}
+
+							fmt.Printf("current version: %v\nlatest version: %v\n", version, m.LatestVersion())
+
+							return nil
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:  "keys",
+			Usage: "manage the API keys which allow changing the buses",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create",
+					Usage: "create a new API key for whom is described by --name",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "`NAME` of who is going to use the key",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return runRepository(dbURL, func(repo *data.Repository) error {
+							key, wholeKey, err := repo.CreateAPIKey(context.Background(), c.String("name"))
+							if err != nil {
+								return err
+							}
+
+							fmt.Printf("id: %v\nname: %v\nkey: %v\n", key.ID, key.Name, wholeKey)
+							logrus.Info("the key cannot be shown again; store it somewhere safe")
+
+							return nil
+						})
+					},
+				},
+				{
+					Name:      "revoke",
+					Usage:     "revoke an API key, so it can't be used anymore",
+					ArgsUsage: "ID",
+					Action: func(c *cli.Context) error {
+						return runRepository(dbURL, func(repo *data.Repository) error {
+							return repo.RevokeAPIKey(context.Background(), c.Args().First())
+						})
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list all API keys, including the revoked ones",
+					Action: func(c *cli.Context) error {
+						return runRepository(dbURL, func(repo *data.Repository) error {
+							keys, err := repo.ReadAllAPIKeys(context.Background())
+							if err != nil {
+								return err
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+							fmt.Fprintln(w, "ID\tNAME\tCREATED\tREVOKED")
+							for _, k := range keys {
+								revoked := "-"
+								if k.Revoked() {
+									revoked = k.RevokedAt.Format(time.RFC3339)
+								}
+
+								fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", k.ID, k.Name, k.CreatedAt.Format(time.RFC3339), revoked)
+							}
+
+							return w.Flush()
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:  "buses",
+			Usage: "manage the buses",
+			Subcommands: []cli.Command{
+				{
+					Name:      "token",
+					Usage:     "issue a new token for a bus (e.g. one created before the buses had tokens), replacing the previous one",
+					ArgsUsage: "ID",
+					Action: func(c *cli.Context) error {
+						return runRepository(dbURL, func(repo *data.Repository) error {
+							id := c.Args().First()
+							token, err := repo.IssueBusToken(context.Background(), id)
+							if err != nil {
+								return err
+							}
+
+							fmt.Printf("id: %v\ntoken: %v\n", id, token)
+							logrus.Info("the token cannot be shown again; give it to the bus driver")
+
+							return nil
+						})
+					},
+				},
+			},
+		},
+	}
+
+	app.Action = func(c *cli.Context) error {
+		if migrate {
+			err := runMigrator(dbURL, func(m *data.Migrator) error {
+				return migrateUp(m, m.LatestVersion())
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		repo, err := openRepository(dbURL)
 		if err != nil {
-			logrus.Error("error opening a database connection")
-			return cli.NewExitError(err.Error(), 1)
+			return repositoryError(err)
 		}
+		var keepRepoOpen bool
 		defer func() {
+			if keepRepoOpen {
+				return
+			}
+
 			if err := repo.Close(); err != nil {
 				logrus.WithError(err).Warn("could not close the database connection")
 			}
 		}()
 
-		mux := web.BuildMux(repo)
+		repo.SetMaxClockSkew(maxClockSkew)
+		repo.SetQueryTimeout(queryTimeout)
 
-		logrus.WithFields(logrus.Fields{
-			"port": port,
-		}).Info("starting web server")
-		if err := http.ListenAndServe(fmt.Sprintf(":%v", port), mux); err != nil {
+		opts := web.Options{
+			DisableAuth:       disableAuth,
+			ReadLimit:         readLimit,
+			WriteLimit:        writeLimit,
+			TrustForwardedFor: trustForwardedFor,
+			CORS: web.CORSOptions{
+				AllowedOrigins: c.StringSlice("cors-origin"),
+				AllowedMethods: c.StringSlice("cors-method"),
+				AllowedHeaders: c.StringSlice("cors-header"),
+				MaxAge:         corsMaxAge,
+			},
+			Sockets: web.NewSockets(),
+		}
+
+		if disableAuth {
+			logrus.Warn("authentication is disabled; anyone can change the buses")
+		} else if len(jwtKeyFile) > 0 {
+			key, err := ioutil.ReadFile(jwtKeyFile)
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("could not read JWT key file: %v", err), 1)
+			}
+
+			if opts.JWTVerifier, err = web.NewJWTVerifier(key); err != nil {
+				return cli.NewExitError(fmt.Sprintf("invalid JWT key file: %v", err), 1)
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"file": jwtKeyFile,
+			}).Info("requests will be authenticated with JWTs")
+		}
+
+		server := &http.Server{
+			Addr:         fmt.Sprintf(":%v", port),
+			Handler:      web.BuildMux(repo, opts),
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			IdleTimeout:  idleTimeout,
+		}
+
+		// SIGTERM is sent by Heroku and Docker when the server must stop
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		defer signal.Stop(signals)
+
+		serverErrs := make(chan error, 1)
+		go func() {
+			logrus.WithFields(logrus.Fields{
+				"port": port,
+			}).Info("starting web server")
+			serverErrs <- server.ListenAndServe()
+		}()
+
+		select {
+		case err := <-serverErrs:
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"port": port,
 			}).Error("error running web server")
 			return cli.NewExitError(err.Error(), 1)
+		case sig := <-signals:
+			logrus.WithFields(logrus.Fields{
+				"signal": sig,
+			}).Info("stopping web server")
+		}
+
+		// otherwise, the event streams would only end when the timeout expires
+		repo.CloseSubscriptions()
+
+		if !shutdownServer(server, opts.Sockets, shutdownTimeout) {
+			// the handlers of the closed connections may still be running, and
+			// the process is about to exit anyway
+			logrus.Warn("leaving the database connection open for the unfinished requests")
+			keepRepoOpen = true
 		}
 
 		return nil
@@ -82,3 +468,131 @@ func main() {
 		logrus.WithError(err).Fatal("error running the program")
 	}
 }
+
+// shutdownServer closes the WebSocket connections, stops accepting new
+// connections and waits for the active requests to finish, but for no longer
+// than timeout. The connections which are still open after that are closed
+// abruptly, and false is returned.
+func shutdownServer(server *http.Server, sockets *web.Sockets, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	finished := true
+	// the server doesn't know about them, as their connections are hijacked
+	if err := sockets.Close(ctx); err != nil {
+		logrus.WithError(err).Warn("could not finish all WebSocket connections before stopping the web server")
+		finished = false
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Warn("could not finish all requests before stopping the web server")
+		if err := server.Close(); err != nil {
+			logrus.WithError(err).Warn("could not close the remaining connections")
+		}
+		finished = false
+	}
+
+	logrus.Info("web server stopped")
+
+	return finished
+}
+
+// runMigrator runs f with a migrator for the database described by the
+// database URL, which has the same format used by openRepository. In-memory
+// databases don't need migrations, so f isn't run for them.
+func runMigrator(dbURL string, f func(*data.Migrator) error) error {
+	var migrator *data.Migrator
+	var err error
+
+	switch {
+	case strings.HasPrefix(dbURL, memoryScheme):
+		logrus.Info("in-memory databases don't need migrations")
+		return nil
+	case strings.HasPrefix(dbURL, sqliteScheme):
+		migrator, err = data.NewSQLiteMigrator(strings.TrimPrefix(dbURL, sqliteScheme))
+	default:
+		migrator, err = data.NewPostgresMigrator(dbURL)
+	}
+	if err != nil {
+		logrus.Error("error opening a database connection for migrations")
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer func() {
+		if err := migrator.Close(); err != nil {
+			logrus.WithError(err).Warn("could not close the database connection for migrations")
+		}
+	}()
+
+	if err := f(migrator); err != nil {
+		logrus.Error("error migrating the database")
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return nil
+}
+
+// runRepository runs f with a repository for the database described by the
+// database URL. In-memory databases are lost as soon as the command exits, so
+// f isn't run for them.
+func runRepository(dbURL string, f func(*data.Repository) error) error {
+	if strings.HasPrefix(dbURL, memoryScheme) {
+		return cli.NewExitError("in-memory databases don't keep any data after the command exits", 1)
+	}
+
+	repo, err := openRepository(dbURL)
+	if err != nil {
+		return repositoryError(err)
+	}
+	defer func() {
+		if err := repo.Close(); err != nil {
+			logrus.WithError(err).Warn("could not close the database connection")
+		}
+	}()
+
+	if err := f(repo); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return nil
+}
+
+// repositoryError logs why the repository couldn't be opened, and how to fix
+// it when possible.
+func repositoryError(err error) error {
+	logrus.Error("error opening a database connection")
+	if _, ok := errors.Cause(err).(data.SchemaVersionError); ok {
+		logrus.Info("run the command \"migrate up\" or the flag \"--migrate\" to migrate the database")
+	}
+
+	return cli.NewExitError(err.Error(), 1)
+}
+
+// migrateUp applies the migrations up to version, refusing to revert any
+// migration.
+func migrateUp(m *data.Migrator, version int) error {
+	currentVersion, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	if version < currentVersion {
+		return fmt.Errorf("cannot migrate up from version %v to %v", currentVersion, version)
+	}
+
+	return m.MigrateTo(version)
+}
+
+// openRepository opens the repository described by the database URL. The URL
+// "memory://" creates an in-memory repository, "sqlite://path" opens the SQLite
+// database at "path" and any other value is handled as a PostgreSQL connection
+// URL.
+func openRepository(dbURL string) (*data.Repository, error) {
+	switch {
+	case strings.HasPrefix(dbURL, memoryScheme):
+		return data.NewMemoryRepository(), nil
+	case strings.HasPrefix(dbURL, sqliteScheme):
+		return data.NewSQLiteRepository(strings.TrimPrefix(dbURL, sqliteScheme))
+	default:
+		return data.NewPostgresRepository(dbURL)
+	}
+}
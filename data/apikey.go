@@ -0,0 +1,67 @@
+package data
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// apiKeySeparator separates the ID of an API key from its secret.
+const apiKeySeparator = "."
+
+// APIKey allows its owner to change the buses. The whole key is made of its ID
+// and a random secret, but only a hash of the secret is stored, so the key
+// can't be recovered after it's created.
+type APIKey struct {
+	ID         string
+	Name       string
+	SecretHash []byte     `db:"secret_hash"`
+	CreatedAt  time.Time  `db:"created_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
+
+// Revoked returns whether the key can no longer be used.
+func (k APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// newAPIKey generates a new API key, returning it along with the whole key
+// which must be given to its owner.
+func newAPIKey(name string, now time.Time) (APIKey, string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", errors.Wrap(err, "failed to generate API key ID")
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := APIKey{
+		ID:         hex.EncodeToString(id),
+		Name:       name,
+		SecretHash: hashSecret(secret),
+		CreatedAt:  now,
+	}
+
+	return key, key.ID + apiKeySeparator + secret, nil
+}
+
+// splitAPIKey splits a whole API key into its ID and its secret.
+func splitAPIKey(key string) (id, secret string, ok bool) {
+	parts := strings.SplitN(key, apiKeySeparator, 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// matchesSecret checks whether secret is the one the key was created with.
+func (k APIKey) matchesSecret(secret string) bool {
+	return matchesSecretHash(k.SecretHash, secret)
+}
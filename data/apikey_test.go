@@ -0,0 +1,62 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	key, wholeKey, err := newAPIKey("test", time.Now())
+	require.NoError(t, err, "failed to generate API key")
+
+	id, secret, ok := splitAPIKey(wholeKey)
+	require.True(t, ok, "the whole key should be splittable")
+	assert.Equal(t, key.ID, id, "the whole key should start with the key ID")
+	assert.True(t, key.matchesSecret(secret), "the key should match its own secret")
+	assert.False(t, key.matchesSecret(secret+"x"), "the key shouldn't match another secret")
+	assert.NotContains(t, string(key.SecretHash), secret, "the secret shouldn't be stored")
+
+	otherKey, otherWholeKey, err := newAPIKey("test", time.Now())
+	require.NoError(t, err, "failed to generate API key")
+	assert.NotEqual(t, key.ID, otherKey.ID, "the key IDs should be random")
+	assert.NotEqual(t, wholeKey, otherWholeKey, "the keys should be random")
+}
+
+func TestSplitAPIKey(t *testing.T) {
+	testCases := []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "no separator",
+			key:  "foo",
+		},
+		{
+			name: "no ID",
+			key:  ".foo",
+		},
+		{
+			name: "no secret",
+			key:  "foo.",
+		},
+		{
+			name: "valid",
+			key:  "foo.bar",
+			ok:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(subT *testing.T) {
+			_, _, ok := splitAPIKey(tc.key)
+			assert.Equal(subT, tc.ok, ok)
+		})
+	}
+}
@@ -1,13 +1,53 @@
 package data
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StreamBusID is reserved for the stream of all buses ("/bus/stream"), so no
+// bus can be created with it.
+const StreamBusID = "stream"
 
 // Bus represents a bus ("fretado") on the system. It contains the last location
-// information (i.e. latitude + longitude).
+// information (i.e. latitude + longitude), along with the optional telemetry
+// reported by the device at the same time; a nil telemetry attribute means it's
+// unknown. RecordedAt is when the device got that location, while UpdatedAt is
+// when the server received it. Only the hash of the bus token is stored, and
+// Token is only set on the bus returned when it's created; TokenHash is nil for
+// the buses created before they had tokens.
 type Bus struct {
-	ID        string
-	Latitude  float64
-	Longitude float64
-	CreatedAt time.Time `db:"created_at"`
-	UpdatedAt time.Time `db:"updated_at"`
+	ID         string
+	Latitude   float64
+	Longitude  float64
+	Speed      *float64  // meters per second
+	Heading    *float64  // degrees clockwise from true north, in [0, 360)
+	Accuracy   *float64  // horizontal accuracy radius, in meters
+	Altitude   *float64  // meters above the WGS84 ellipsoid
+	RecordedAt time.Time `db:"recorded_at"`
+	CreatedAt  time.Time `db:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at"`
+	TokenHash  []byte    `db:"token_hash"`
+	Token      string    `db:"-"`
+}
+
+// updateFailure finds out why no rows were updated by a conditional UPDATE
+// statement: either the bus doesn't exist, its current position is newer than
+// the one being updated or it has been modified since it was last read.
+func updateFailure(ctx context.Context, readBus func(context.Context, string) (Bus, error), bus Bus) error {
+	existingBus, err := readBus(ctx, bus.ID)
+	if err != nil {
+		if errors.Cause(err) == ErrNoSuchRow {
+			return errors.WithMessage(ErrNoSuchRow, "no rows were updated")
+		}
+		return errors.Wrap(err, "failed to check updated bus")
+	}
+
+	if existingBus.RecordedAt.After(bus.RecordedAt) {
+		return errors.WithMessage(ErrOutdatedPosition, "bus has a newer position")
+	}
+
+	return errors.WithMessage(ErrConcurrentUpdate, "bus has been updated since it was read")
 }
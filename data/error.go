@@ -9,6 +9,22 @@ import (
 // ErrNoSuchRow represents an error when some data entry could not be found.
 var ErrNoSuchRow = errors.New("no such row")
 
+// ErrConcurrentUpdate represents an error when a row could not be updated
+// because it has been modified since it was last read.
+var ErrConcurrentUpdate = errors.New("row was modified concurrently")
+
+// ErrOutdatedPosition represents an error when a bus position could not be
+// updated because it was recorded before the current one.
+var ErrOutdatedPosition = errors.New("position is older than the current one")
+
+// ErrInvalidAPIKey represents an error when an API key doesn't exist, doesn't
+// match the stored one or has been revoked.
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// ErrInvalidBusToken represents an error when a token doesn't match the one
+// issued for the bus.
+var ErrInvalidBusToken = errors.New("invalid bus token")
+
 // DuplicateError represents an error when an operation could not be performed
 // because that row already exists.
 type DuplicateError struct {
@@ -27,6 +43,25 @@ type MissingParameterError struct {
 	Name string
 }
 
+// SchemaVersionError represents an error when the database schema isn't at the
+// version expected by the application.
+type SchemaVersionError struct {
+	Version         int
+	ExpectedVersion int
+}
+
+// BatchError represents an error when some items of a batch are invalid. None
+// of the items are stored in that case.
+type BatchError struct {
+	Errors []ItemError
+}
+
+// ItemError represents an error on the item at Index of a batch.
+type ItemError struct {
+	Index int
+	Err   error
+}
+
 // Error returns a string representation of the error.
 func (e InvalidParameterError) Error() string {
 	return fmt.Sprintf("invalid parameter \"%v\" = \"%v\"", e.Name, e.Value)
@@ -37,6 +72,16 @@ func (e MissingParameterError) Error() string {
 	return fmt.Sprintf("missing parameter \"%v\"", e.Name)
 }
 
+// Error returns a string representation of the error.
+func (e SchemaVersionError) Error() string {
+	return fmt.Sprintf("database schema version is %v, expected %v", e.Version, e.ExpectedVersion)
+}
+
+// Error returns a string representation of the error.
+func (e BatchError) Error() string {
+	return fmt.Sprintf("%v invalid item(s) in batch", len(e.Errors))
+}
+
 // Error returns a string representation of the error.
 func (e DuplicateError) Error() string {
 	return fmt.Sprintf("row with ID=\"%v\" already exists", e.ID)
@@ -0,0 +1,115 @@
+package data
+
+import (
+	"math"
+	"sort"
+)
+
+// earthRadius is the mean radius of the Earth, in meters.
+const earthRadius = 6371008.8
+
+// Distance calculates the great-circle distance, in meters, between two points
+// on Earth using the haversine formula. The coordinates are in degrees.
+func Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1 := radians(lat1)
+	phi2 := radians(lat2)
+	dPhi := radians(lat2 - lat1)
+	dLambda := radians(lng2 - lng1)
+
+	a := math.Pow(math.Sin(dPhi/2), 2) + math.Cos(phi1)*math.Cos(phi2)*math.Pow(math.Sin(dLambda/2), 2)
+
+	// rounding errors may push "a" slightly above 1 for antipodal points
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, a)))
+}
+
+// boundingBox calculates the smallest latitude/longitude rectangle containing
+// every point within radius meters of (lat, lng). It's meant to pre-filter
+// rows before calculating the exact distance, so the longitude range falls back
+// to the whole Earth when the circle reaches a pole or the antimeridian.
+func boundingBox(lat, lng, radius float64) (minLat, minLng, maxLat, maxLng float64) {
+	angle := radius / earthRadius
+
+	minLat = lat - degrees(angle)
+	maxLat = lat + degrees(angle)
+	minLng = -180
+	maxLng = 180
+
+	if minLat <= -90 || maxLat >= 90 {
+		return math.Max(minLat, -90), minLng, math.Min(maxLat, 90), maxLng
+	}
+
+	ratio := math.Sin(angle) / math.Cos(radians(lat))
+	if angle >= math.Pi/2 || ratio >= 1 {
+		return minLat, minLng, maxLat, maxLng
+	}
+
+	dLng := degrees(math.Asin(ratio))
+	if lng-dLng < -180 || lng+dLng > 180 {
+		return minLat, minLng, maxLat, maxLng
+	}
+
+	return minLat, lng - dLng, maxLat, lng + dLng
+}
+
+// inBox checks whether the point (lat, lng) is inside the box with the
+// specified corners. If minLng is greater than maxLng, the box crosses the
+// antimeridian.
+func inBox(lat, lng, minLat, minLng, maxLat, maxLng float64) bool {
+	if lat < minLat || lat > maxLat {
+		return false
+	}
+
+	if minLng <= maxLng {
+		return lng >= minLng && lng <= maxLng
+	}
+
+	return lng >= minLng || lng <= maxLng
+}
+
+// nearestBuses returns the buses within radius meters of (lat, lng), ordered
+// by their distance to that point and then by ID.
+func nearestBuses(buses []Bus, lat, lng, radius float64) []Bus {
+	var nearBuses []Bus
+	var distances []float64
+
+	for _, b := range buses {
+		if d := Distance(lat, lng, b.Latitude, b.Longitude); d <= radius {
+			nearBuses = append(nearBuses, b)
+			distances = append(distances, d)
+		}
+	}
+
+	sort.Sort(busesByDistance{nearBuses, distances})
+
+	return nearBuses
+}
+
+type busesByDistance struct {
+	buses     []Bus
+	distances []float64
+}
+
+func (s busesByDistance) Len() int {
+	return len(s.buses)
+}
+
+func (s busesByDistance) Less(i, j int) bool {
+	if s.distances[i] != s.distances[j] {
+		return s.distances[i] < s.distances[j]
+	}
+
+	return s.buses[i].ID < s.buses[j].ID
+}
+
+func (s busesByDistance) Swap(i, j int) {
+	s.buses[i], s.buses[j] = s.buses[j], s.buses[i]
+	s.distances[i], s.distances[j] = s.distances[j], s.distances[i]
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func degrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
@@ -0,0 +1,100 @@
+package data
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		expectedDistance       float64
+	}{
+		{"same point", -23.5505, -46.6333, -23.5505, -46.6333, 0},
+		{"one degree of latitude", 0, 10, 1, 10, 111195},
+		{"São Paulo to Rio de Janeiro", -23.5505, -46.6333, -22.9068, -43.1729, 360749},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, 111195},
+		{"antipodal points", 10, 20, -10, -160, math.Pi * earthRadius},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(subT *testing.T) {
+			distance := Distance(test.lat1, test.lng1, test.lat2, test.lng2)
+			assert.InDelta(subT, test.expectedDistance, distance, 1, "unexpected distance")
+
+			reverseDistance := Distance(test.lat2, test.lng2, test.lat1, test.lng1)
+			assert.InDelta(subT, distance, reverseDistance, 1e-6, "distance should be symmetric")
+		})
+	}
+}
+
+func TestBoundingBox(t *testing.T) {
+	t.Run("regular", func(subT *testing.T) {
+		lat, lng, radius := -23.5505, -46.6333, 1000.0
+		minLat, minLng, maxLat, maxLng := boundingBox(lat, lng, radius)
+
+		assert.InDelta(subT, radius, Distance(lat, lng, minLat, lng), 1, "south edge")
+		assert.InDelta(subT, radius, Distance(lat, lng, maxLat, lng), 1, "north edge")
+		assert.True(subT, Distance(lat, lng, lat, minLng) >= radius, "west edge should contain the circle")
+		assert.True(subT, Distance(lat, lng, lat, maxLng) >= radius, "east edge should contain the circle")
+	})
+
+	t.Run("pole", func(subT *testing.T) {
+		minLat, minLng, maxLat, maxLng := boundingBox(89.99, 0, 10000)
+		assert.Equal(subT, 90.0, maxLat, "maximum latitude")
+		assert.True(subT, minLat < 89.99, "minimum latitude")
+		assert.Equal(subT, -180.0, minLng, "minimum longitude")
+		assert.Equal(subT, 180.0, maxLng, "maximum longitude")
+	})
+
+	t.Run("antimeridian", func(subT *testing.T) {
+		_, minLng, _, maxLng := boundingBox(0, 179.99, 10000)
+		assert.Equal(subT, -180.0, minLng, "minimum longitude")
+		assert.Equal(subT, 180.0, maxLng, "maximum longitude")
+	})
+
+	t.Run("whole Earth", func(subT *testing.T) {
+		minLat, minLng, maxLat, maxLng := boundingBox(0, 0, math.Pi*earthRadius)
+		assert.Equal(subT, []float64{-90, -180, 90, 180}, []float64{minLat, minLng, maxLat, maxLng})
+	})
+}
+
+func TestInBox(t *testing.T) {
+	assert.True(t, inBox(1, 1, 0, 0, 2, 2), "point inside the box")
+	assert.True(t, inBox(0, 2, 0, 0, 2, 2), "point on the edge of the box")
+	assert.False(t, inBox(3, 1, 0, 0, 2, 2), "point north of the box")
+	assert.False(t, inBox(1, 3, 0, 0, 2, 2), "point east of the box")
+	assert.True(t, inBox(1, 179.5, 0, 179, 2, -179), "point west of the antimeridian")
+	assert.True(t, inBox(1, -179.5, 0, 179, 2, -179), "point east of the antimeridian")
+	assert.False(t, inBox(1, 0, 0, 179, 2, -179), "point outside the box crossing the antimeridian")
+}
+
+func TestNearestBuses(t *testing.T) {
+	var buses []Bus
+
+	for i, lat := range []float64{0.03, 0.01, 0.02, 0.01} {
+		buses = append(buses, Bus{
+			ID:        fmt.Sprintf("bus-%v", 3-i),
+			Latitude:  lat,
+			Longitude: 1,
+		})
+	}
+
+	nearBuses := nearestBuses(buses, 0, 1, 2500)
+
+	var ids []string
+	for _, b := range nearBuses {
+		ids = append(ids, b.ID)
+	}
+	assert.Equal(t, []string{"bus-0", "bus-2", "bus-1"}, ids, "buses should be ordered by distance and then by ID")
+}
+
+func BenchmarkDistance(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		Distance(-23.5505, -46.6333, -22.9068, -43.1729)
+	}
+}
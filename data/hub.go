@@ -0,0 +1,109 @@
+package data
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// subscriptionBufferSize is the number of events which may be queued for a
+// subscriber before new events start to be dropped.
+const subscriptionBufferSize = 16
+
+// EventType represents which kind of change happened to a bus.
+type EventType string
+
+const (
+	// BusCreated is the type of the event sent after a bus is created.
+	BusCreated EventType = "created"
+	// BusUpdated is the type of the event sent after a bus is updated.
+	BusUpdated EventType = "updated"
+	// BusDeleted is the type of the event sent after a bus is deleted.
+	BusDeleted EventType = "deleted"
+)
+
+// BusEvent represents a change on a bus which has been successfully stored in
+// the repository. Deleted buses only contain their ID.
+type BusEvent struct {
+	Type EventType
+	Bus  Bus
+}
+
+// hub is an in-process publish/subscribe mechanism which delivers bus events
+// to every interested subscriber.
+type hub struct {
+	mu          sync.Mutex
+	subscribers map[chan BusEvent]string
+	closed      bool
+}
+
+func newHub() *hub {
+	return &hub{
+		subscribers: make(map[chan BusEvent]string),
+	}
+}
+
+// subscribe registers a new subscriber for the events of the bus with the
+// specified ID, or for the events of all buses if busID is empty.
+func (h *hub) subscribe(busID string) chan BusEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan BusEvent, subscriptionBufferSize)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+
+	h.subscribers[ch] = busID
+
+	return ch
+}
+
+// unsubscribe removes a subscriber and closes its channel. It's safe to call
+// it more than once for the same channel.
+func (h *hub) unsubscribe(ch chan BusEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.subscribers[ch]; exists {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish delivers an event to all interested subscribers. It never blocks: if
+// a subscriber isn't keeping up with the events, the event is dropped for that
+// subscriber.
+func (h *hub) publish(e BusEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, busID := range h.subscribers {
+		if len(busID) > 0 && busID != e.Bus.ID {
+			continue
+		}
+
+		select {
+		case ch <- e:
+		default:
+			logrus.WithFields(logrus.Fields{
+				"type":   e.Type,
+				"bus_id": e.Bus.ID,
+			}).Warn("subscriber is too slow; dropping bus event")
+		}
+	}
+}
+
+// close closes the channels of all subscribers. Subscribing after the hub has
+// been closed returns an already closed channel.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+	h.closed = true
+}
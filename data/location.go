@@ -0,0 +1,23 @@
+package data
+
+import "time"
+
+// Location represents a position of a bus at some point in time. Every time a
+// bus is updated, its new position is appended to the bus location history.
+type Location struct {
+	ID         int64
+	BusID      string `db:"bus_id"`
+	Latitude   float64
+	Longitude  float64
+	RecordedAt time.Time `db:"recorded_at"`
+}
+
+// nullTime converts a zero time to a SQL NULL value, so it can be used as an
+// optional query parameter.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
@@ -0,0 +1,430 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+type memorySource struct {
+	mu             sync.RWMutex
+	buses          map[string]Bus
+	locations      map[string][]Location
+	lastLocationID int64
+	deletions      map[string]time.Time
+	apiKeys        map[string]APIKey
+}
+
+// NewMemoryRepository creates a new repository which keeps all its data in
+// memory. It's safe for concurrent use and it doesn't need any external
+// database, but all data is lost when the repository is closed. It's mostly
+// useful for tests and local development.
+func NewMemoryRepository() *Repository {
+	logrus.Debug("creating in-memory repository")
+
+	src := &memorySource{
+		buses:     make(map[string]Bus),
+		locations: make(map[string][]Location),
+		deletions: make(map[string]time.Time),
+		apiKeys:   make(map[string]APIKey),
+	}
+
+	return newRepositoryFromSource(src)
+}
+
+func (src *memorySource) CreateBus(ctx context.Context, bus Bus) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if _, exists := src.buses[bus.ID]; exists {
+		return errors.WithMessage(DuplicateError{bus.ID}, "bus with the same ID already exists")
+	}
+
+	src.buses[bus.ID] = bus
+
+	return nil
+}
+
+func (src *memorySource) UpdateBusTokenHash(ctx context.Context, id string, tokenHash []byte) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	bus, exists := src.buses[id]
+	if !exists {
+		return errors.WithMessage(ErrNoSuchRow, "no bus token has been updated")
+	}
+
+	bus.TokenHash = tokenHash
+	src.buses[id] = bus
+
+	return nil
+}
+
+func (src *memorySource) DeleteBus(ctx context.Context, id string) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if _, exists := src.buses[id]; !exists {
+		return errors.WithMessage(ErrNoSuchRow, "no rows have been deleted")
+	}
+
+	delete(src.buses, id)
+	delete(src.locations, id)
+
+	return nil
+}
+
+func (src *memorySource) CreateBusDeletion(ctx context.Context, id string, deletedAt time.Time) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	src.deletions[id] = deletedAt
+
+	return nil
+}
+
+func (src *memorySource) ReadBusDeletionsSince(ctx context.Context, since time.Time) ([]string, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var ids []string
+
+	for id, deletedAt := range src.deletions {
+		if _, exists := src.buses[id]; !exists && !deletedAt.Before(since) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if ti, tj := src.deletions[ids[i]], src.deletions[ids[j]]; !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return ids[i] < ids[j]
+	})
+
+	return ids, nil
+}
+
+func (src *memorySource) ReadAllBuses(ctx context.Context) ([]Bus, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var buses []Bus
+
+	for _, b := range src.buses {
+		buses = append(buses, b)
+	}
+
+	sort.Slice(buses, func(i, j int) bool {
+		return buses[i].ID < buses[j].ID
+	})
+
+	return buses, nil
+}
+
+func (src *memorySource) ReadBusesPage(ctx context.Context, page Page) ([]Bus, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	keys := page.sortKeys()
+	backwards := len(page.Before) > 0
+
+	var cursor Bus
+	if len(page.After) > 0 || backwards {
+		var err error
+
+		cursor, err = page.cursor(ctx, src.readBus)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buses []Bus
+
+	for _, b := range src.buses {
+		if len(page.After) > 0 && compareBuses(b, cursor, keys) <= 0 {
+			continue
+		}
+		if backwards && compareBuses(b, cursor, keys) >= 0 {
+			continue
+		}
+
+		buses = append(buses, b)
+	}
+
+	sort.Slice(buses, func(i, j int) bool {
+		return compareBuses(buses[i], buses[j], keys) < 0
+	})
+
+	if len(buses) > page.Size {
+		if backwards {
+			buses = buses[len(buses)-page.Size:]
+		} else {
+			buses = buses[:page.Size]
+		}
+	}
+
+	return buses, nil
+}
+
+func (src *memorySource) CountBuses(ctx context.Context) (int, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	return len(src.buses), nil
+}
+
+func (src *memorySource) ReadNearbyBuses(ctx context.Context, lat, lng, radius float64) ([]Bus, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var buses []Bus
+
+	for _, b := range src.buses {
+		buses = append(buses, b)
+	}
+
+	return nearestBuses(buses, lat, lng, radius), nil
+}
+
+func (src *memorySource) ReadBusesInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]Bus, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var buses []Bus
+
+	for _, b := range src.buses {
+		if inBox(b.Latitude, b.Longitude, minLat, minLng, maxLat, maxLng) {
+			buses = append(buses, b)
+		}
+	}
+
+	sort.Slice(buses, func(i, j int) bool {
+		return buses[i].ID < buses[j].ID
+	})
+
+	return buses, nil
+}
+
+func (src *memorySource) ReadBusesUpdatedSince(ctx context.Context, since time.Time) ([]Bus, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var buses []Bus
+
+	for _, b := range src.buses {
+		if !b.UpdatedAt.Before(since) {
+			buses = append(buses, b)
+		}
+	}
+
+	sort.Slice(buses, func(i, j int) bool {
+		return compareBuses(buses[i], buses[j], []SortKey{{Field: "updated_at"}, {Field: "id"}}) < 0
+	})
+
+	return buses, nil
+}
+
+func (src *memorySource) ReadBus(ctx context.Context, id string) (Bus, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	return src.readBus(ctx, id)
+}
+
+// readBus reads a bus while the lock is already held.
+func (src *memorySource) readBus(ctx context.Context, id string) (Bus, error) {
+	bus, exists := src.buses[id]
+	if !exists {
+		return Bus{}, errors.WithMessage(ErrNoSuchRow, "bus not found")
+	}
+
+	return bus, nil
+}
+
+func (src *memorySource) UpdateBus(ctx context.Context, bus Bus, previousUpdatedAt time.Time) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	existingBus, exists := src.buses[bus.ID]
+	if !exists {
+		return errors.WithMessage(ErrNoSuchRow, "no rows were updated")
+	}
+
+	if existingBus.RecordedAt.After(bus.RecordedAt) {
+		return errors.WithMessage(ErrOutdatedPosition, "bus has a newer position")
+	}
+
+	if !previousUpdatedAt.IsZero() && !existingBus.UpdatedAt.Equal(previousUpdatedAt) {
+		return errors.WithMessage(ErrConcurrentUpdate, "bus has been updated since it was read")
+	}
+
+	// only the same columns as the other sources are updated
+	existingBus.Latitude = bus.Latitude
+	existingBus.Longitude = bus.Longitude
+	existingBus.Speed = bus.Speed
+	existingBus.Heading = bus.Heading
+	existingBus.Accuracy = bus.Accuracy
+	existingBus.Altitude = bus.Altitude
+	existingBus.RecordedAt = bus.RecordedAt
+	existingBus.UpdatedAt = bus.UpdatedAt
+	src.buses[bus.ID] = existingBus
+
+	return nil
+}
+
+func (src *memorySource) CreateLocation(ctx context.Context, loc Location) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if _, exists := src.buses[loc.BusID]; !exists {
+		return errors.WithMessage(ErrNoSuchRow, "bus not found")
+	}
+
+	src.lastLocationID++
+	loc.ID = src.lastLocationID
+	src.locations[loc.BusID] = append(src.locations[loc.BusID], loc)
+
+	return nil
+}
+
+func (src *memorySource) ReadLocations(ctx context.Context, busID string, since, until time.Time) ([]Location, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var locations []Location
+
+	for _, l := range src.locations[busID] {
+		if !since.IsZero() && l.RecordedAt.Before(since) {
+			continue
+		}
+		if !until.IsZero() && l.RecordedAt.After(until) {
+			continue
+		}
+
+		locations = append(locations, l)
+	}
+
+	sort.SliceStable(locations, func(i, j int) bool {
+		return locations[i].RecordedAt.Before(locations[j].RecordedAt)
+	})
+
+	return locations, nil
+}
+
+func (src *memorySource) CreateAPIKey(ctx context.Context, key APIKey) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if _, exists := src.apiKeys[key.ID]; exists {
+		return errors.WithMessage(DuplicateError{key.ID}, "API key with the same ID already exists")
+	}
+
+	src.apiKeys[key.ID] = key
+
+	return nil
+}
+
+func (src *memorySource) ReadAllAPIKeys(ctx context.Context) ([]APIKey, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var keys []APIKey
+
+	for _, k := range src.apiKeys {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (src *memorySource) ReadAPIKey(ctx context.Context, id string) (APIKey, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	key, exists := src.apiKeys[id]
+	if !exists {
+		return APIKey{}, errors.WithMessage(ErrNoSuchRow, "API key not found")
+	}
+
+	return key, nil
+}
+
+func (src *memorySource) RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	key, exists := src.apiKeys[id]
+	if !exists || key.Revoked() {
+		return errors.WithMessage(ErrNoSuchRow, "no active API key has been revoked")
+	}
+
+	key.RevokedAt = &revokedAt
+	src.apiKeys[id] = key
+
+	return nil
+}
+
+// WithTx calls f with a copy of the data, which replaces the original one only
+// if f succeeds. The other operations wait until the transaction is finished.
+func (src *memorySource) WithTx(ctx context.Context, f func(Source) error) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	txSrc := &memorySource{
+		buses:          make(map[string]Bus, len(src.buses)),
+		locations:      make(map[string][]Location, len(src.locations)),
+		lastLocationID: src.lastLocationID,
+		deletions:      make(map[string]time.Time, len(src.deletions)),
+		apiKeys:        make(map[string]APIKey, len(src.apiKeys)),
+	}
+	for id, bus := range src.buses {
+		txSrc.buses[id] = bus
+	}
+	for id, deletedAt := range src.deletions {
+		txSrc.deletions[id] = deletedAt
+	}
+	for id, key := range src.apiKeys {
+		txSrc.apiKeys[id] = key
+	}
+	for busID, locations := range src.locations {
+		// limiting the capacity makes the copy allocate a new array when
+		// appending, so the original locations stay untouched
+		txSrc.locations[busID] = locations[:len(locations):len(locations)]
+	}
+
+	if err := f(txSrc); err != nil {
+		return err
+	}
+
+	src.buses = txSrc.buses
+	src.locations = txSrc.locations
+	src.lastLocationID = txSrc.lastLocationID
+	src.deletions = txSrc.deletions
+	src.apiKeys = txSrc.apiKeys
+
+	return nil
+}
+
+func (src *memorySource) Close() error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	src.buses = make(map[string]Bus)
+	src.locations = make(map[string][]Location)
+	src.deletions = make(map[string]time.Time)
+	src.apiKeys = make(map[string]APIKey)
+
+	return nil
+}
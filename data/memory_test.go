@@ -0,0 +1,60 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMemoryRepository(t *testing.T) {
+	memRepo := NewMemoryRepository()
+
+	buses, err := memRepo.ReadAllBuses(context.Background())
+	require.NoError(t, err, "failed to read all buses")
+	assert.Empty(t, buses)
+
+	assert.NoError(t, memRepo.Close())
+}
+
+func TestMemorySource_concurrency(t *testing.T) {
+	memRepo := NewMemoryRepository()
+	defer memRepo.Close()
+
+	nBuses := 8
+
+	var wg sync.WaitGroup
+	for i := 0; i < nBuses; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			bus := Bus{
+				ID:        fmt.Sprintf("test-memory-%v", i),
+				Latitude:  1.23,
+				Longitude: 4.56,
+			}
+			if _, err := memRepo.CreateBus(context.Background(), bus); err != nil {
+				t.Error(err)
+				return
+			}
+
+			bus.Latitude = float64(i)
+			if _, err := memRepo.UpdateBus(context.Background(), bus); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	buses, err := memRepo.ReadAllBuses(context.Background())
+	require.NoError(t, err, "failed to read all buses")
+	require.Len(t, buses, nBuses)
+	for i, b := range buses {
+		assert.Equal(t, fmt.Sprintf("test-memory-%v", i), b.ID, "buses should be ordered by ID")
+		assert.Equal(t, float64(i), b.Latitude, "bus latitude")
+	}
+}
@@ -0,0 +1,213 @@
+package data
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// migration is a versioned change to the database schema. The SQL statements
+// in up apply the change, and the ones in down revert it.
+type migration struct {
+	version     int
+	description string
+	up          string
+	down        string
+}
+
+// Migrator changes the schema of a database by applying or reverting its
+// migrations in order. Each migration runs in its own transaction, and the
+// versions which have been applied are stored in the table
+// "schema_migrations". After using the migrator, the user must call Close.
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []migration
+}
+
+// NewPostgresMigrator creates a migrator for the PostgreSQL database at url.
+// The connection URL is the same one used by the command "psql".
+func NewPostgresMigrator(url string) (*Migrator, error) {
+	logrus.WithFields(logrus.Fields{
+		"url": url,
+	}).Debug("opening connection to Postgres for migrations")
+	db, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open a Postgres connection")
+	}
+
+	return &Migrator{db: db, migrations: postgresMigrations}, nil
+}
+
+// NewSQLiteMigrator creates a migrator for the SQLite database stored in the
+// file at path. The file is created if it doesn't exist yet.
+func NewSQLiteMigrator(path string) (*Migrator, error) {
+	logrus.WithFields(logrus.Fields{
+		"path": path,
+	}).Debug("opening SQLite database for migrations")
+
+	// some migrations rebuild tables, which would delete the rows referencing
+	// them if foreign keys were enabled
+	dsn := path
+	if strings.ContainsRune(dsn, '?') {
+		dsn += "&_foreign_keys=0"
+	} else {
+		dsn += "?_foreign_keys=0"
+	}
+
+	db, err := sqlx.Connect("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open a SQLite database")
+	}
+
+	db.SetMaxOpenConns(1)
+
+	return &Migrator{db: db, migrations: sqliteMigrations}, nil
+}
+
+// Version returns the current schema version of the database. A database
+// without any migration has version 0.
+func (m *Migrator) Version() (int, error) {
+	return schemaVersion(m.db)
+}
+
+// LatestVersion returns the schema version after applying all migrations.
+func (m *Migrator) LatestVersion() int {
+	return len(m.migrations)
+}
+
+// MigrateTo applies or reverts migrations until the database schema is at
+// version.
+func (m *Migrator) MigrateTo(version int) error {
+	return migrateTo(m.db, m.migrations, version)
+}
+
+func (m *Migrator) Close() error {
+	if err := m.db.Close(); err != nil {
+		return errors.Wrap(err, "failed to close migration database")
+	}
+
+	return nil
+}
+
+// schemaVersion reads the current schema version of the database, creating the
+// table which stores it if needed.
+func schemaVersion(db *sqlx.DB) (int, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL
+		)`)
+	if err != nil {
+		return 0, errors.Wrap(err, "error creating the table \"schema_migrations\"")
+	}
+
+	var version int
+
+	if err := db.Get(&version, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`); err != nil {
+		return 0, errors.Wrap(err, "failed to read schema version")
+	}
+
+	return version, nil
+}
+
+// checkSchemaVersion makes sure the database has all migrations applied, and
+// not any unknown one.
+func checkSchemaVersion(db *sqlx.DB, migrations []migration) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version != len(migrations) {
+		err := SchemaVersionError{
+			Version:         version,
+			ExpectedVersion: len(migrations),
+		}
+		return errors.WithMessage(err, "database schema must be migrated")
+	}
+
+	return nil
+}
+
+func migrateTo(db *sqlx.DB, migrations []migration, version int) error {
+	if version < 0 || version > len(migrations) {
+		err := InvalidParameterError{
+			Name:  "version",
+			Value: version,
+		}
+		return errors.WithMessage(err, "schema version doesn't exist")
+	}
+
+	currentVersion, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if currentVersion > len(migrations) {
+		err := SchemaVersionError{
+			Version:         currentVersion,
+			ExpectedVersion: len(migrations),
+		}
+		return errors.WithMessage(err, "database schema is newer than the known migrations")
+	}
+
+	for ; currentVersion < version; currentVersion++ {
+		if err := applyMigration(db, migrations[currentVersion], true); err != nil {
+			return err
+		}
+	}
+
+	for ; currentVersion > version; currentVersion-- {
+		if err := applyMigration(db, migrations[currentVersion-1], false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyMigration applies (if up is true) or reverts a migration, and records
+// it in the table "schema_migrations", in the same transaction.
+func applyMigration(db *sqlx.DB, m migration, up bool) error {
+	logFields := logrus.WithFields(logrus.Fields{
+		"version":     m.version,
+		"description": m.description,
+	})
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	// rolling back has no effect after the transaction is committed
+	defer tx.Rollback()
+
+	if up {
+		logFields.Info("applying database migration")
+
+		if _, err := tx.Exec(m.up); err != nil {
+			return errors.Wrapf(err, "error applying migration %v", m.version)
+		}
+
+		_, err = tx.Exec(tx.Rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+			m.version, time.Now().UTC())
+	} else {
+		logFields.Info("reverting database migration")
+
+		if _, err := tx.Exec(m.down); err != nil {
+			return errors.Wrapf(err, "error reverting migration %v", m.version)
+		}
+
+		_, err = tx.Exec(tx.Rebind(`DELETE FROM schema_migrations WHERE version = ?`), m.version)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to record migration %v", m.version)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return nil
+}
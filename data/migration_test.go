@@ -0,0 +1,107 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations_versions(t *testing.T) {
+	for name, migrations := range map[string][]migration{
+		"postgres": postgresMigrations,
+		"sqlite":   sqliteMigrations,
+	} {
+		t.Run(name, func(subT *testing.T) {
+			for i, m := range migrations {
+				assert.Equal(subT, i+1, m.version, "migrations must be sorted by version, starting at 1")
+				assert.NotEmpty(subT, m.description, "migration %v must have a description", m.version)
+				assert.NotEmpty(subT, m.up, "migration %v must be applicable", m.version)
+				assert.NotEmpty(subT, m.down, "migration %v must be revertible", m.version)
+			}
+		})
+	}
+
+	assert.Equal(t, len(postgresMigrations), len(sqliteMigrations), "every database must have the same migrations")
+}
+
+func TestMigrator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motofretado")
+	require.NoError(t, err, "failed to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.db")
+
+	migrator, err := NewSQLiteMigrator(path)
+	require.NoError(t, err, "failed to open database for migrations")
+	defer migrator.Close()
+
+	version, err := migrator.Version()
+	require.NoError(t, err, "failed to read schema version")
+	assert.Equal(t, 0, version, "a new database shouldn't have any migration")
+
+	t.Run("invalid version", func(subT *testing.T) {
+		err := migrator.MigrateTo(migrator.LatestVersion() + 1)
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "version", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("up", func(subT *testing.T) {
+		require.NoError(subT, migrator.MigrateTo(migrator.LatestVersion()), "failed to migrate database")
+
+		version, err := migrator.Version()
+		require.NoError(subT, err, "failed to read schema version")
+		assert.Equal(subT, migrator.LatestVersion(), version, "all migrations should be applied")
+	})
+
+	bus := Bus{
+		ID:        "test-migration",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	testRepo, err := NewSQLiteRepository(path)
+	require.NoError(t, err, "failed to open migrated database")
+	_, err = testRepo.CreateBus(context.Background(), bus)
+	require.NoError(t, err, "failed to create bus")
+	_, err = testRepo.UpdateBus(context.Background(), bus)
+	require.NoError(t, err, "failed to update bus")
+	require.NoError(t, testRepo.Close(), "failed to close database")
+
+	t.Run("down and up", func(subT *testing.T) {
+		// the rebuilt tables must keep their rows and the rows referencing them
+		require.NoError(subT, migrator.MigrateTo(2), "failed to revert migrations")
+		require.NoError(subT, migrator.MigrateTo(migrator.LatestVersion()), "failed to reapply migrations")
+
+		testRepo, err := NewSQLiteRepository(path)
+		require.NoError(subT, err, "failed to open migrated database")
+		defer testRepo.Close()
+
+		existingBus, err := testRepo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, bus.Latitude, existingBus.Latitude, "bus latitude")
+		assert.True(subT, existingBus.RecordedAt.Equal(existingBus.UpdatedAt), "the recording time should be the update time")
+
+		locations, err := testRepo.ReadLocations(context.Background(), bus.ID, time.Time{}, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		assert.Len(subT, locations, 1, "the locations should be kept")
+	})
+
+	t.Run("down", func(subT *testing.T) {
+		require.NoError(subT, migrator.MigrateTo(0), "failed to revert migrations")
+
+		version, err := migrator.Version()
+		require.NoError(subT, err, "failed to read schema version")
+		assert.Equal(subT, 0, version, "all migrations should be reverted")
+	})
+}
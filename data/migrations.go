@@ -0,0 +1,212 @@
+package data
+
+// The migrations of each database must be sorted by version, starting at 1.
+// A migration must never be changed after it's released; any change to the
+// schema needs a new migration instead. The first migrations don't fail on
+// existing tables because those used to be created without migrations.
+
+var postgresMigrations = []migration{
+	{
+		version:     1,
+		description: "create buses and their locations",
+		up: `CREATE TABLE IF NOT EXISTS buses (
+				id TEXT PRIMARY KEY,
+				latitude FLOAT8 NOT NULL,
+				longitude FLOAT8 NOT NULL,
+				updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+			CREATE TABLE IF NOT EXISTS bus_locations (
+				id BIGSERIAL PRIMARY KEY,
+				bus_id TEXT NOT NULL REFERENCES buses (id) ON DELETE CASCADE,
+				latitude FLOAT8 NOT NULL,
+				longitude FLOAT8 NOT NULL,
+				recorded_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS bus_locations_bus_id_recorded_at_idx ON bus_locations (bus_id, recorded_at)`,
+		down: `DROP TABLE bus_locations;
+			DROP TABLE buses`,
+	},
+	{
+		version:     2,
+		description: "index bus positions and update times",
+		up: `CREATE INDEX IF NOT EXISTS buses_latitude_longitude_idx ON buses (latitude, longitude);
+			CREATE INDEX IF NOT EXISTS buses_updated_at_idx ON buses (updated_at)`,
+		down: `DROP INDEX buses_latitude_longitude_idx;
+			DROP INDEX buses_updated_at_idx`,
+	},
+	{
+		version:     3,
+		description: "add bus telemetry",
+		up: `ALTER TABLE buses
+				ADD COLUMN IF NOT EXISTS speed FLOAT8,
+				ADD COLUMN IF NOT EXISTS heading FLOAT8,
+				ADD COLUMN IF NOT EXISTS accuracy FLOAT8,
+				ADD COLUMN IF NOT EXISTS altitude FLOAT8`,
+		down: `ALTER TABLE buses
+				DROP COLUMN speed,
+				DROP COLUMN heading,
+				DROP COLUMN accuracy,
+				DROP COLUMN altitude`,
+	},
+	{
+		version:     4,
+		description: "add bus position recording time",
+		// the existing positions are assumed to be as old as their last update
+		up: `ALTER TABLE buses ADD COLUMN IF NOT EXISTS recorded_at TIMESTAMP WITH TIME ZONE;
+			UPDATE buses SET recorded_at = updated_at WHERE recorded_at IS NULL;
+			ALTER TABLE buses ALTER COLUMN recorded_at SET NOT NULL`,
+		down: `ALTER TABLE buses DROP COLUMN recorded_at`,
+	},
+	{
+		version:     5,
+		description: "create API keys",
+		up: `CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				secret_hash BYTEA NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				revoked_at TIMESTAMP WITH TIME ZONE
+			)`,
+		down: `DROP TABLE api_keys`,
+	},
+	{
+		version:     6,
+		description: "add bus tokens",
+		up:          `ALTER TABLE buses ADD COLUMN token_hash BYTEA`,
+		down:        `ALTER TABLE buses DROP COLUMN token_hash`,
+	},
+	{
+		version:     7,
+		description: "record bus deletions",
+		up: `CREATE TABLE bus_deletions (
+				bus_id TEXT PRIMARY KEY,
+				deleted_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+			CREATE INDEX bus_deletions_deleted_at_idx ON bus_deletions (deleted_at)`,
+		down: `DROP TABLE bus_deletions`,
+	},
+}
+
+// SQLite can't drop columns, so the tables must be rebuilt instead.
+var sqliteMigrations = []migration{
+	{
+		version:     1,
+		description: "create buses and their locations",
+		up: `CREATE TABLE IF NOT EXISTS buses (
+				id TEXT PRIMARY KEY NOT NULL,
+				latitude REAL NOT NULL,
+				longitude REAL NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+			CREATE TABLE IF NOT EXISTS bus_locations (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				bus_id TEXT NOT NULL REFERENCES buses (id) ON DELETE CASCADE,
+				latitude REAL NOT NULL,
+				longitude REAL NOT NULL,
+				recorded_at TIMESTAMP NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS bus_locations_bus_id_recorded_at_idx ON bus_locations (bus_id, recorded_at)`,
+		down: `DROP TABLE bus_locations;
+			DROP TABLE buses`,
+	},
+	{
+		version:     2,
+		description: "index bus positions and update times",
+		up: `CREATE INDEX IF NOT EXISTS buses_latitude_longitude_idx ON buses (latitude, longitude);
+			CREATE INDEX IF NOT EXISTS buses_updated_at_idx ON buses (updated_at)`,
+		down: `DROP INDEX buses_latitude_longitude_idx;
+			DROP INDEX buses_updated_at_idx`,
+	},
+	{
+		version:     3,
+		description: "add bus telemetry",
+		up: `ALTER TABLE buses ADD COLUMN speed REAL;
+			ALTER TABLE buses ADD COLUMN heading REAL;
+			ALTER TABLE buses ADD COLUMN accuracy REAL;
+			ALTER TABLE buses ADD COLUMN altitude REAL`,
+		down: `CREATE TABLE buses_old (
+				id TEXT PRIMARY KEY NOT NULL,
+				latitude REAL NOT NULL,
+				longitude REAL NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+			INSERT INTO buses_old (id, latitude, longitude, updated_at, created_at)
+				SELECT id, latitude, longitude, updated_at, created_at FROM buses;
+			DROP TABLE buses;
+			ALTER TABLE buses_old RENAME TO buses;
+			CREATE INDEX buses_latitude_longitude_idx ON buses (latitude, longitude);
+			CREATE INDEX buses_updated_at_idx ON buses (updated_at)`,
+	},
+	{
+		version:     4,
+		description: "add bus position recording time",
+		// the existing positions are assumed to be as old as their last update
+		up: `ALTER TABLE buses ADD COLUMN recorded_at TIMESTAMP;
+			UPDATE buses SET recorded_at = updated_at`,
+		down: `CREATE TABLE buses_old (
+				id TEXT PRIMARY KEY NOT NULL,
+				latitude REAL NOT NULL,
+				longitude REAL NOT NULL,
+				speed REAL,
+				heading REAL,
+				accuracy REAL,
+				altitude REAL,
+				updated_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+			INSERT INTO buses_old (id, latitude, longitude, speed, heading, accuracy, altitude, updated_at, created_at)
+				SELECT id, latitude, longitude, speed, heading, accuracy, altitude, updated_at, created_at FROM buses;
+			DROP TABLE buses;
+			ALTER TABLE buses_old RENAME TO buses;
+			CREATE INDEX buses_latitude_longitude_idx ON buses (latitude, longitude);
+			CREATE INDEX buses_updated_at_idx ON buses (updated_at)`,
+	},
+	{
+		version:     5,
+		description: "create API keys",
+		up: `CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY NOT NULL,
+				name TEXT NOT NULL,
+				secret_hash BLOB NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP
+			)`,
+		down: `DROP TABLE api_keys`,
+	},
+	{
+		version:     6,
+		description: "add bus tokens",
+		up:          `ALTER TABLE buses ADD COLUMN token_hash BLOB`,
+		down: `CREATE TABLE buses_old (
+				id TEXT PRIMARY KEY NOT NULL,
+				latitude REAL NOT NULL,
+				longitude REAL NOT NULL,
+				speed REAL,
+				heading REAL,
+				accuracy REAL,
+				altitude REAL,
+				recorded_at TIMESTAMP,
+				updated_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+			INSERT INTO buses_old (id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, updated_at, created_at)
+				SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, updated_at, created_at FROM buses;
+			DROP TABLE buses;
+			ALTER TABLE buses_old RENAME TO buses;
+			CREATE INDEX buses_latitude_longitude_idx ON buses (latitude, longitude);
+			CREATE INDEX buses_updated_at_idx ON buses (updated_at)`,
+	},
+	{
+		version:     7,
+		description: "record bus deletions",
+		up: `CREATE TABLE bus_deletions (
+				bus_id TEXT PRIMARY KEY NOT NULL,
+				deleted_at TIMESTAMP NOT NULL
+			);
+			CREATE INDEX bus_deletions_deleted_at_idx ON bus_deletions (deleted_at)`,
+		down: `DROP TABLE bus_deletions`,
+	},
+}
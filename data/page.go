@@ -0,0 +1,200 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Page selects a range of buses ordered by Sort. At most Size buses are read,
+// starting right after the bus with ID After or ending right before the bus
+// with ID Before; at most one of them may be set. If none of them are set, the
+// page starts at the first bus.
+type Page struct {
+	Size   int
+	After  string
+	Before string
+	Sort   []SortKey
+}
+
+// SortKey selects a bus field used to sort buses. The field names are the
+// same as the database columns (e.g. "updated_at").
+type SortKey struct {
+	Field      string
+	Descending bool
+}
+
+// sortFields contains the names of the fields which may be used to sort buses.
+var sortFields = map[string]bool{
+	"id":         true,
+	"latitude":   true,
+	"longitude":  true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// sortKeys returns the keys used to sort the buses in the page. The ID is
+// always the last key, so the order is the same on every request.
+func (page Page) sortKeys() []SortKey {
+	keys := make([]SortKey, 0, len(page.Sort)+1)
+
+	for _, k := range page.Sort {
+		keys = append(keys, k)
+		if k.Field == "id" {
+			return keys
+		}
+	}
+
+	return append(keys, SortKey{Field: "id"})
+}
+
+// cursor returns the bus right before (or after) the page. Only its ID is
+// needed when the buses are sorted by ID, so it doesn't even need to exist in
+// that case.
+func (page Page) cursor(ctx context.Context, readBus func(context.Context, string) (Bus, error)) (Bus, error) {
+	id, param := page.After, "after"
+	if len(page.Before) > 0 {
+		id, param = page.Before, "before"
+	}
+
+	if keys := page.sortKeys(); len(keys) == 1 {
+		return Bus{ID: id}, nil
+	}
+
+	bus, err := readBus(ctx, id)
+	if err != nil {
+		if errors.Cause(err) == ErrNoSuchRow {
+			err := InvalidParameterError{
+				Name:  param,
+				Value: id,
+			}
+			return Bus{}, errors.WithMessage(err, "page cursor not found")
+		}
+		return Bus{}, errors.Wrap(err, "failed to read page cursor")
+	}
+
+	return bus, nil
+}
+
+// compareBuses compares two buses using the sort keys. It returns a negative
+// number if a comes before b, a positive number if a comes after b, and zero
+// if they have the same position.
+func compareBuses(a, b Bus, keys []SortKey) int {
+	for _, k := range keys {
+		var cmp int
+
+		switch k.Field {
+		case "id":
+			cmp = strings.Compare(a.ID, b.ID)
+		case "latitude":
+			cmp = compareFloats(a.Latitude, b.Latitude)
+		case "longitude":
+			cmp = compareFloats(a.Longitude, b.Longitude)
+		case "created_at":
+			cmp = compareTimes(a.CreatedAt, b.CreatedAt)
+		case "updated_at":
+			cmp = compareTimes(a.UpdatedAt, b.UpdatedAt)
+		}
+
+		if k.Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// pageQuery builds the SQL query which selects the buses in the page, using
+// "?" as the parameter placeholder. The buses are selected in reverse order
+// when the page is read with Before.
+func pageQuery(page Page, cursor Bus) (string, []interface{}) {
+	keys := page.sortKeys()
+	backwards := len(page.Before) > 0
+	hasCursor := len(page.After) > 0 || backwards
+
+	var args []interface{}
+	var conditions []string
+	var orderBy []string
+
+	for i, k := range keys {
+		descending := k.Descending != backwards
+
+		if descending {
+			orderBy = append(orderBy, k.Field+" DESC")
+		} else {
+			orderBy = append(orderBy, k.Field)
+		}
+
+		if !hasCursor {
+			continue
+		}
+
+		// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+		var terms []string
+		for _, prevKey := range keys[:i] {
+			terms = append(terms, prevKey.Field+" = ?")
+			args = append(args, busField(cursor, prevKey.Field))
+		}
+		if descending {
+			terms = append(terms, k.Field+" < ?")
+		} else {
+			terms = append(terms, k.Field+" > ?")
+		}
+		args = append(args, busField(cursor, k.Field))
+
+		conditions = append(conditions, "("+strings.Join(terms, " AND ")+")")
+	}
+
+	query := "SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses"
+	if hasCursor {
+		query += " WHERE " + strings.Join(conditions, " OR ")
+	}
+	query += fmt.Sprintf(" ORDER BY %v LIMIT ?", strings.Join(orderBy, ", "))
+	args = append(args, page.Size)
+
+	return query, args
+}
+
+func busField(bus Bus, field string) interface{} {
+	switch field {
+	case "latitude":
+		return bus.Latitude
+	case "longitude":
+		return bus.Longitude
+	case "created_at":
+		// SQLite compares timestamps as text, so they must all be in UTC
+		return bus.CreatedAt.UTC()
+	case "updated_at":
+		return bus.UpdatedAt.UTC()
+	default:
+		return bus.ID
+	}
+}
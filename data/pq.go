@@ -1,7 +1,9 @@
 package data
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
@@ -10,18 +12,36 @@ import (
 )
 
 type postgresSource struct {
-	db            *sqlx.DB
-	insertStmt    *sqlx.Stmt
-	selectAllStmt *sqlx.Stmt
-	selectStmt    *sqlx.Stmt
-	updateStmt    *sqlx.Stmt
-	deleteStmt    *sqlx.Stmt
+	db              *sqlx.DB
+	tx              *sqlx.Tx // only set inside WithTx
+	insertStmt      *sqlx.Stmt
+	selectAllStmt   *sqlx.Stmt
+	countStmt       *sqlx.Stmt
+	selectNearStmt  *sqlx.Stmt
+	selectBoxStmt   *sqlx.Stmt
+	selectSinceStmt *sqlx.Stmt
+	selectStmt      *sqlx.Stmt
+	lockStmt        *sqlx.Stmt
+	updateStmt      *sqlx.Stmt
+	updateTokenStmt *sqlx.Stmt
+	deleteStmt      *sqlx.Stmt
+
+	insertDeletionStmt  *sqlx.Stmt
+	selectDeletionsStmt *sqlx.Stmt
+
+	insertLocationStmt  *sqlx.Stmt
+	selectLocationsStmt *sqlx.Stmt
+
+	insertKeyStmt     *sqlx.Stmt
+	selectAllKeysStmt *sqlx.Stmt
+	selectKeyStmt     *sqlx.Stmt
+	revokeKeyStmt     *sqlx.Stmt
 }
 
 // NewPostgresRepository creates a new connection to a PostgreSQL database.
-// The connection URL is the same one used by the command "psql". All tables are
-// created during this function (if needed). After using the connection, the
-// user must call Close.
+// The connection URL is the same one used by the command "psql". The database
+// schema must have been migrated (see NewPostgresMigrator). After using the
+// connection, the user must call Close.
 func NewPostgresRepository(url string) (*Repository, error) {
 	logrus.WithFields(logrus.Fields{
 		"url": url,
@@ -31,46 +51,116 @@ func NewPostgresRepository(url string) (*Repository, error) {
 		return nil, errors.Wrap(err, "could not open a Postgres connection")
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS buses (
-			id TEXT PRIMARY KEY,
-			latitude FLOAT8 NOT NULL,
-			longitude FLOAT8 NOT NULL,
-			updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
-			created_at TIMESTAMP WITH TIME ZONE NOT NULL
-		)`)
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating the table \"buses\"")
+	if err := checkSchemaVersion(db, postgresMigrations); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	src := postgresSource{db: db}
-	src.insertStmt, err = db.Preparex(`INSERT INTO buses (id, latitude, longitude, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)`)
+	src.insertStmt, err = db.Preparex(`INSERT INTO buses (id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at, token_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to prepare INSERT statement")
 	}
-	src.selectAllStmt, err = db.Preparex(`SELECT id, latitude, longitude, created_at, updated_at FROM buses ORDER BY id`)
+	src.selectAllStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses ORDER BY id`)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to prepare SELECT (all) statement")
 	}
-	src.selectStmt, err = db.Preparex(`SELECT latitude, longitude, created_at, updated_at FROM buses WHERE id = $1`)
+	src.countStmt, err = db.Preparex(`SELECT COUNT(*) FROM buses`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (count) statement")
+	}
+	src.selectNearStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM (
+			SELECT *, 2 * $4::float8 * asin(sqrt(least(1,
+				power(sin(radians(latitude - $1) / 2), 2) +
+				cos(radians($1)) * cos(radians(latitude)) * power(sin(radians(longitude - $2) / 2), 2)))) AS distance
+			FROM buses
+		) AS b WHERE distance <= $3 ORDER BY distance, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (near) statement")
+	}
+	src.selectBoxStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses
+		WHERE latitude BETWEEN $1 AND $3 AND (
+			($2::float8 <= $4::float8 AND longitude BETWEEN $2 AND $4) OR
+			($2::float8 > $4::float8 AND (longitude >= $2 OR longitude <= $4))
+		) ORDER BY id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (box) statement")
+	}
+	src.selectSinceStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses
+		WHERE updated_at >= $1 ORDER BY updated_at, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (since) statement")
+	}
+	src.selectStmt, err = db.Preparex(`SELECT latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at, token_hash FROM buses WHERE id = $1`)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to prepare SELECT statement")
 	}
-	src.updateStmt, err = db.Preparex(`UPDATE buses SET latitude = $2, longitude = $3, updated_at = $4 WHERE id = $1`)
+	src.lockStmt, err = db.Preparex(`SELECT latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at, token_hash FROM buses WHERE id = $1
+		FOR UPDATE`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (lock) statement")
+	}
+	src.updateStmt, err = db.Preparex(`UPDATE buses SET latitude = $2, longitude = $3, speed = $4, heading = $5, accuracy = $6, altitude = $7,
+			recorded_at = $8, updated_at = $9
+		WHERE id = $1 AND recorded_at <= $8 AND ($10::timestamptz IS NULL OR updated_at = $10)`)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to prepare UPDATE statement")
 	}
+	src.updateTokenStmt, err = db.Preparex(`UPDATE buses SET token_hash = $2 WHERE id = $1`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare UPDATE (token) statement")
+	}
 	src.deleteStmt, err = db.Preparex(`DELETE FROM buses WHERE id = $1`)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to prepare DELETE statement")
 	}
+	src.insertDeletionStmt, err = db.Preparex(`INSERT INTO bus_deletions (bus_id, deleted_at) VALUES ($1, $2)
+		ON CONFLICT (bus_id) DO UPDATE SET deleted_at = EXCLUDED.deleted_at`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare INSERT (deletion) statement")
+	}
+	src.selectDeletionsStmt, err = db.Preparex(`SELECT bus_id FROM bus_deletions
+		WHERE deleted_at >= $1 AND NOT EXISTS (SELECT 1 FROM buses WHERE id = bus_id)
+		ORDER BY deleted_at, bus_id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (deletions) statement")
+	}
+	src.insertLocationStmt, err = db.Preparex(`INSERT INTO bus_locations (bus_id, latitude, longitude, recorded_at) VALUES ($1, $2, $3, $4)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare INSERT (location) statement")
+	}
+	src.selectLocationsStmt, err = db.Preparex(`SELECT id, bus_id, latitude, longitude, recorded_at FROM bus_locations
+		WHERE bus_id = $1 AND ($2::timestamptz IS NULL OR recorded_at >= $2) AND ($3::timestamptz IS NULL OR recorded_at <= $3)
+		ORDER BY recorded_at, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (locations) statement")
+	}
+	src.insertKeyStmt, err = db.Preparex(`INSERT INTO api_keys (id, name, secret_hash, created_at) VALUES ($1, $2, $3, $4)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare INSERT (API key) statement")
+	}
+	src.selectAllKeysStmt, err = db.Preparex(`SELECT id, name, secret_hash, created_at, revoked_at FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (all API keys) statement")
+	}
+	src.selectKeyStmt, err = db.Preparex(`SELECT id, name, secret_hash, created_at, revoked_at FROM api_keys WHERE id = $1`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (API key) statement")
+	}
+	src.revokeKeyStmt, err = db.Preparex(`UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare UPDATE (API key) statement")
+	}
 
-	return &Repository{src: src}, nil
+	return newRepositoryFromSource(src), nil
 }
 
-func (src postgresSource) CreateBus(bus Bus) error {
-	res, err := src.insertStmt.Exec(bus.ID, bus.Latitude, bus.Longitude, bus.CreatedAt, bus.UpdatedAt)
+func (src postgresSource) CreateBus(ctx context.Context, bus Bus) error {
+	res, err := src.stmt(ctx, src.insertStmt).ExecContext(ctx, bus.ID, bus.Latitude, bus.Longitude, bus.Speed, bus.Heading, bus.Accuracy, bus.Altitude,
+		bus.RecordedAt, bus.CreatedAt, bus.UpdatedAt, bus.TokenHash)
 	if err != nil {
-		if err.(*pq.Error).Code == "23505" { // unique_violation
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
 			return errors.WithMessage(DuplicateError{bus.ID}, "bus with the same ID already exists")
 		}
 		return errors.Wrap(err, "error creating bus")
@@ -87,8 +177,28 @@ func (src postgresSource) CreateBus(bus Bus) error {
 	return nil
 }
 
-func (src postgresSource) DeleteBus(id string) error {
-	res, err := src.deleteStmt.Exec(id)
+func (src postgresSource) UpdateBusTokenHash(ctx context.Context, id string, tokenHash []byte) error {
+	res, err := src.stmt(ctx, src.updateTokenStmt).ExecContext(ctx, id, tokenHash)
+	if err != nil {
+		return errors.Wrap(err, "error updating bus token")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows == 0 {
+		return errors.WithMessage(ErrNoSuchRow, "no bus token has been updated")
+	}
+	if nRows > 1 {
+		return errors.New("more rows than expected were updated")
+	}
+
+	return nil
+}
+
+func (src postgresSource) DeleteBus(ctx context.Context, id string) error {
+	res, err := src.stmt(ctx, src.deleteStmt).ExecContext(ctx, id)
 	if err != nil {
 		return errors.Wrap(err, "error deleting bus")
 	}
@@ -107,20 +217,114 @@ func (src postgresSource) DeleteBus(id string) error {
 	return nil
 }
 
-func (src postgresSource) ReadAllBuses() ([]Bus, error) {
+func (src postgresSource) CreateBusDeletion(ctx context.Context, id string, deletedAt time.Time) error {
+	if _, err := src.stmt(ctx, src.insertDeletionStmt).ExecContext(ctx, id, deletedAt); err != nil {
+		return errors.Wrap(err, "error recording bus deletion")
+	}
+
+	return nil
+}
+
+func (src postgresSource) ReadBusDeletionsSince(ctx context.Context, since time.Time) ([]string, error) {
+	var ids []string
+
+	if err := src.stmt(ctx, src.selectDeletionsStmt).SelectContext(ctx, &ids, since); err != nil {
+		return nil, errors.Wrap(err, "failed to read bus deletions")
+	}
+
+	return ids, nil
+}
+
+func (src postgresSource) ReadAllBuses(ctx context.Context) ([]Bus, error) {
 	var buses []Bus
 
-	if err := src.selectAllStmt.Select(&buses); err != nil {
+	if err := src.stmt(ctx, src.selectAllStmt).SelectContext(ctx, &buses); err != nil {
 		return nil, errors.Wrap(err, "failed to read all buses")
 	}
 
 	return buses, nil
 }
 
-func (src postgresSource) ReadBus(id string) (Bus, error) {
+func (src postgresSource) ReadBusesPage(ctx context.Context, page Page) ([]Bus, error) {
+	var cursor Bus
+	if len(page.After) > 0 || len(page.Before) > 0 {
+		var err error
+
+		cursor, err = page.cursor(ctx, src.ReadBus)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query, args := pageQuery(page, cursor)
+
+	var buses []Bus
+
+	if err := sqlx.SelectContext(ctx, src.queryer(), &buses, src.db.Rebind(query), args...); err != nil {
+		return nil, errors.Wrap(err, "failed to read page of buses")
+	}
+
+	if len(page.Before) > 0 {
+		// the previous page is read backwards
+		for i, j := 0, len(buses)-1; i < j; i, j = i+1, j-1 {
+			buses[i], buses[j] = buses[j], buses[i]
+		}
+	}
+
+	return buses, nil
+}
+
+func (src postgresSource) CountBuses(ctx context.Context) (int, error) {
+	var count int
+
+	if err := src.stmt(ctx, src.countStmt).GetContext(ctx, &count); err != nil {
+		return 0, errors.Wrap(err, "failed to count buses")
+	}
+
+	return count, nil
+}
+
+func (src postgresSource) ReadNearbyBuses(ctx context.Context, lat, lng, radius float64) ([]Bus, error) {
+	var buses []Bus
+
+	if err := src.stmt(ctx, src.selectNearStmt).SelectContext(ctx, &buses, lat, lng, radius, earthRadius); err != nil {
+		return nil, errors.Wrap(err, "failed to read nearby buses")
+	}
+
+	return buses, nil
+}
+
+func (src postgresSource) ReadBusesInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]Bus, error) {
+	var buses []Bus
+
+	if err := src.stmt(ctx, src.selectBoxStmt).SelectContext(ctx, &buses, minLat, minLng, maxLat, maxLng); err != nil {
+		return nil, errors.Wrap(err, "failed to read buses in box")
+	}
+
+	return buses, nil
+}
+
+func (src postgresSource) ReadBusesUpdatedSince(ctx context.Context, since time.Time) ([]Bus, error) {
+	var buses []Bus
+
+	if err := src.stmt(ctx, src.selectSinceStmt).SelectContext(ctx, &buses, since); err != nil {
+		return nil, errors.Wrap(err, "failed to read updated buses")
+	}
+
+	return buses, nil
+}
+
+func (src postgresSource) ReadBus(ctx context.Context, id string) (Bus, error) {
 	bus := Bus{ID: id}
 
-	if err := src.selectStmt.Get(&bus, id); err != nil {
+	// inside a transaction, the bus stays locked until the end of it, so it
+	// can't change between being read and updated
+	selectStmt := src.selectStmt
+	if src.tx != nil {
+		selectStmt = src.lockStmt
+	}
+
+	if err := src.stmt(ctx, selectStmt).GetContext(ctx, &bus, id); err != nil {
 		if err == sql.ErrNoRows {
 			return Bus{}, errors.WithMessage(ErrNoSuchRow, "bus not found")
 		}
@@ -131,8 +335,9 @@ func (src postgresSource) ReadBus(id string) (Bus, error) {
 	return bus, nil
 }
 
-func (src postgresSource) UpdateBus(bus Bus) error {
-	res, err := src.updateStmt.Exec(bus.ID, bus.Latitude, bus.Longitude, bus.UpdatedAt)
+func (src postgresSource) UpdateBus(ctx context.Context, bus Bus, previousUpdatedAt time.Time) error {
+	res, err := src.stmt(ctx, src.updateStmt).ExecContext(ctx, bus.ID, bus.Latitude, bus.Longitude, bus.Speed, bus.Heading, bus.Accuracy, bus.Altitude,
+		bus.RecordedAt, bus.UpdatedAt, nullTime(previousUpdatedAt))
 	if err != nil {
 		return errors.Wrap(err, "error updating bus")
 	}
@@ -142,7 +347,7 @@ func (src postgresSource) UpdateBus(bus Bus) error {
 		return errors.Wrap(err, "could not get number of affected rows")
 	}
 	if nRows == 0 {
-		return errors.WithMessage(ErrNoSuchRow, "no rows were updated")
+		return updateFailure(ctx, src.ReadBus, bus)
 	}
 	if nRows > 1 {
 		return errors.New("more rows than expected were updated")
@@ -151,7 +356,147 @@ func (src postgresSource) UpdateBus(bus Bus) error {
 	return nil
 }
 
+func (src postgresSource) CreateLocation(ctx context.Context, loc Location) error {
+	res, err := src.stmt(ctx, src.insertLocationStmt).ExecContext(ctx, loc.BusID, loc.Latitude, loc.Longitude, loc.RecordedAt)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" { // foreign_key_violation
+			return errors.WithMessage(ErrNoSuchRow, "bus not found")
+		}
+		return errors.Wrap(err, "error creating location")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows != 1 {
+		return errors.New("unexpected number of rows were inserted")
+	}
+
+	return nil
+}
+
+func (src postgresSource) ReadLocations(ctx context.Context, busID string, since, until time.Time) ([]Location, error) {
+	var locations []Location
+
+	if err := src.stmt(ctx, src.selectLocationsStmt).SelectContext(ctx, &locations, busID, nullTime(since), nullTime(until)); err != nil {
+		return nil, errors.Wrap(err, "failed to read locations")
+	}
+
+	return locations, nil
+}
+
+func (src postgresSource) CreateAPIKey(ctx context.Context, key APIKey) error {
+	_, err := src.stmt(ctx, src.insertKeyStmt).ExecContext(ctx, key.ID, key.Name, key.SecretHash, key.CreatedAt)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
+			return errors.WithMessage(DuplicateError{key.ID}, "API key with the same ID already exists")
+		}
+		return errors.Wrap(err, "error creating API key")
+	}
+
+	return nil
+}
+
+func (src postgresSource) ReadAllAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+
+	if err := src.stmt(ctx, src.selectAllKeysStmt).SelectContext(ctx, &keys); err != nil {
+		return nil, errors.Wrap(err, "failed to read all API keys")
+	}
+
+	return keys, nil
+}
+
+func (src postgresSource) ReadAPIKey(ctx context.Context, id string) (APIKey, error) {
+	var key APIKey
+
+	if err := src.stmt(ctx, src.selectKeyStmt).GetContext(ctx, &key, id); err != nil {
+		if err == sql.ErrNoRows {
+			return APIKey{}, errors.WithMessage(ErrNoSuchRow, "API key not found")
+		}
+
+		return APIKey{}, errors.Wrap(err, "error reading API key")
+	}
+
+	return key, nil
+}
+
+func (src postgresSource) RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error {
+	res, err := src.stmt(ctx, src.revokeKeyStmt).ExecContext(ctx, revokedAt, id)
+	if err != nil {
+		return errors.Wrap(err, "error revoking API key")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows == 0 {
+		return errors.WithMessage(ErrNoSuchRow, "no active API key has been revoked")
+	}
+
+	return nil
+}
+
+func (src postgresSource) WithTx(ctx context.Context, f func(Source) error) error {
+	return src.withTx(ctx, func(txSrc postgresSource) error {
+		return f(txSrc)
+	})
+}
+
+// withTx calls f with a copy of the source whose statements run in a new
+// transaction, or in the current one if there's already one.
+func (src postgresSource) withTx(ctx context.Context, f func(postgresSource) error) error {
+	if src.tx != nil {
+		return f(src)
+	}
+
+	tx, err := src.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	// rolling back has no effect after the transaction is committed
+	defer tx.Rollback()
+
+	txSrc := src
+	txSrc.tx = tx
+
+	if err := f(txSrc); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return nil
+}
+
+// stmt returns the prepared statement bound to the current transaction, if
+// there's one.
+func (src postgresSource) stmt(ctx context.Context, stmt *sqlx.Stmt) *sqlx.Stmt {
+	if src.tx == nil {
+		return stmt
+	}
+
+	return src.tx.StmtxContext(ctx, stmt)
+}
+
+// queryer returns where the statements which aren't prepared should run.
+func (src postgresSource) queryer() sqlx.QueryerContext {
+	if src.tx == nil {
+		return src.db
+	}
+
+	return src.tx
+}
+
 func (src postgresSource) Close() error {
+	if src.tx != nil {
+		return errors.New("cannot close the database inside a transaction")
+	}
+
 	if err := src.insertStmt.Close(); err != nil {
 		return errors.Wrap(err, "failed to close INSERT statement")
 	}
@@ -160,18 +505,66 @@ func (src postgresSource) Close() error {
 		return errors.Wrap(err, "failed to close SELECT (all) statement")
 	}
 
+	if err := src.countStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (count) statement")
+	}
+
+	if err := src.selectNearStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (near) statement")
+	}
+
+	if err := src.selectBoxStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (box) statement")
+	}
+
+	if err := src.selectSinceStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (since) statement")
+	}
+
 	if err := src.selectStmt.Close(); err != nil {
 		return errors.Wrap(err, "failed to close SELECT statement")
 	}
 
+	if err := src.lockStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (lock) statement")
+	}
+
 	if err := src.updateStmt.Close(); err != nil {
 		return errors.Wrap(err, "failed to close UPDATE statement")
 	}
 
+	if err := src.updateTokenStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close UPDATE (token) statement")
+	}
+
 	if err := src.deleteStmt.Close(); err != nil {
 		return errors.Wrap(err, "failed to close DELETE statement")
 	}
 
+	if err := src.insertLocationStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close INSERT (location) statement")
+	}
+
+	if err := src.selectLocationsStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (locations) statement")
+	}
+
+	if err := src.insertKeyStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close INSERT (API key) statement")
+	}
+
+	if err := src.selectAllKeysStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (all API keys) statement")
+	}
+
+	if err := src.selectKeyStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (API key) statement")
+	}
+
+	if err := src.revokeKeyStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close UPDATE (API key) statement")
+	}
+
 	if err := src.db.Close(); err != nil {
 		return errors.Wrap(err, "failed to close connection to Postgres")
 	}
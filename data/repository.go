@@ -1,28 +1,88 @@
 package data
 
 import (
+	"context"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 )
 
+// DefaultMaxClockSkew is how far into the future a bus position may be recorded
+// by default, to tolerate devices whose clocks are slightly ahead.
+const DefaultMaxClockSkew = time.Minute
+
+// DefaultQueryTimeout is how long each operation may wait for the database by
+// default.
+const DefaultQueryTimeout = 10 * time.Second
+
+// timePrecision is the precision of the times stored by the repository.
+// PostgreSQL only keeps microseconds, so finer times would change once the bus
+// is read back, and so would its ETag.
+const timePrecision = time.Microsecond
+
 type Repository struct {
-	src Source
+	src          Source
+	hub          *hub
+	maxClockSkew time.Duration
+	queryTimeout time.Duration
+}
+
+// newRepositoryFromSource creates a repository on top of src with the default settings.
+func newRepositoryFromSource(src Source) *Repository {
+	return &Repository{
+		src:          src,
+		hub:          newHub(),
+		maxClockSkew: DefaultMaxClockSkew,
+		queryTimeout: DefaultQueryTimeout,
+	}
+}
+
+// SetMaxClockSkew changes how far into the future a bus position may be
+// recorded, according to the server clock.
+func (r *Repository) SetMaxClockSkew(maxClockSkew time.Duration) {
+	r.maxClockSkew = maxClockSkew
+}
+
+// SetQueryTimeout changes how long each operation may wait for the database.
+// A zero timeout means the operations only end when their context is done.
+func (r *Repository) SetQueryTimeout(queryTimeout time.Duration) {
+	r.queryTimeout = queryTimeout
 }
 
-func (r Repository) CreateBus(bus Bus) (Bus, error) {
+// withTimeout limits how long an operation with ctx may wait for the database.
+// The returned function must be called when the operation is finished.
+func (r Repository) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, r.queryTimeout)
+}
+
+func (r Repository) CreateBus(ctx context.Context, bus Bus) (Bus, error) {
 	logrus.WithFields(logrus.Fields{
-		"id":         bus.ID,
-		"latitude":   bus.Latitude,
-		"longitude":  bus.Longitude,
-		"created_at": bus.CreatedAt,
-		"updated_at": bus.UpdatedAt,
+		"id":          bus.ID,
+		"latitude":    bus.Latitude,
+		"longitude":   bus.Longitude,
+		"recorded_at": bus.RecordedAt,
+		"created_at":  bus.CreatedAt,
+		"updated_at":  bus.UpdatedAt,
 	}).Debug("creating bus")
 	if len(bus.ID) == 0 {
 		return Bus{}, errors.WithMessage(MissingParameterError{"id"}, "missing bus ID")
 	}
 
+	if bus.ID == StreamBusID {
+		err := InvalidParameterError{
+			Name:  "id",
+			Value: bus.ID,
+		}
+		return Bus{}, errors.WithMessage(err, "bus ID is reserved")
+	}
+
 	if !bus.CreatedAt.IsZero() {
 		err := InvalidParameterError{
 			Name:  "created_at",
@@ -39,23 +99,216 @@ func (r Repository) CreateBus(bus Bus) (Bus, error) {
 		return Bus{}, errors.WithMessage(err, "bus update time cannot be specified")
 	}
 
-	now := time.Now()
+	if err := validatePosition(bus.Latitude, bus.Longitude); err != nil {
+		return Bus{}, err
+	}
+
+	if err := validateTelemetry(bus); err != nil {
+		return Bus{}, err
+	}
+
+	now := time.Now().Truncate(timePrecision)
 	bus.CreatedAt = now
 	bus.UpdatedAt = now
 
-	if err := r.src.CreateBus(bus); err != nil {
+	if err := r.setRecordedAt(&bus, now); err != nil {
+		return Bus{}, err
+	}
+
+	token, err := newSecret()
+	if err != nil {
+		return Bus{}, errors.WithMessage(err, "failed to generate bus token")
+	}
+	bus.TokenHash = hashSecret(token)
+	bus.Token = ""
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if err := r.src.CreateBus(ctx, bus); err != nil {
 		return Bus{}, err
 	}
 
+	r.hub.publish(BusEvent{
+		Type: BusCreated,
+		Bus:  bus,
+	})
+
+	// the token can only be seen by whoever created the bus
+	bus.Token = token
+
 	return bus, nil
 }
 
-func (r Repository) ReadAllBuses() ([]Bus, error) {
+func (r Repository) ReadAllBuses(ctx context.Context) ([]Bus, error) {
 	logrus.Debug("reading all buses")
-	return r.src.ReadAllBuses()
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.ReadAllBuses(ctx)
+}
+
+// ReadBusesPage reads a page of buses ordered by the page sort keys, and then
+// by ID. Besides the buses, it returns whether there are more buses after the
+// page (or before it, if the page is read with Before).
+func (r Repository) ReadBusesPage(ctx context.Context, page Page) ([]Bus, bool, error) {
+	logrus.WithFields(logrus.Fields{
+		"size":   page.Size,
+		"after":  page.After,
+		"before": page.Before,
+		"sort":   page.Sort,
+	}).Debug("reading page of buses")
+	if page.Size <= 0 {
+		err := InvalidParameterError{
+			Name:  "size",
+			Value: page.Size,
+		}
+		return nil, false, errors.WithMessage(err, "page size must be positive")
+	}
+
+	if len(page.After) > 0 && len(page.Before) > 0 {
+		err := InvalidParameterError{
+			Name:  "before",
+			Value: page.Before,
+		}
+		return nil, false, errors.WithMessage(err, "page cannot be read both after and before some bus")
+	}
+
+	for _, k := range page.Sort {
+		if !sortFields[k.Field] {
+			err := InvalidParameterError{
+				Name:  "sort",
+				Value: k.Field,
+			}
+			return nil, false, errors.WithMessage(err, "buses cannot be sorted by that field")
+		}
+	}
+
+	// one more bus is read to find out whether there's another page
+	srcPage := page
+	srcPage.Size++
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	buses, err := r.src.ReadBusesPage(ctx, srcPage)
+	if err != nil {
+		return nil, false, err
+	}
+
+	more := len(buses) > page.Size
+	if more {
+		if len(page.Before) > 0 {
+			buses = buses[1:]
+		} else {
+			buses = buses[:page.Size]
+		}
+	}
+
+	return buses, more, nil
+}
+
+// CountBuses counts all the buses.
+func (r Repository) CountBuses(ctx context.Context) (int, error) {
+	logrus.Debug("counting buses")
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.CountBuses(ctx)
+}
+
+// ReadNearbyBuses reads the buses which are at most radius meters away from
+// the point (lat, lng), ordered by their distance to that point.
+func (r Repository) ReadNearbyBuses(ctx context.Context, lat, lng, radius float64) ([]Bus, error) {
+	logrus.WithFields(logrus.Fields{
+		"latitude":  lat,
+		"longitude": lng,
+		"radius":    radius,
+	}).Debug("reading nearby buses")
+	if err := validateCoordinates(lat, lng); err != nil {
+		return nil, err
+	}
+
+	if math.IsNaN(radius) || math.IsInf(radius, 0) || radius <= 0 {
+		err := InvalidParameterError{
+			Name:  "radius",
+			Value: radius,
+		}
+		return nil, errors.WithMessage(err, "radius must be a positive number")
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.ReadNearbyBuses(ctx, lat, lng, radius)
+}
+
+// ReadBusesInBox reads the buses inside the box with the specified corners,
+// ordered by ID. If minLng is greater than maxLng, the box crosses the
+// antimeridian.
+func (r Repository) ReadBusesInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]Bus, error) {
+	logrus.WithFields(logrus.Fields{
+		"min_latitude":  minLat,
+		"min_longitude": minLng,
+		"max_latitude":  maxLat,
+		"max_longitude": maxLng,
+	}).Debug("reading buses in box")
+	if err := validateCoordinates(minLat, minLng); err != nil {
+		return nil, err
+	}
+
+	if err := validateCoordinates(maxLat, maxLng); err != nil {
+		return nil, err
+	}
+
+	if minLat > maxLat {
+		err := InvalidParameterError{
+			Name:  "latitude",
+			Value: minLat,
+		}
+		return nil, errors.WithMessage(err, "minimum latitude cannot be greater than maximum latitude")
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.ReadBusesInBox(ctx, minLat, minLng, maxLat, maxLng)
+}
+
+// ReadBusesUpdatedSince reads the buses which have been updated at or after
+// since, ordered by their update time.
+func (r Repository) ReadBusesUpdatedSince(ctx context.Context, since time.Time) ([]Bus, error) {
+	logrus.WithFields(logrus.Fields{
+		"since": since,
+	}).Debug("reading updated buses")
+	if since.IsZero() {
+		return nil, errors.WithMessage(MissingParameterError{"updated_since"}, "missing update time")
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.ReadBusesUpdatedSince(ctx, since)
 }
 
-func (r Repository) ReadBus(id string) (Bus, error) {
+// ReadBusDeletionsSince reads the IDs of the buses which have been deleted at
+// or after since, ordered by their deletion time. The buses created again with
+// the same ID after being deleted aren't included.
+func (r Repository) ReadBusDeletionsSince(ctx context.Context, since time.Time) ([]string, error) {
+	logrus.WithFields(logrus.Fields{
+		"since": since,
+	}).Debug("reading bus deletions")
+	if since.IsZero() {
+		return nil, errors.WithMessage(MissingParameterError{"deleted_since"}, "missing deletion time")
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.ReadBusDeletionsSince(ctx, since)
+}
+
+func (r Repository) ReadBus(ctx context.Context, id string) (Bus, error) {
 	logrus.WithFields(logrus.Fields{
 		"id": id,
 	}).Debug("reading bus")
@@ -63,55 +316,246 @@ func (r Repository) ReadBus(id string) (Bus, error) {
 		return Bus{}, errors.WithMessage(MissingParameterError{"id"}, "missing bus ID")
 	}
 
-	return r.src.ReadBus(id)
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.ReadBus(ctx, id)
+}
+
+func (r Repository) UpdateBus(ctx context.Context, bus Bus) (Bus, error) {
+	return r.updateBus(ctx, bus, time.Time{})
+}
+
+// UpdateBusIfMatch updates the bus only if its current update time is
+// updatedAt. The check and the update happen atomically; if the bus has been
+// updated by someone else in the meantime, ErrConcurrentUpdate is returned.
+func (r Repository) UpdateBusIfMatch(ctx context.Context, bus Bus, updatedAt time.Time) (Bus, error) {
+	return r.updateBus(ctx, bus, updatedAt)
 }
 
-func (r Repository) UpdateBus(bus Bus) (Bus, error) {
+func (r Repository) updateBus(ctx context.Context, bus Bus, previousUpdatedAt time.Time) (Bus, error) {
 	logrus.WithFields(logrus.Fields{
-		"id":         bus.ID,
-		"latitude":   bus.Latitude,
-		"longitude":  bus.Longitude,
-		"created_at": bus.CreatedAt,
-		"updated_at": bus.UpdatedAt,
+		"id":                  bus.ID,
+		"latitude":            bus.Latitude,
+		"longitude":           bus.Longitude,
+		"recorded_at":         bus.RecordedAt,
+		"created_at":          bus.CreatedAt,
+		"updated_at":          bus.UpdatedAt,
+		"previous_updated_at": previousUpdatedAt,
 	}).Debug("updating bus")
 	if len(bus.ID) == 0 {
 		return Bus{}, errors.WithMessage(MissingParameterError{"id"}, "missing bus ID")
 	}
 
-	existingBus, err := r.src.ReadBus(bus.ID)
-	if err != nil {
-		return Bus{}, errors.Wrap(err, "failed to check existing bus")
+	if err := validatePosition(bus.Latitude, bus.Longitude); err != nil {
+		return Bus{}, err
 	}
 
-	if !bus.CreatedAt.IsZero() {
-		if !bus.CreatedAt.Equal(existingBus.CreatedAt) {
+	if err := validateTelemetry(bus); err != nil {
+		return Bus{}, err
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// the bus can't change between being checked and updated, and its
+	// location history must only be recorded if it's updated
+	err := r.src.WithTx(ctx, func(src Source) error {
+		existingBus, err := src.ReadBus(ctx, bus.ID)
+		if err != nil {
+			return errors.Wrap(err, "failed to check existing bus")
+		}
+
+		if !previousUpdatedAt.IsZero() && !existingBus.UpdatedAt.Equal(previousUpdatedAt) {
+			return errors.WithMessage(ErrConcurrentUpdate, "bus has been updated since it was read")
+		}
+
+		now := time.Now().Truncate(timePrecision)
+
+		if err := r.setRecordedAt(&bus, now); err != nil {
+			return err
+		}
+
+		// a delayed position must not overwrite a newer one
+		if bus.RecordedAt.Before(existingBus.RecordedAt) {
+			return errors.WithMessage(ErrOutdatedPosition, "bus has a newer position")
+		}
+
+		if !bus.CreatedAt.IsZero() {
+			if !bus.CreatedAt.Equal(existingBus.CreatedAt) {
+				err := InvalidParameterError{
+					Name:  "created_at",
+					Value: bus.CreatedAt,
+				}
+				return errors.WithMessage(err, "bus creation time cannot be specified")
+			}
+		} else {
+			bus.CreatedAt = existingBus.CreatedAt
+		}
+
+		if !bus.UpdatedAt.IsZero() && !bus.UpdatedAt.Equal(existingBus.UpdatedAt) {
 			err := InvalidParameterError{
-				Name:  "created_at",
-				Value: bus.CreatedAt,
+				Name:  "updated_at",
+				Value: bus.UpdatedAt,
 			}
-			return Bus{}, errors.WithMessage(err, "bus creation time cannot be specified")
+			return errors.WithMessage(err, "bus update time cannot be specified")
 		}
-	} else {
-		bus.CreatedAt = existingBus.CreatedAt
+		bus.UpdatedAt = now
+
+		if err := src.UpdateBus(ctx, bus, previousUpdatedAt); err != nil {
+			return err
+		}
+
+		loc := Location{
+			BusID:      bus.ID,
+			Latitude:   bus.Latitude,
+			Longitude:  bus.Longitude,
+			RecordedAt: bus.RecordedAt,
+		}
+		if err := src.CreateLocation(ctx, loc); err != nil {
+			return errors.Wrap(err, "failed to record bus location")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Bus{}, err
+	}
+
+	r.hub.publish(BusEvent{
+		Type: BusUpdated,
+		Bus:  bus,
+	})
+
+	return bus, nil
+}
+
+// CreateLocations adds a batch of locations to the history of a bus, e.g. the
+// positions buffered by a device while it was offline. Every location must
+// have its recording time. The bus is also updated to the newest location,
+// unless it already has a newer position. Either all locations are stored or
+// none of them; if any location is invalid, a BatchError with the errors of
+// each invalid location is returned.
+func (r Repository) CreateLocations(ctx context.Context, busID string, locations []Location) error {
+	logrus.WithFields(logrus.Fields{
+		"bus_id":    busID,
+		"locations": len(locations),
+	}).Debug("creating bus locations")
+	if len(busID) == 0 {
+		return errors.WithMessage(MissingParameterError{"id"}, "missing bus ID")
 	}
 
-	if !bus.UpdatedAt.IsZero() && !bus.UpdatedAt.Equal(existingBus.UpdatedAt) {
+	if len(locations) == 0 {
+		return errors.WithMessage(MissingParameterError{"locations"}, "missing bus locations")
+	}
+
+	now := time.Now().Truncate(timePrecision)
+	newest := -1
+
+	var batchErr BatchError
+	for i := range locations {
+		loc := &locations[i]
+		loc.BusID = busID
+
+		if err := r.validateLocation(loc, now); err != nil {
+			batchErr.Errors = append(batchErr.Errors, ItemError{
+				Index: i,
+				Err:   err,
+			})
+			continue
+		}
+
+		if newest < 0 || !loc.RecordedAt.Before(locations[newest].RecordedAt) {
+			newest = i
+		}
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return errors.WithMessage(batchErr, "invalid bus locations")
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var bus Bus
+	var updated bool
+
+	err := r.src.WithTx(ctx, func(src Source) error {
+		var err error
+		if bus, err = src.ReadBus(ctx, busID); err != nil {
+			return errors.Wrap(err, "failed to check existing bus")
+		}
+
+		for _, loc := range locations {
+			if err := src.CreateLocation(ctx, loc); err != nil {
+				return errors.Wrap(err, "failed to record bus location")
+			}
+		}
+
+		// the telemetry of the previous position doesn't apply to the new one
+		bus.Latitude = locations[newest].Latitude
+		bus.Longitude = locations[newest].Longitude
+		bus.Speed, bus.Heading, bus.Accuracy, bus.Altitude = nil, nil, nil, nil
+		bus.RecordedAt = locations[newest].RecordedAt
+		bus.UpdatedAt = now
+
+		if err := src.UpdateBus(ctx, bus, time.Time{}); err != nil {
+			if errors.Cause(err) == ErrOutdatedPosition {
+				// the locations are only added to the history
+				return nil
+			}
+			return err
+		}
+		updated = true
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if updated {
+		r.hub.publish(BusEvent{
+			Type: BusUpdated,
+			Bus:  bus,
+		})
+	}
+
+	return nil
+}
+
+// ReadLocations reads the location history of a bus, ordered by time. Only the
+// locations recorded between since and until (inclusive) are returned; a zero
+// time means there's no limit on that side.
+func (r Repository) ReadLocations(ctx context.Context, busID string, since, until time.Time) ([]Location, error) {
+	logrus.WithFields(logrus.Fields{
+		"bus_id": busID,
+		"since":  since,
+		"until":  until,
+	}).Debug("reading bus locations")
+	if len(busID) == 0 {
+		return nil, errors.WithMessage(MissingParameterError{"id"}, "missing bus ID")
+	}
+
+	if !since.IsZero() && !until.IsZero() && until.Before(since) {
 		err := InvalidParameterError{
-			Name:  "updated_at",
-			Value: bus.UpdatedAt,
+			Name:  "until",
+			Value: until,
 		}
-		return Bus{}, errors.WithMessage(err, "bus update time cannot be specified")
+		return nil, errors.WithMessage(err, "end of time range cannot be before its start")
 	}
-	bus.UpdatedAt = time.Now()
 
-	if err := r.src.UpdateBus(bus); err != nil {
-		return Bus{}, err
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := r.src.ReadBus(ctx, busID); err != nil {
+		return nil, errors.Wrap(err, "failed to check existing bus")
 	}
 
-	return bus, nil
+	return r.src.ReadLocations(ctx, busID, since, until)
 }
 
-func (r Repository) DeleteBus(id string) error {
+func (r Repository) DeleteBus(ctx context.Context, id string) error {
 	logrus.WithFields(logrus.Fields{
 		"id": id,
 	}).Debug("deleting bus")
@@ -119,10 +563,352 @@ func (r Repository) DeleteBus(id string) error {
 		return MissingParameterError{"id"}
 	}
 
-	return r.src.DeleteBus(id)
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// the deletion is recorded, so the clients which only read the updated
+	// buses also find out about it
+	err := r.src.WithTx(ctx, func(src Source) error {
+		if err := src.DeleteBus(ctx, id); err != nil {
+			return err
+		}
+
+		return src.CreateBusDeletion(ctx, id, time.Now().Truncate(timePrecision))
+	})
+	if err != nil {
+		return err
+	}
+
+	r.hub.publish(BusEvent{
+		Type: BusDeleted,
+		Bus:  Bus{ID: id},
+	})
+
+	return nil
+}
+
+// CreateAPIKey creates a new API key, whose name describes who is going to use
+// it. Besides the key, it returns the whole key which must be sent in the
+// requests; it can't be read again later.
+func (r Repository) CreateAPIKey(ctx context.Context, name string) (APIKey, string, error) {
+	logrus.WithFields(logrus.Fields{
+		"name": name,
+	}).Debug("creating API key")
+	if len(strings.TrimSpace(name)) == 0 {
+		return APIKey{}, "", errors.WithMessage(MissingParameterError{"name"}, "missing API key name")
+	}
+
+	key, wholeKey, err := newAPIKey(name, time.Now())
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if err := r.src.CreateAPIKey(ctx, key); err != nil {
+		return APIKey{}, "", err
+	}
+
+	return key, wholeKey, nil
+}
+
+// ReadAllAPIKeys reads all API keys, including the revoked ones, ordered by
+// their creation time.
+func (r Repository) ReadAllAPIKeys(ctx context.Context) ([]APIKey, error) {
+	logrus.Debug("reading all API keys")
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.ReadAllAPIKeys(ctx)
+}
+
+// RevokeAPIKey prevents the API key with the specified ID from being used
+// again. ErrNoSuchRow is returned if there's no such key, or if it has already
+// been revoked.
+func (r Repository) RevokeAPIKey(ctx context.Context, id string) error {
+	logrus.WithFields(logrus.Fields{
+		"id": id,
+	}).Debug("revoking API key")
+	if len(id) == 0 {
+		return errors.WithMessage(MissingParameterError{"id"}, "missing API key ID")
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.RevokeAPIKey(ctx, id, time.Now())
+}
+
+// AuthenticateAPIKey finds the API key whose whole key is wholeKey.
+// ErrInvalidAPIKey is returned if there's no such key, or if it has been
+// revoked.
+func (r Repository) AuthenticateAPIKey(ctx context.Context, wholeKey string) (APIKey, error) {
+	id, secret, ok := splitAPIKey(wholeKey)
+	if !ok {
+		return APIKey{}, errors.WithMessage(ErrInvalidAPIKey, "malformed API key")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id": id,
+	}).Debug("authenticating API key")
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	key, err := r.src.ReadAPIKey(ctx, id)
+	if err != nil {
+		if errors.Cause(err) == ErrNoSuchRow {
+			return APIKey{}, errors.WithMessage(ErrInvalidAPIKey, "API key not found")
+		}
+		return APIKey{}, err
+	}
+
+	if !key.matchesSecret(secret) {
+		return APIKey{}, errors.WithMessage(ErrInvalidAPIKey, "API key doesn't match")
+	}
+
+	if key.Revoked() {
+		return APIKey{}, errors.WithMessage(ErrInvalidAPIKey, "API key has been revoked")
+	}
+
+	return key, nil
+}
+
+// IssueBusToken issues a new token for the bus with the specified ID, and
+// returns it. The previous token, if any, can't be used anymore. The buses
+// created before they had tokens need one before they can be changed.
+func (r Repository) IssueBusToken(ctx context.Context, id string) (string, error) {
+	logrus.WithFields(logrus.Fields{
+		"id": id,
+	}).Debug("issuing bus token")
+
+	token, err := newSecret()
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to generate bus token")
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if err := r.src.UpdateBusTokenHash(ctx, id, hashSecret(token)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// VerifyBusToken checks whether token is the one issued for the bus.
+// ErrInvalidBusToken is returned if it isn't, or if the bus has no token (i.e.
+// it was created before the buses had tokens; see IssueBusToken), and
+// ErrNoSuchRow if the bus doesn't exist.
+func (r Repository) VerifyBusToken(ctx context.Context, id, token string) error {
+	logrus.WithFields(logrus.Fields{
+		"id": id,
+	}).Debug("verifying bus token")
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	bus, err := r.src.ReadBus(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if bus.TokenHash == nil {
+		return errors.WithMessage(ErrInvalidBusToken, "bus has no token")
+	}
+
+	if !matchesSecretHash(bus.TokenHash, token) {
+		return errors.WithMessage(ErrInvalidBusToken, "bus token doesn't match")
+	}
+
+	return nil
+}
+
+// WithTx calls f with a source whose operations all happen in a single
+// transaction, so several of them can be combined atomically. The transaction
+// is committed if f returns nil, and rolled back otherwise. Unlike the other
+// operations, nothing done with that source is validated or sent to the
+// subscribers.
+func (r Repository) WithTx(ctx context.Context, f func(Source) error) error {
+	logrus.Debug("running database transaction")
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.src.WithTx(ctx, f)
+}
+
+// Subscribe starts listening to changes on the bus with the specified ID, or on
+// all buses if busID is empty. An event is sent to the returned channel every
+// time a bus is successfully created, updated or deleted. The caller must call
+// the returned function when it's no longer interested in the events; the
+// channel is closed after that, or after the repository is closed.
+func (r Repository) Subscribe(busID string) (<-chan BusEvent, func()) {
+	logrus.WithFields(logrus.Fields{
+		"bus_id": busID,
+	}).Debug("subscribing to bus events")
+	ch := r.hub.subscribe(busID)
+
+	return ch, func() {
+		r.hub.unsubscribe(ch)
+	}
+}
+
+// CloseSubscriptions closes the channels of all subscribers, so they stop
+// waiting for bus events (e.g. before the web server shuts down). Subscribing
+// afterwards returns an already closed channel.
+func (r Repository) CloseSubscriptions() {
+	logrus.Debug("closing bus event subscriptions")
+	r.hub.close()
 }
 
 func (r Repository) Close() error {
 	logrus.Debug("closing connection to database")
+	r.hub.close()
 	return r.src.Close()
 }
+
+// validatePosition checks whether the latitude and the longitude represent a
+// valid bus position. The position (0, 0) is also rejected because that's
+// what a bus would get if its coordinates weren't specified.
+func validatePosition(lat, lng float64) error {
+	if err := validateCoordinates(lat, lng); err != nil {
+		return err
+	}
+
+	if lat == 0 && lng == 0 {
+		err := InvalidParameterError{
+			Name:  "latitude",
+			Value: lat,
+		}
+		return errors.WithMessage(err, "bus position cannot be (0, 0)")
+	}
+
+	return nil
+}
+
+// setRecordedAt sets when the bus position was recorded to now, if the device
+// didn't report it.
+func (r Repository) setRecordedAt(bus *Bus, now time.Time) error {
+	if bus.RecordedAt.IsZero() {
+		bus.RecordedAt = now
+		return nil
+	}
+
+	recordedAt, err := r.checkRecordedAt(bus.RecordedAt, now)
+	if err != nil {
+		return err
+	}
+	bus.RecordedAt = recordedAt
+
+	return nil
+}
+
+// checkRecordedAt rejects positions recorded too far into the future. The ones
+// within the clock skew tolerance are considered recorded now, so they don't
+// prevent the next positions from being stored. The others are truncated to the
+// stored precision.
+func (r Repository) checkRecordedAt(recordedAt, now time.Time) (time.Time, error) {
+	if recordedAt.After(now.Add(r.maxClockSkew)) {
+		err := InvalidParameterError{
+			Name:  "recorded_at",
+			Value: recordedAt,
+		}
+		return time.Time{}, errors.WithMessage(err, "bus position cannot be recorded in the future")
+	}
+
+	if recordedAt.After(now) {
+		return now, nil
+	}
+
+	return recordedAt.Truncate(timePrecision), nil
+}
+
+// validateLocation checks whether a location from a batch is valid. Its
+// recording time may be changed by checkRecordedAt.
+func (r Repository) validateLocation(loc *Location, now time.Time) error {
+	if err := validatePosition(loc.Latitude, loc.Longitude); err != nil {
+		return err
+	}
+
+	if loc.RecordedAt.IsZero() {
+		return errors.WithMessage(MissingParameterError{"recorded_at"}, "missing location recording time")
+	}
+
+	recordedAt, err := r.checkRecordedAt(loc.RecordedAt, now)
+	if err != nil {
+		return err
+	}
+	loc.RecordedAt = recordedAt
+
+	return nil
+}
+
+// validateTelemetry checks whether the optional telemetry attributes of a bus
+// are within their valid ranges. Missing attributes are always valid.
+func validateTelemetry(bus Bus) error {
+	if bus.Speed != nil {
+		if speed := *bus.Speed; math.IsNaN(speed) || math.IsInf(speed, 0) || speed < 0 {
+			err := InvalidParameterError{
+				Name:  "speed",
+				Value: speed,
+			}
+			return errors.WithMessage(err, "speed cannot be negative")
+		}
+	}
+
+	if bus.Heading != nil {
+		if heading := *bus.Heading; math.IsNaN(heading) || heading < 0 || heading >= 360 {
+			err := InvalidParameterError{
+				Name:  "heading",
+				Value: heading,
+			}
+			return errors.WithMessage(err, "heading must be between 0 (inclusive) and 360 (exclusive)")
+		}
+	}
+
+	if bus.Accuracy != nil {
+		if accuracy := *bus.Accuracy; math.IsNaN(accuracy) || math.IsInf(accuracy, 0) || accuracy < 0 {
+			err := InvalidParameterError{
+				Name:  "accuracy",
+				Value: accuracy,
+			}
+			return errors.WithMessage(err, "accuracy cannot be negative")
+		}
+	}
+
+	if bus.Altitude != nil {
+		if altitude := *bus.Altitude; math.IsNaN(altitude) || math.IsInf(altitude, 0) {
+			err := InvalidParameterError{
+				Name:  "altitude",
+				Value: altitude,
+			}
+			return errors.WithMessage(err, "altitude must be a finite number")
+		}
+	}
+
+	return nil
+}
+
+// validateCoordinates checks whether the latitude and the longitude represent
+// a valid position on Earth.
+func validateCoordinates(lat, lng float64) error {
+	if math.IsNaN(lat) || math.IsInf(lat, 0) || lat < -90 || lat > 90 {
+		err := InvalidParameterError{
+			Name:  "latitude",
+			Value: lat,
+		}
+		return errors.WithMessage(err, "latitude must be between -90 and 90")
+	}
+
+	if math.IsNaN(lng) || math.IsInf(lng, 0) || lng < -180 || lng > 180 {
+		err := InvalidParameterError{
+			Name:  "longitude",
+			Value: lng,
+		}
+		return errors.WithMessage(err, "longitude must be between -180 and 180")
+	}
+
+	return nil
+}
@@ -1,7 +1,9 @@
 package data
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"testing"
@@ -14,8 +16,25 @@ import (
 
 var repo *Repository
 
+// newRepository opens a connection to the Postgres database specified by the
+// environment variable POSTGRES_URL. If it's not set, an in-memory repository
+// is used instead.
 func newRepository() (*Repository, error) {
 	env := os.Getenv("POSTGRES_URL")
+	if len(env) == 0 {
+		return NewMemoryRepository(), nil
+	}
+
+	migrator, err := NewPostgresMigrator(env)
+	if err != nil {
+		return nil, err
+	}
+	defer migrator.Close()
+
+	if err := migrator.MigrateTo(migrator.LatestVersion()); err != nil {
+		return nil, err
+	}
+
 	return NewPostgresRepository(env)
 }
 
@@ -36,7 +55,52 @@ func TestMain(m *testing.M) {
 	os.Exit(status)
 }
 
+// positionTestCases contains the boundary cases of the bus coordinates. An
+// empty invalidParameter means the position is valid.
+var positionTestCases = []struct {
+	name             string
+	latitude         float64
+	longitude        float64
+	invalidParameter string
+}{
+	{"null island", 0, 0, "latitude"},
+	{"equator", 0, 4.56, ""},
+	{"prime meridian", 1.23, 0, ""},
+	{"north pole", 90, 4.56, ""},
+	{"south pole", -90, 4.56, ""},
+	{"latitude too big", 90.0001, 4.56, "latitude"},
+	{"latitude too small", -90.0001, 4.56, "latitude"},
+	{"latitude NaN", math.NaN(), 4.56, "latitude"},
+	{"latitude +Inf", math.Inf(1), 4.56, "latitude"},
+	{"latitude -Inf", math.Inf(-1), 4.56, "latitude"},
+	{"antimeridian east", 1.23, 180, ""},
+	{"antimeridian west", 1.23, -180, ""},
+	{"longitude too big", 1.23, 180.0001, "longitude"},
+	{"longitude too small", 1.23, -180.0001, "longitude"},
+	{"longitude NaN", 1.23, math.NaN(), "longitude"},
+	{"longitude +Inf", 1.23, math.Inf(1), "longitude"},
+	{"longitude -Inf", 1.23, math.Inf(-1), "longitude"},
+}
+
+func assertPositionError(t *testing.T, invalidParameter string, err error) {
+	if len(invalidParameter) == 0 {
+		assert.NoError(t, err)
+		return
+	}
+
+	switch causeErr := errors.Cause(err); causeErr.(type) {
+	case InvalidParameterError:
+		assert.Equal(t, invalidParameter, causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+	default:
+		assert.Fail(t, "unexpected error", "%T: %[1]v", causeErr)
+	}
+}
+
 func TestNewPostgresRepository(t *testing.T) {
+	if len(os.Getenv("POSTGRES_URL")) == 0 {
+		t.Skip("POSTGRES_URL not set")
+	}
+
 	// don't use the global connection because we need to close it here
 	_, err := NewPostgresRepository("")
 	assert.Error(t, err, "invalid dialect and/or URL")
@@ -60,12 +124,36 @@ func TestRepository_Close(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRepository_SetQueryTimeout(t *testing.T) {
+	testRepo := NewMemoryRepository()
+	defer testRepo.Close()
+
+	ctx, cancel := testRepo.withTimeout(context.Background())
+	deadline, ok := ctx.Deadline()
+	cancel()
+	require.True(t, ok, "the operations should have a default timeout")
+	assert.WithinDuration(t, time.Now().Add(DefaultQueryTimeout), deadline, time.Second)
+
+	testRepo.SetQueryTimeout(time.Minute)
+	ctx, cancel = testRepo.withTimeout(context.Background())
+	deadline, _ = ctx.Deadline()
+	cancel()
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	testRepo.SetQueryTimeout(0)
+	ctx, cancel = testRepo.withTimeout(context.Background())
+	_, ok = ctx.Deadline()
+	cancel()
+	assert.False(t, ok, "the operations shouldn't have a timeout")
+	assert.Error(t, ctx.Err(), "the context should be done after it's cancelled")
+}
+
 func TestRepository_CreateBus(t *testing.T) {
 	t.Run("missing ID", func(subT *testing.T) {
 		var bus Bus
 
-		_, err := repo.CreateBus(bus)
-		defer repo.DeleteBus(bus.ID)
+		_, err := repo.CreateBus(context.Background(), bus)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case MissingParameterError:
@@ -75,14 +163,30 @@ func TestRepository_CreateBus(t *testing.T) {
 		}
 	})
 
+	t.Run("reserved ID", func(subT *testing.T) {
+		bus := Bus{
+			ID: StreamBusID,
+		}
+
+		_, err := repo.CreateBus(context.Background(), bus)
+		defer repo.DeleteBus(context.Background(), bus.ID)
+
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "id", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
 	t.Run("creation time non-null", func(subT *testing.T) {
 		bus := Bus{
 			ID:        "test-create",
 			CreatedAt: time.Now(),
 		}
 
-		_, err := repo.CreateBus(bus)
-		defer repo.DeleteBus(bus.ID)
+		_, err := repo.CreateBus(context.Background(), bus)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case InvalidParameterError:
@@ -98,8 +202,8 @@ func TestRepository_CreateBus(t *testing.T) {
 			UpdatedAt: time.Now(),
 		}
 
-		_, err := repo.CreateBus(bus)
-		defer repo.DeleteBus(bus.ID)
+		_, err := repo.CreateBus(context.Background(), bus)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case InvalidParameterError:
@@ -110,13 +214,17 @@ func TestRepository_CreateBus(t *testing.T) {
 	})
 
 	t.Run("existing ID", func(subT *testing.T) {
-		bus := Bus{ID: "test-create"}
+		bus := Bus{
+			ID:        "test-create",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
 
-		_, err := repo.CreateBus(bus)
+		_, err := repo.CreateBus(context.Background(), bus)
 		require.NoError(subT, err, "failed to create bus")
-		defer repo.DeleteBus(bus.ID)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
-		_, err = repo.CreateBus(bus)
+		_, err = repo.CreateBus(context.Background(), bus)
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case DuplicateError:
 			assert.Equal(subT, bus.ID, causeErr.(DuplicateError).ID, "wrong existing row ID")
@@ -128,36 +236,129 @@ func TestRepository_CreateBus(t *testing.T) {
 	t.Run("success", func(subT *testing.T) {
 		bus := Bus{
 			ID:        "test-create",
-			Latitude:  123,
-			Longitude: 456,
+			Latitude:  12.3,
+			Longitude: 45.6,
 		}
 
-		createdBus, err := repo.CreateBus(bus)
+		createdBus, err := repo.CreateBus(context.Background(), bus)
 		require.NoError(subT, err, "failed to create bus")
-		defer repo.DeleteBus(bus.ID)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		assert.Equal(subT, bus.ID, createdBus.ID, "bus ID")
 		assert.Equal(subT, bus.Latitude, createdBus.Latitude, "bus latitude")
 		assert.Equal(subT, bus.Longitude, createdBus.Longitude, "bus longitude")
+
+		readBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.True(subT, createdBus.UpdatedAt.Equal(readBus.UpdatedAt), "the update time should be the stored one; expected %v, got %v", createdBus.UpdatedAt, readBus.UpdatedAt)
+		assert.True(subT, createdBus.RecordedAt.Equal(readBus.RecordedAt), "the recording time should be the stored one; expected %v, got %v", createdBus.RecordedAt, readBus.RecordedAt)
+	})
+}
+
+func TestRepository_CreateBus_position(t *testing.T) {
+	for _, tc := range positionTestCases {
+		t.Run(tc.name, func(subT *testing.T) {
+			bus := Bus{
+				ID:        "test-create-position",
+				Latitude:  tc.latitude,
+				Longitude: tc.longitude,
+			}
+
+			_, err := repo.CreateBus(context.Background(), bus)
+			defer repo.DeleteBus(context.Background(), bus.ID)
+
+			assertPositionError(subT, tc.invalidParameter, err)
+		})
+	}
+}
+
+func TestRepository_CreateBus_telemetry(t *testing.T) {
+	float := func(f float64) *float64 {
+		return &f
+	}
+
+	subTestFunc := func(bus Bus, invalidParameter string) func(*testing.T) {
+		return func(subT *testing.T) {
+			bus.ID = "test-create-telemetry"
+			bus.Latitude = 1.23
+			bus.Longitude = 4.56
+
+			_, err := repo.CreateBus(context.Background(), bus)
+			defer repo.DeleteBus(context.Background(), bus.ID)
+
+			switch causeErr := errors.Cause(err); causeErr.(type) {
+			case InvalidParameterError:
+				assert.Equal(subT, invalidParameter, causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+			default:
+				assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+			}
+		}
+	}
+
+	t.Run("negative speed", subTestFunc(Bus{Speed: float(-1)}, "speed"))
+	t.Run("infinite speed", subTestFunc(Bus{Speed: float(math.Inf(1))}, "speed"))
+	t.Run("negative heading", subTestFunc(Bus{Heading: float(-0.5)}, "heading"))
+	t.Run("full turn heading", subTestFunc(Bus{Heading: float(360)}, "heading"))
+	t.Run("negative accuracy", subTestFunc(Bus{Accuracy: float(-10)}, "accuracy"))
+	t.Run("NaN altitude", subTestFunc(Bus{Altitude: float(math.NaN())}, "altitude"))
+
+	t.Run("success", func(subT *testing.T) {
+		bus := Bus{
+			ID:        "test-create-telemetry",
+			Latitude:  1.23,
+			Longitude: 4.56,
+			Speed:     float(12.5),
+			Heading:   float(0),
+			Accuracy:  float(5),
+			Altitude:  float(-20),
+		}
+
+		_, err := repo.CreateBus(context.Background(), bus)
+		require.NoError(subT, err, "failed to create bus")
+		defer repo.DeleteBus(context.Background(), bus.ID)
+
+		readBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, bus.Speed, readBus.Speed, "bus speed")
+		assert.Equal(subT, bus.Heading, readBus.Heading, "bus heading")
+		assert.Equal(subT, bus.Accuracy, readBus.Accuracy, "bus accuracy")
+		assert.Equal(subT, bus.Altitude, readBus.Altitude, "bus altitude")
+
+		// the telemetry belongs to a position, so it's cleared when a new
+		// position is reported without it
+		bus.Speed, bus.Heading, bus.Accuracy, bus.Altitude = nil, nil, nil, nil
+		_, err = repo.UpdateBus(context.Background(), bus)
+		require.NoError(subT, err, "failed to update bus")
+
+		readBus, err = repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Nil(subT, readBus.Speed, "bus speed")
+		assert.Nil(subT, readBus.Heading, "bus heading")
+		assert.Nil(subT, readBus.Accuracy, "bus accuracy")
+		assert.Nil(subT, readBus.Altitude, "bus altitude")
 	})
 }
 
 func TestRepository_ReadBus(t *testing.T) {
-	bus := Bus{ID: "test-read"}
+	bus := Bus{
+		ID:        "test-read",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 
-	createdBus, err := repo.CreateBus(bus)
+	createdBus, err := repo.CreateBus(context.Background(), bus)
 	if err != nil {
 		t.Skipf("failed to create bus which would be read: %v", err)
 	}
-	defer repo.DeleteBus(bus.ID)
+	defer repo.DeleteBus(context.Background(), bus.ID)
 
 	t.Run("non-existing", func(subT *testing.T) {
-		_, err = repo.ReadBus("non-existing")
+		_, err = repo.ReadBus(context.Background(), "non-existing")
 		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
 	})
 
 	t.Run("existing", func(subT *testing.T) {
-		readBus, err := repo.ReadBus(bus.ID)
+		readBus, err := repo.ReadBus(context.Background(), bus.ID)
 		require.NoError(subT, err, "failed to read bus")
 		assert.Equal(subT, readBus.ID, createdBus.ID, "bus ID")
 		assert.Equal(subT, readBus.Latitude, createdBus.Latitude, "bus latitude")
@@ -167,7 +368,7 @@ func TestRepository_ReadBus(t *testing.T) {
 
 func TestRepository_ReadAllBuses(t *testing.T) {
 	t.Run("empty", func(subT *testing.T) {
-		buses, err := repo.ReadAllBuses()
+		buses, err := repo.ReadAllBuses(context.Background())
 		require.NoError(subT, err, "failed to read all buses")
 		assert.Empty(subT, buses)
 	})
@@ -176,31 +377,381 @@ func TestRepository_ReadAllBuses(t *testing.T) {
 		nBuses := 2
 
 		for i := 0; i < nBuses; i++ {
-			bus := Bus{ID: fmt.Sprintf("test-readall-%v", i)}
-			if _, err := repo.CreateBus(bus); err != nil {
+			bus := Bus{
+				ID:        fmt.Sprintf("test-readall-%v", i),
+				Latitude:  1.23,
+				Longitude: 4.56,
+			}
+			if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 				subT.Skipf("failed to create bus which would be read: %v", err)
 			}
-			defer repo.DeleteBus(bus.ID)
+			defer repo.DeleteBus(context.Background(), bus.ID)
 		}
 
-		buses, err := repo.ReadAllBuses()
+		buses, err := repo.ReadAllBuses(context.Background())
 		require.NoError(subT, err, "failed to read all buses")
 		assert.Len(subT, buses, nBuses)
 	})
 }
 
+func TestRepository_ReadBusesPage(t *testing.T) {
+	t.Run("invalid size", func(subT *testing.T) {
+		_, _, err := repo.ReadBusesPage(context.Background(), Page{Size: 0})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "size", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("after and before", func(subT *testing.T) {
+		_, _, err := repo.ReadBusesPage(context.Background(), Page{Size: 1, After: "a", Before: "b"})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "before", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	for i := 0; i < 5; i++ {
+		bus := Bus{
+			ID:        fmt.Sprintf("test-page-%v", i),
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			t.Skipf("failed to create bus which would be read: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), bus.ID)
+	}
+
+	subTestFunc := func(page Page, expectedMore bool, expectedIDs ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			buses, more, err := repo.ReadBusesPage(context.Background(), page)
+			require.NoError(subT, err, "failed to read page of buses")
+			assert.Equal(subT, expectedMore, more, "unexpected indication of more buses")
+
+			var ids []string
+			for _, b := range buses {
+				ids = append(ids, b.ID)
+			}
+			assert.Equal(subT, expectedIDs, ids, "unexpected buses in page")
+		}
+	}
+
+	t.Run("first", subTestFunc(Page{Size: 2}, true, "test-page-0", "test-page-1"))
+	t.Run("after", subTestFunc(Page{Size: 2, After: "test-page-1"}, true, "test-page-2", "test-page-3"))
+	t.Run("last", subTestFunc(Page{Size: 2, After: "test-page-3"}, false, "test-page-4"))
+	t.Run("before", subTestFunc(Page{Size: 2, Before: "test-page-4"}, true, "test-page-2", "test-page-3"))
+	t.Run("before first", subTestFunc(Page{Size: 2, Before: "test-page-2"}, false, "test-page-0", "test-page-1"))
+	t.Run("exact size", subTestFunc(Page{Size: 5}, false, "test-page-0", "test-page-1", "test-page-2", "test-page-3", "test-page-4"))
+}
+
+func TestRepository_ReadBusesPage_sort(t *testing.T) {
+	t.Run("invalid field", func(subT *testing.T) {
+		_, _, err := repo.ReadBusesPage(context.Background(), Page{Size: 1, Sort: []SortKey{{Field: "foo"}}})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "sort", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("cursor not found", func(subT *testing.T) {
+		_, _, err := repo.ReadBusesPage(context.Background(), Page{Size: 1, After: "not-found", Sort: []SortKey{{Field: "latitude"}}})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "after", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	// the latitudes make the IDs in reverse order, except for a tie
+	for i, lat := range []float64{4, 3, 3, 1} {
+		bus := Bus{
+			ID:        fmt.Sprintf("test-sort-%v", i),
+			Latitude:  lat,
+			Longitude: 4.56,
+		}
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			t.Skipf("failed to create bus which would be read: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), bus.ID)
+	}
+
+	subTestFunc := func(page Page, expectedIDs ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			buses, _, err := repo.ReadBusesPage(context.Background(), page)
+			require.NoError(subT, err, "failed to read page of buses")
+
+			var ids []string
+			for _, b := range buses {
+				ids = append(ids, b.ID)
+			}
+			assert.Equal(subT, expectedIDs, ids, "unexpected buses in page")
+		}
+	}
+
+	byLatitude := []SortKey{{Field: "latitude"}}
+	t.Run("ascending", subTestFunc(Page{Size: 4, Sort: byLatitude}, "test-sort-3", "test-sort-1", "test-sort-2", "test-sort-0"))
+	t.Run("after tie", subTestFunc(Page{Size: 2, After: "test-sort-1", Sort: byLatitude}, "test-sort-2", "test-sort-0"))
+	t.Run("before tie", subTestFunc(Page{Size: 2, Before: "test-sort-2", Sort: byLatitude}, "test-sort-3", "test-sort-1"))
+
+	byLatitudeDesc := []SortKey{{Field: "latitude", Descending: true}, {Field: "id", Descending: true}}
+	t.Run("descending", subTestFunc(Page{Size: 4, Sort: byLatitudeDesc}, "test-sort-0", "test-sort-2", "test-sort-1", "test-sort-3"))
+	t.Run("descending after", subTestFunc(Page{Size: 2, After: "test-sort-2", Sort: byLatitudeDesc}, "test-sort-1", "test-sort-3"))
+
+	byUpdateTime := []SortKey{{Field: "updated_at", Descending: true}}
+	t.Run("update time", subTestFunc(Page{Size: 2, Sort: byUpdateTime}, "test-sort-3", "test-sort-2"))
+}
+
+func TestRepository_CountBuses(t *testing.T) {
+	count, err := repo.CountBuses(context.Background())
+	require.NoError(t, err, "failed to count buses")
+	assert.Equal(t, 0, count, "unexpected number of buses")
+
+	bus := Bus{
+		ID:        "test-count",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to create bus which would be counted: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	count, err = repo.CountBuses(context.Background())
+	require.NoError(t, err, "failed to count buses")
+	assert.Equal(t, 1, count, "unexpected number of buses")
+}
+
+func TestRepository_ReadBusesUpdatedSince(t *testing.T) {
+	t.Run("missing time", func(subT *testing.T) {
+		_, err := repo.ReadBusesUpdatedSince(context.Background(), time.Time{})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case MissingParameterError:
+			assert.Equal(subT, "updated_since", causeErr.(MissingParameterError).Name, "wrong missing parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	var createdBuses []Bus
+
+	for i := 0; i < 3; i++ {
+		bus := Bus{
+			ID:        fmt.Sprintf("test-since-%v", i),
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		createdBus, err := repo.CreateBus(context.Background(), bus)
+		if err != nil {
+			t.Skipf("failed to create bus which would be read: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), bus.ID)
+
+		createdBuses = append(createdBuses, createdBus)
+	}
+
+	// the first bus is updated after the other ones
+	updatedBus, err := repo.UpdateBus(context.Background(), createdBuses[0])
+	if err != nil {
+		t.Skipf("failed to update bus: %v", err)
+	}
+
+	subTestFunc := func(since time.Time, expectedIDs ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			buses, err := repo.ReadBusesUpdatedSince(context.Background(), since)
+			require.NoError(subT, err, "failed to read updated buses")
+
+			var ids []string
+			for _, b := range buses {
+				ids = append(ids, b.ID)
+			}
+			assert.Equal(subT, expectedIDs, ids, "unexpected updated buses")
+		}
+	}
+
+	t.Run("all", subTestFunc(createdBuses[0].UpdatedAt, "test-since-1", "test-since-2", "test-since-0"))
+	t.Run("inclusive", subTestFunc(createdBuses[2].UpdatedAt, "test-since-2", "test-since-0"))
+	t.Run("updated", subTestFunc(updatedBus.UpdatedAt, "test-since-0"))
+	t.Run("future", subTestFunc(time.Now().Add(time.Hour)))
+}
+
+func TestRepository_ReadBusDeletionsSince(t *testing.T) {
+	t.Run("missing time", func(subT *testing.T) {
+		_, err := repo.ReadBusDeletionsSince(context.Background(), time.Time{})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case MissingParameterError:
+			assert.Equal(subT, "deleted_since", causeErr.(MissingParameterError).Name, "wrong missing parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	since := time.Now().Truncate(timePrecision)
+
+	for i := 0; i < 3; i++ {
+		bus := Bus{
+			ID:        fmt.Sprintf("test-deleted-%v", i),
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			t.Skipf("failed to create bus which would be deleted: %v", err)
+		}
+		if err := repo.DeleteBus(context.Background(), bus.ID); err != nil {
+			t.Skipf("failed to delete bus: %v", err)
+		}
+	}
+
+	// the last bus is created again after being deleted
+	recreatedBus := Bus{
+		ID:        "test-deleted-2",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	if _, err := repo.CreateBus(context.Background(), recreatedBus); err != nil {
+		t.Skipf("failed to create bus again: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), recreatedBus.ID)
+
+	t.Run("deleted", func(subT *testing.T) {
+		ids, err := repo.ReadBusDeletionsSince(context.Background(), since)
+		require.NoError(subT, err, "failed to read bus deletions")
+		assert.Equal(subT, []string{"test-deleted-0", "test-deleted-1"}, ids, "unexpected deleted buses")
+	})
+
+	t.Run("future", func(subT *testing.T) {
+		ids, err := repo.ReadBusDeletionsSince(context.Background(), time.Now().Add(time.Hour))
+		require.NoError(subT, err, "failed to read bus deletions")
+		assert.Empty(subT, ids, "no bus should have been deleted in the future")
+	})
+
+	t.Run("failed deletion", func(subT *testing.T) {
+		err := repo.DeleteBus(context.Background(), "test-deleted-not-found")
+		require.Equal(subT, ErrNoSuchRow, errors.Cause(err), "unexpected error")
+
+		ids, err := repo.ReadBusDeletionsSince(context.Background(), since)
+		require.NoError(subT, err, "failed to read bus deletions")
+		assert.NotContains(subT, ids, "test-deleted-not-found", "a bus which doesn't exist shouldn't be recorded as deleted")
+	})
+}
+
+func TestRepository_ReadNearbyBuses(t *testing.T) {
+	t.Run("invalid point", func(subT *testing.T) {
+		_, err := repo.ReadNearbyBuses(context.Background(), 91, 4.56, 1000)
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "latitude", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("invalid radius", func(subT *testing.T) {
+		for _, radius := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+			_, err := repo.ReadNearbyBuses(context.Background(), 1.23, 4.56, radius)
+			switch causeErr := errors.Cause(err); causeErr.(type) {
+			case InvalidParameterError:
+				assert.Equal(subT, "radius", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+			default:
+				assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+			}
+		}
+	})
+
+	t.Run("some buses", func(subT *testing.T) {
+		// roughly 170 m, 390 m, 950 m and 5.4 km away from the point
+		for i, lat := range []float64{-23.5505, -23.5555, -23.5605, -23.6005} {
+			bus := Bus{
+				ID:        fmt.Sprintf("test-nearby-%v", i),
+				Latitude:  lat,
+				Longitude: -46.6333,
+			}
+			if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+				subT.Skipf("failed to create bus which would be read: %v", err)
+			}
+			defer repo.DeleteBus(context.Background(), bus.ID)
+		}
+
+		buses, err := repo.ReadNearbyBuses(context.Background(), -23.5520, -46.6333, 1000)
+		require.NoError(subT, err, "failed to read nearby buses")
+		require.Len(subT, buses, 3)
+		assert.Equal(subT, "test-nearby-0", buses[0].ID, "first bus")
+		assert.Equal(subT, "test-nearby-1", buses[1].ID, "second bus")
+		assert.Equal(subT, "test-nearby-2", buses[2].ID, "third bus")
+	})
+}
+
+func TestRepository_ReadBusesInBox(t *testing.T) {
+	t.Run("invalid box", func(subT *testing.T) {
+		for _, box := range [][4]float64{
+			{-91, 0, 10, 10},
+			{0, 0, 10, 181},
+			{10, 0, 0, 10},
+		} {
+			_, err := repo.ReadBusesInBox(context.Background(), box[0], box[1], box[2], box[3])
+			switch causeErr := errors.Cause(err); causeErr.(type) {
+			case InvalidParameterError:
+			default:
+				assert.Fail(subT, "unexpected error", "%v: %T: %[2]v", box, causeErr)
+			}
+		}
+	})
+
+	buses := []Bus{
+		{ID: "test-box-0", Latitude: 1, Longitude: 1},
+		{ID: "test-box-1", Latitude: 2, Longitude: 179.5},
+		{ID: "test-box-2", Latitude: 3, Longitude: -179.5},
+		{ID: "test-box-3", Latitude: 4, Longitude: 2},
+	}
+	for _, bus := range buses {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			t.Skipf("failed to create bus which would be read: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), bus.ID)
+	}
+
+	subTestFunc := func(minLat, minLng, maxLat, maxLng float64, expectedIDs ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			buses, err := repo.ReadBusesInBox(context.Background(), minLat, minLng, maxLat, maxLng)
+			require.NoError(subT, err, "failed to read buses in box")
+
+			var ids []string
+			for _, b := range buses {
+				ids = append(ids, b.ID)
+			}
+			assert.Equal(subT, expectedIDs, ids, "unexpected buses in box")
+		}
+	}
+
+	t.Run("regular", subTestFunc(0, 0, 3.5, 10, "test-box-0"))
+	t.Run("inclusive", subTestFunc(1, 1, 4, 2, "test-box-0", "test-box-3"))
+	t.Run("antimeridian", subTestFunc(0, 179, 10, -179, "test-box-1", "test-box-2"))
+	t.Run("empty", subTestFunc(-10, -10, -5, -5))
+}
+
 func TestRepository_UpdateBus(t *testing.T) {
 	t.Run("missing ID", func(subT *testing.T) {
-		bus := Bus{ID: "test-update"}
+		bus := Bus{
+			ID:        "test-update",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
 
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			subT.Skipf("failed to create bus which would be updated: %v", err)
 		}
-		defer repo.DeleteBus(bus.ID)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		bus.ID = ""
 
-		_, err := repo.UpdateBus(bus)
+		_, err := repo.UpdateBus(context.Background(), bus)
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case MissingParameterError:
 			assert.Equal(subT, "id", causeErr.(MissingParameterError).Name, "bad missing parameter name")
@@ -210,30 +761,38 @@ func TestRepository_UpdateBus(t *testing.T) {
 	})
 
 	t.Run("non-existing ID", func(subT *testing.T) {
-		bus := Bus{ID: "test-update"}
+		bus := Bus{
+			ID:        "test-update",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
 
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			subT.Skipf("failed to create bus which would be updated: %v", err)
 		}
-		defer repo.DeleteBus(bus.ID)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		bus.ID = "bar"
 
-		_, err := repo.UpdateBus(bus)
+		_, err := repo.UpdateBus(context.Background(), bus)
 		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
 	})
 
 	t.Run("creation time non-null", func(subT *testing.T) {
-		bus := Bus{ID: "test-update"}
+		bus := Bus{
+			ID:        "test-update",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
 
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			subT.Skipf("failed to create bus which would be updated: %v", err)
 		}
-		defer repo.DeleteBus(bus.ID)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		bus.CreatedAt = time.Now()
 
-		_, err := repo.UpdateBus(bus)
+		_, err := repo.UpdateBus(context.Background(), bus)
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case InvalidParameterError:
 			assert.Equal(subT, "created_at", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
@@ -243,16 +802,20 @@ func TestRepository_UpdateBus(t *testing.T) {
 	})
 
 	t.Run("update time non-null", func(subT *testing.T) {
-		bus := Bus{ID: "test-update"}
+		bus := Bus{
+			ID:        "test-update",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
 
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			subT.Skipf("failed to create bus which would be updated: %v", err)
 		}
-		defer repo.DeleteBus(bus.ID)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		bus.UpdatedAt = time.Now()
 
-		_, err := repo.UpdateBus(bus)
+		_, err := repo.UpdateBus(context.Background(), bus)
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case InvalidParameterError:
 			assert.Equal(subT, "updated_at", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
@@ -262,17 +825,21 @@ func TestRepository_UpdateBus(t *testing.T) {
 	})
 
 	t.Run("success", func(subT *testing.T) {
-		bus := Bus{ID: "test-update"}
+		bus := Bus{
+			ID:        "test-update",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
 
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			subT.Skipf("failed to create bus which would be updated: %v", err)
 		}
-		defer repo.DeleteBus(bus.ID)
+		defer repo.DeleteBus(context.Background(), bus.ID)
 
 		bus.Latitude = 1.23
 		bus.Longitude = 4.56
 
-		updatedBus, err := repo.UpdateBus(bus)
+		updatedBus, err := repo.UpdateBus(context.Background(), bus)
 		require.NoError(subT, err, "failed to create bus")
 		assert.Equal(subT, bus.ID, updatedBus.ID, "bus ID")
 		assert.Equal(subT, bus.Latitude, updatedBus.Latitude, "bus latitude")
@@ -280,20 +847,709 @@ func TestRepository_UpdateBus(t *testing.T) {
 	})
 }
 
+func TestRepository_UpdateBusIfMatch(t *testing.T) {
+	bus := Bus{
+		ID:        "test-update-if-match",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	t.Run("not found", func(subT *testing.T) {
+		notFoundBus := bus
+		notFoundBus.ID = "not-found"
+
+		_, err := repo.UpdateBusIfMatch(context.Background(), notFoundBus, createdBus.UpdatedAt)
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("mismatch", func(subT *testing.T) {
+		_, err := repo.UpdateBusIfMatch(context.Background(), bus, createdBus.UpdatedAt.Add(-time.Second))
+		assert.EqualError(subT, errors.Cause(err), ErrConcurrentUpdate.Error())
+	})
+
+	t.Run("success", func(subT *testing.T) {
+		existingBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+
+		updatedBus, err := repo.UpdateBusIfMatch(context.Background(), bus, existingBus.UpdatedAt)
+		require.NoError(subT, err, "failed to update bus")
+
+		// the previous update time doesn't match anymore
+		_, err = repo.UpdateBusIfMatch(context.Background(), bus, existingBus.UpdatedAt)
+		assert.EqualError(subT, errors.Cause(err), ErrConcurrentUpdate.Error())
+
+		_, err = repo.UpdateBusIfMatch(context.Background(), bus, updatedBus.UpdatedAt)
+		assert.NoError(subT, err, "failed to update bus with the latest update time")
+	})
+
+	t.Run("concurrent update", func(subT *testing.T) {
+		existingBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+
+		// someone else updates the bus after it was read by the repository
+		staleBus := existingBus
+		staleBus.UpdatedAt = time.Now()
+		require.NoError(subT, repo.src.UpdateBus(context.Background(), staleBus, time.Time{}), "failed to update bus")
+
+		err = repo.src.UpdateBus(context.Background(), existingBus, existingBus.UpdatedAt)
+		assert.EqualError(subT, errors.Cause(err), ErrConcurrentUpdate.Error())
+	})
+
+	t.Run("simultaneous updates", func(subT *testing.T) {
+		existingBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+
+		const nUpdates = 5
+		errs := make(chan error, nUpdates)
+		for i := 0; i < nUpdates; i++ {
+			go func() {
+				_, err := repo.UpdateBusIfMatch(context.Background(), bus, existingBus.UpdatedAt)
+				errs <- err
+			}()
+		}
+
+		nSuccesses := 0
+		for i := 0; i < nUpdates; i++ {
+			if err := <-errs; err == nil {
+				nSuccesses++
+			} else {
+				assert.EqualError(subT, errors.Cause(err), ErrConcurrentUpdate.Error())
+			}
+		}
+		assert.Equal(subT, 1, nSuccesses, "only one update should match the previous update time")
+	})
+}
+
+func TestRepository_UpdateBus_recordedAt(t *testing.T) {
+	recordedAt := time.Now().Add(-time.Hour).Truncate(timePrecision)
+
+	bus := Bus{
+		ID:         "test-update-recorded-at",
+		Latitude:   1.23,
+		Longitude:  4.56,
+		RecordedAt: recordedAt,
+	}
+
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	assert.True(t, recordedAt.Equal(createdBus.RecordedAt), "the device time should be kept")
+
+	t.Run("future", func(subT *testing.T) {
+		futureBus := bus
+		futureBus.RecordedAt = time.Now().Add(DefaultMaxClockSkew + time.Minute)
+
+		_, err := repo.UpdateBus(context.Background(), futureBus)
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "recorded_at", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("clock skew", func(subT *testing.T) {
+		skewedBus := bus
+		skewedBus.RecordedAt = time.Now().Add(DefaultMaxClockSkew / 2)
+
+		updatedBus, err := repo.UpdateBus(context.Background(), skewedBus)
+		require.NoError(subT, err, "failed to update bus slightly ahead of the server")
+		assert.False(subT, updatedBus.RecordedAt.After(updatedBus.UpdatedAt), "the position shouldn't be recorded in the future")
+
+		recordedAt = updatedBus.RecordedAt
+	})
+
+	t.Run("outdated", func(subT *testing.T) {
+		outdatedBus := bus
+		outdatedBus.Latitude = 7.89
+		outdatedBus.RecordedAt = recordedAt.Add(-time.Second)
+
+		_, err := repo.UpdateBus(context.Background(), outdatedBus)
+		assert.EqualError(subT, errors.Cause(err), ErrOutdatedPosition.Error())
+
+		existingBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, bus.Latitude, existingBus.Latitude, "the outdated position shouldn't be stored")
+
+		// the source must also reject it, in case another position is stored
+		// after the repository checked it
+		outdatedBus.UpdatedAt = time.Now()
+		err = repo.src.UpdateBus(context.Background(), outdatedBus, time.Time{})
+		assert.EqualError(subT, errors.Cause(err), ErrOutdatedPosition.Error())
+	})
+
+	t.Run("success", func(subT *testing.T) {
+		bus.RecordedAt = time.Now().Truncate(timePrecision)
+
+		updatedBus, err := repo.UpdateBus(context.Background(), bus)
+		require.NoError(subT, err, "failed to update bus")
+		assert.True(subT, bus.RecordedAt.Equal(updatedBus.RecordedAt), "the device time should be kept")
+
+		locations, err := repo.ReadLocations(context.Background(), bus.ID, bus.RecordedAt, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		require.Len(subT, locations, 1, "the location should be recorded at the device time")
+		assert.True(subT, bus.RecordedAt.Equal(locations[0].RecordedAt), "location time")
+	})
+
+	t.Run("missing", func(subT *testing.T) {
+		bus.RecordedAt = time.Time{}
+
+		updatedBus, err := repo.UpdateBus(context.Background(), bus)
+		require.NoError(subT, err, "failed to update bus")
+		assert.True(subT, updatedBus.RecordedAt.Equal(updatedBus.UpdatedAt), "the server time should be used")
+	})
+}
+
+func TestRepository_UpdateBus_position(t *testing.T) {
+	bus := Bus{
+		ID:        "test-update-position",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	for _, tc := range positionTestCases {
+		t.Run(tc.name, func(subT *testing.T) {
+			bus.Latitude = tc.latitude
+			bus.Longitude = tc.longitude
+
+			_, err := repo.UpdateBus(context.Background(), bus)
+			assertPositionError(subT, tc.invalidParameter, err)
+		})
+	}
+}
+
+func TestRepository_ReadLocations(t *testing.T) {
+	bus := Bus{
+		ID:        "test-locations",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	_, err := repo.CreateBus(context.Background(), bus)
+	require.NoError(t, err, "failed to create bus which would be updated")
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	nLocations := 3
+	updatedBuses := make([]Bus, nLocations)
+
+	for i := range updatedBuses {
+		bus.Latitude = float64(i + 1)
+		bus.Longitude = float64(i + 1)
+
+		updatedBus, err := repo.UpdateBus(context.Background(), bus)
+		require.NoError(t, err, "failed to update bus")
+
+		updatedBuses[i] = updatedBus
+	}
+
+	t.Run("missing ID", func(subT *testing.T) {
+		_, err := repo.ReadLocations(context.Background(), "", time.Time{}, time.Time{})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case MissingParameterError:
+			assert.Equal(subT, "id", causeErr.(MissingParameterError).Name, "wrong missing parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("non-existing ID", func(subT *testing.T) {
+		_, err := repo.ReadLocations(context.Background(), "non-existing", time.Time{}, time.Time{})
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("invalid time range", func(subT *testing.T) {
+		now := time.Now()
+
+		_, err := repo.ReadLocations(context.Background(), bus.ID, now, now.Add(-time.Minute))
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case InvalidParameterError:
+			assert.Equal(subT, "until", causeErr.(InvalidParameterError).Name, "wrong invalid parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("all", func(subT *testing.T) {
+		locations, err := repo.ReadLocations(context.Background(), bus.ID, time.Time{}, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		require.Len(subT, locations, nLocations)
+		for i, l := range locations {
+			assert.Equal(subT, bus.ID, l.BusID, "location bus ID")
+			assert.Equal(subT, updatedBuses[i].Latitude, l.Latitude, "location latitude")
+			assert.Equal(subT, updatedBuses[i].Longitude, l.Longitude, "location longitude")
+		}
+	})
+
+	t.Run("time range", func(subT *testing.T) {
+		since := updatedBuses[1].UpdatedAt
+		until := updatedBuses[nLocations-1].UpdatedAt
+
+		locations, err := repo.ReadLocations(context.Background(), bus.ID, since, until)
+		require.NoError(subT, err, "failed to read locations")
+		require.Len(subT, locations, nLocations-1)
+		assert.Equal(subT, updatedBuses[1].Latitude, locations[0].Latitude, "first location latitude")
+	})
+}
+
+func TestRepository_CreateLocations(t *testing.T) {
+	bus := Bus{
+		ID:        "test-create-locations",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	location := func(lat float64, recordedAt time.Time) Location {
+		return Location{
+			Latitude:   lat,
+			Longitude:  4.56,
+			RecordedAt: recordedAt,
+		}
+	}
+
+	t.Run("missing ID", func(subT *testing.T) {
+		err := repo.CreateLocations(context.Background(), "", []Location{location(1.23, time.Now())})
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case MissingParameterError:
+			assert.Equal(subT, "id", causeErr.(MissingParameterError).Name, "wrong missing parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("empty", func(subT *testing.T) {
+		err := repo.CreateLocations(context.Background(), bus.ID, nil)
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case MissingParameterError:
+			assert.Equal(subT, "locations", causeErr.(MissingParameterError).Name, "wrong missing parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("not found", func(subT *testing.T) {
+		err := repo.CreateLocations(context.Background(), "not-found", []Location{location(1.23, time.Now())})
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("invalid", func(subT *testing.T) {
+		locations := []Location{
+			location(1.23, time.Now()),
+			location(100, time.Now()),
+			location(1.23, time.Time{}),
+			location(1.23, time.Now().Add(time.Hour)),
+		}
+
+		err := repo.CreateLocations(context.Background(), bus.ID, locations)
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case BatchError:
+			itemErrs := causeErr.(BatchError).Errors
+			require.Len(subT, itemErrs, 3, "unexpected number of invalid locations")
+			for i, expectedName := range []string{"latitude", "recorded_at", "recorded_at"} {
+				assert.Equal(subT, i+1, itemErrs[i].Index, "wrong invalid location index")
+				assert.Contains(subT, itemErrs[i].Err.Error(), expectedName, "wrong invalid location parameter")
+			}
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+
+		storedLocations, err := repo.ReadLocations(context.Background(), bus.ID, time.Time{}, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		assert.Empty(subT, storedLocations, "no location should be stored")
+	})
+
+	t.Run("outdated", func(subT *testing.T) {
+		locations := []Location{
+			location(7.89, createdBus.RecordedAt.Add(-2*time.Minute)),
+			location(7.65, createdBus.RecordedAt.Add(-time.Minute)),
+		}
+
+		require.NoError(subT, repo.CreateLocations(context.Background(), bus.ID, locations), "failed to create locations")
+
+		existingBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, bus.Latitude, existingBus.Latitude, "the bus shouldn't be moved to an older position")
+
+		storedLocations, err := repo.ReadLocations(context.Background(), bus.ID, time.Time{}, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		assert.Len(subT, storedLocations, 2, "the older locations should be kept in the history")
+	})
+
+	t.Run("success", func(subT *testing.T) {
+		now := time.Now().Truncate(timePrecision)
+		locations := []Location{
+			location(2.34, now),
+			location(3.45, now.Add(-time.Second)),
+		}
+
+		require.NoError(subT, repo.CreateLocations(context.Background(), bus.ID, locations), "failed to create locations")
+
+		existingBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, locations[0].Latitude, existingBus.Latitude, "the bus should be moved to the newest position")
+		assert.True(subT, now.Equal(existingBus.RecordedAt), "the bus should be recorded at the newest position time")
+
+		storedLocations, err := repo.ReadLocations(context.Background(), bus.ID, locations[1].RecordedAt, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		require.Len(subT, storedLocations, 2, "unexpected number of locations")
+		assert.Equal(subT, locations[1].Latitude, storedLocations[0].Latitude, "the locations should be ordered by time")
+	})
+}
+
+func TestRepository_CreateAPIKey(t *testing.T) {
+	t.Run("missing name", func(subT *testing.T) {
+		_, _, err := repo.CreateAPIKey(context.Background(), " ")
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case MissingParameterError:
+			assert.Equal(subT, "name", causeErr.(MissingParameterError).Name, "wrong missing parameter name")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("success", func(subT *testing.T) {
+		key, wholeKey, err := repo.CreateAPIKey(context.Background(), "test-create")
+		require.NoError(subT, err, "failed to create API key")
+		assert.NotEmpty(subT, wholeKey)
+		assert.False(subT, key.Revoked(), "a new key shouldn't be revoked")
+
+		keys, err := repo.ReadAllAPIKeys(context.Background())
+		require.NoError(subT, err, "failed to read all API keys")
+
+		found := false
+		for _, k := range keys {
+			if k.ID == key.ID {
+				found = true
+				assert.Equal(subT, key.Name, k.Name, "API key name")
+				assert.Equal(subT, key.SecretHash, k.SecretHash, "API key secret hash")
+			}
+		}
+		assert.True(subT, found, "the new key should be listed")
+	})
+}
+
+func TestRepository_AuthenticateAPIKey(t *testing.T) {
+	key, wholeKey, err := repo.CreateAPIKey(context.Background(), "test-authenticate")
+	if err != nil {
+		t.Skipf("failed to create API key which would be authenticated: %v", err)
+	}
+
+	authenticatedKey, err := repo.AuthenticateAPIKey(context.Background(), wholeKey)
+	require.NoError(t, err, "failed to authenticate API key")
+	assert.Equal(t, key.ID, authenticatedKey.ID, "wrong API key")
+
+	for _, invalidKey := range []string{"", "malformed", "not-found.secret", key.ID + ".wrong-secret"} {
+		_, err := repo.AuthenticateAPIKey(context.Background(), invalidKey)
+		assert.EqualError(t, errors.Cause(err), ErrInvalidAPIKey.Error(), "key %q", invalidKey)
+	}
+
+	require.NoError(t, repo.RevokeAPIKey(context.Background(), key.ID), "failed to revoke API key")
+
+	_, err = repo.AuthenticateAPIKey(context.Background(), wholeKey)
+	assert.EqualError(t, errors.Cause(err), ErrInvalidAPIKey.Error(), "a revoked key shouldn't be valid")
+}
+
+func TestRepository_RevokeAPIKey(t *testing.T) {
+	key, _, err := repo.CreateAPIKey(context.Background(), "test-revoke")
+	if err != nil {
+		t.Skipf("failed to create API key which would be revoked: %v", err)
+	}
+
+	require.NoError(t, repo.RevokeAPIKey(context.Background(), key.ID), "failed to revoke API key")
+
+	keys, err := repo.ReadAllAPIKeys(context.Background())
+	require.NoError(t, err, "failed to read all API keys")
+	for _, k := range keys {
+		if k.ID == key.ID {
+			assert.True(t, k.Revoked(), "the key should be revoked")
+		}
+	}
+
+	err = repo.RevokeAPIKey(context.Background(), key.ID)
+	assert.EqualError(t, errors.Cause(err), ErrNoSuchRow.Error(), "a key can only be revoked once")
+
+	err = repo.RevokeAPIKey(context.Background(), "not-found")
+	assert.EqualError(t, errors.Cause(err), ErrNoSuchRow.Error())
+}
+
+func TestRepository_VerifyBusToken(t *testing.T) {
+	bus := Bus{
+		ID:        "test-verify-token",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be verified: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	require.NotEmpty(t, createdBus.Token, "the created bus should have a token")
+
+	readBus, err := repo.ReadBus(context.Background(), bus.ID)
+	require.NoError(t, err, "failed to read bus")
+	assert.Empty(t, readBus.Token, "the token shouldn't be stored")
+
+	t.Run("valid token", func(subT *testing.T) {
+		assert.NoError(subT, repo.VerifyBusToken(context.Background(), bus.ID, createdBus.Token))
+	})
+
+	t.Run("invalid token", func(subT *testing.T) {
+		for _, token := range []string{"", "foo", createdBus.Token + "foo"} {
+			err := repo.VerifyBusToken(context.Background(), bus.ID, token)
+			assert.EqualError(subT, errors.Cause(err), ErrInvalidBusToken.Error(), "token %q", token)
+		}
+	})
+
+	t.Run("not found", func(subT *testing.T) {
+		err := repo.VerifyBusToken(context.Background(), "not-found", createdBus.Token)
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("bus without token", func(subT *testing.T) {
+		legacyBus := Bus{
+			ID:         "test-verify-token-legacy",
+			Latitude:   1.23,
+			Longitude:  4.56,
+			RecordedAt: time.Now(),
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+		}
+
+		// the sources don't generate tokens, so it's like the buses created before them
+		err := repo.WithTx(context.Background(), func(src Source) error {
+			return src.CreateBus(context.Background(), legacyBus)
+		})
+		if err != nil {
+			subT.Skipf("failed to create bus without token: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), legacyBus.ID)
+
+		err = repo.VerifyBusToken(context.Background(), legacyBus.ID, "")
+		assert.EqualError(subT, errors.Cause(err), ErrInvalidBusToken.Error(), "a bus without token shouldn't be changed")
+
+		token, err := repo.IssueBusToken(context.Background(), legacyBus.ID)
+		require.NoError(subT, err, "failed to issue bus token")
+		assert.NoError(subT, repo.VerifyBusToken(context.Background(), legacyBus.ID, token))
+	})
+}
+
+func TestRepository_IssueBusToken(t *testing.T) {
+	bus := Bus{
+		ID:        "test-issue-token",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would get a token: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	t.Run("existing", func(subT *testing.T) {
+		token, err := repo.IssueBusToken(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to issue bus token")
+		assert.NotEqual(subT, createdBus.Token, token, "the new token should be different")
+
+		assert.NoError(subT, repo.VerifyBusToken(context.Background(), bus.ID, token))
+		err = repo.VerifyBusToken(context.Background(), bus.ID, createdBus.Token)
+		assert.EqualError(subT, errors.Cause(err), ErrInvalidBusToken.Error(), "the previous token shouldn't be valid anymore")
+
+		readBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.True(subT, createdBus.UpdatedAt.Equal(readBus.UpdatedAt), "the bus shouldn't be updated")
+	})
+
+	t.Run("not found", func(subT *testing.T) {
+		_, err := repo.IssueBusToken(context.Background(), "not-found")
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+}
+
+func TestRepository_WithTx(t *testing.T) {
+	now := time.Now()
+	bus := Bus{
+		ID:         "test-with-tx",
+		Latitude:   1.23,
+		Longitude:  4.56,
+		RecordedAt: now,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	errRollback := errors.New("rollback")
+
+	t.Run("rollback", func(subT *testing.T) {
+		err := repo.WithTx(context.Background(), func(src Source) error {
+			require.NoError(subT, src.CreateBus(context.Background(), bus), "failed to create bus")
+
+			_, err := src.ReadBus(context.Background(), bus.ID)
+			assert.NoError(subT, err, "the bus should exist inside the transaction")
+
+			return errRollback
+		})
+		assert.Equal(subT, errRollback, errors.Cause(err))
+
+		_, err = repo.ReadBus(context.Background(), bus.ID)
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("nested rollback", func(subT *testing.T) {
+		err := repo.WithTx(context.Background(), func(src Source) error {
+			err := src.WithTx(context.Background(), func(nestedSrc Source) error {
+				return nestedSrc.CreateBus(context.Background(), bus)
+			})
+			require.NoError(subT, err, "failed to create bus in nested transaction")
+
+			return errRollback
+		})
+		assert.Equal(subT, errRollback, errors.Cause(err))
+
+		_, err = repo.ReadBus(context.Background(), bus.ID)
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("commit", func(subT *testing.T) {
+		err := repo.WithTx(context.Background(), func(src Source) error {
+			if err := src.CreateBus(context.Background(), bus); err != nil {
+				return err
+			}
+
+			return src.CreateLocation(context.Background(), Location{
+				BusID:      bus.ID,
+				Latitude:   bus.Latitude,
+				Longitude:  bus.Longitude,
+				RecordedAt: bus.RecordedAt,
+			})
+		})
+		require.NoError(subT, err, "failed to commit transaction")
+		defer repo.DeleteBus(context.Background(), bus.ID)
+
+		_, err = repo.ReadBus(context.Background(), bus.ID)
+		assert.NoError(subT, err, "failed to read bus")
+
+		locations, err := repo.ReadLocations(context.Background(), bus.ID, time.Time{}, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		assert.Len(subT, locations, 1)
+	})
+}
+
+func TestRepository_Subscribe(t *testing.T) {
+	bus := Bus{
+		ID:        "test-subscribe",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	allEvents, unsubscribeAll := repo.Subscribe("")
+	defer unsubscribeAll()
+
+	busEvents, unsubscribeBus := repo.Subscribe(bus.ID)
+	defer unsubscribeBus()
+
+	otherEvents, unsubscribeOther := repo.Subscribe("test-subscribe-other")
+	defer unsubscribeOther()
+
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to create bus: %v", err)
+	}
+	if _, err := repo.UpdateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to update bus: %v", err)
+	}
+	if err := repo.DeleteBus(context.Background(), bus.ID); err != nil {
+		t.Skipf("failed to delete bus: %v", err)
+	}
+
+	for _, events := range []<-chan BusEvent{allEvents, busEvents} {
+		for _, expectedType := range []EventType{BusCreated, BusUpdated, BusDeleted} {
+			select {
+			case e := <-events:
+				assert.Equal(t, expectedType, e.Type, "unexpected event type")
+				assert.Equal(t, bus.ID, e.Bus.ID, "unexpected event bus ID")
+				assert.Empty(t, e.Bus.Token, "the bus token shouldn't be sent to subscribers")
+			case <-time.After(time.Second):
+				assert.Fail(t, "event not received", "%v", expectedType)
+			}
+		}
+	}
+
+	select {
+	case e := <-otherEvents:
+		assert.Fail(t, "unexpected event", "%v", e)
+	default:
+	}
+
+	unsubscribeBus()
+	_, ok := <-busEvents
+	assert.False(t, ok, "channel should be closed after unsubscribing")
+}
+
+func TestRepository_CloseSubscriptions(t *testing.T) {
+	// don't use the global repository because its subscriptions can't be
+	// reopened
+	testRepo := NewMemoryRepository()
+	defer testRepo.Close()
+
+	events, unsubscribe := testRepo.Subscribe("")
+	defer unsubscribe()
+
+	testRepo.CloseSubscriptions()
+
+	_, ok := <-events
+	assert.False(t, ok, "channel should be closed with the subscriptions")
+
+	lateEvents, lateUnsubscribe := testRepo.Subscribe("")
+	defer lateUnsubscribe()
+
+	_, ok = <-lateEvents
+	assert.False(t, ok, "channel should be closed if subscribed afterwards")
+
+	_, err := testRepo.CreateBus(context.Background(), Bus{
+		ID:        "test-close-subscriptions",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	})
+	assert.NoError(t, err, "the repository should still work without subscriptions")
+}
+
 func TestRepository_DeleteBus(t *testing.T) {
-	bus := Bus{ID: "test-delete"}
+	bus := Bus{
+		ID:        "test-delete",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 
 	t.Run("existing", func(subT *testing.T) {
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			t.Skipf("failed to create bus which would be deleted: %v", err)
 		}
 
-		err := repo.DeleteBus(bus.ID)
+		err := repo.DeleteBus(context.Background(), bus.ID)
 		assert.NoError(subT, err, "failed to delete bus")
 	})
 
 	t.Run("non-existing", func(subT *testing.T) {
-		err := repo.DeleteBus("non-existing")
+		err := repo.DeleteBus(context.Background(), "non-existing")
 		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
 	})
 }
@@ -331,15 +1587,19 @@ func BenchmarkRepository_Close(b *testing.B) {
 }
 
 func BenchmarkRepository_CreateBus(b *testing.B) {
-	bus := Bus{ID: "bench-create"}
+	bus := Bus{
+		ID:        "bench-create",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 
 	for n := 0; n < b.N; n++ {
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			b.Fatal(err)
 		}
 
 		b.StopTimer()
-		if err := repo.DeleteBus(bus.ID); err != nil {
+		if err := repo.DeleteBus(context.Background(), bus.ID); err != nil {
 			b.Error(err)
 		}
 		b.StartTimer()
@@ -347,17 +1607,21 @@ func BenchmarkRepository_CreateBus(b *testing.B) {
 }
 
 func BenchmarkRepository_ReadBus(b *testing.B) {
-	bus := Bus{ID: "bench-read"}
+	bus := Bus{
+		ID:        "bench-read",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 
-	if _, err := repo.CreateBus(bus); err != nil {
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 		b.Skipf("failed to create bus which would be read: %v", err)
 	}
-	defer repo.DeleteBus(bus.ID)
+	defer repo.DeleteBus(context.Background(), bus.ID)
 
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
-		if _, err := repo.ReadBus(bus.ID); err != nil {
+		if _, err := repo.ReadBus(context.Background(), bus.ID); err != nil {
 			b.Error(err)
 		}
 	}
@@ -372,17 +1636,21 @@ func BenchmarkRepository_ReadAllBuses(b *testing.B) {
 	for _, nb := range nBuses {
 		b.Run(strconv.Itoa(nb), func(subB *testing.B) {
 			for i := 0; i < nb; i++ {
-				bus := Bus{ID: fmt.Sprintf("bench-readall-%v", i)}
-				if _, err := repo.CreateBus(bus); err != nil {
+				bus := Bus{
+					ID:        fmt.Sprintf("bench-readall-%v", i),
+					Latitude:  1.23,
+					Longitude: 4.56,
+				}
+				if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 					subB.Skipf("failed to create bus which would be read: %v", err)
 				}
-				defer repo.DeleteBus(bus.ID)
+				defer repo.DeleteBus(context.Background(), bus.ID)
 			}
 
 			subB.ResetTimer()
 
 			for n := 0; n < subB.N; n++ {
-				if _, err := repo.ReadAllBuses(); err != nil {
+				if _, err := repo.ReadAllBuses(context.Background()); err != nil {
 					subB.Error(err)
 				}
 			}
@@ -394,20 +1662,24 @@ func BenchmarkRepository_ReadAllBuses(b *testing.B) {
 }
 
 func BenchmarkRepository_UpdateBus(b *testing.B) {
-	bus := Bus{ID: "bench-update"}
+	bus := Bus{
+		ID:        "bench-update",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 
-	if _, err := repo.CreateBus(bus); err != nil {
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 		b.Skipf("failed to create bus which would be updated: %v", err)
 	}
-	defer repo.DeleteBus(bus.ID)
+	defer repo.DeleteBus(context.Background(), bus.ID)
 
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
-		bus.Latitude = float64(n)
-		bus.Longitude = float64(n)
+		bus.Latitude = float64(n%90) + 0.5
+		bus.Longitude = float64(n%180) + 0.5
 
-		if _, err := repo.UpdateBus(bus); err != nil {
+		if _, err := repo.UpdateBus(context.Background(), bus); err != nil {
 			b.Error(err)
 		}
 	}
@@ -417,16 +1689,20 @@ func BenchmarkRepository_UpdateBus(b *testing.B) {
 }
 
 func BenchmarkRepository_DeleteBus(b *testing.B) {
-	bus := Bus{ID: "bench-delete"}
+	bus := Bus{
+		ID:        "bench-delete",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 
 	for n := 0; n < b.N; n++ {
 		b.StopTimer()
-		if _, err := repo.CreateBus(bus); err != nil {
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
 			b.Fatal(err)
 		}
 		b.StartTimer()
 
-		if err := repo.DeleteBus(bus.ID); err != nil {
+		if err := repo.DeleteBus(context.Background(), bus.ID); err != nil {
 			b.Error(err)
 		}
 	}
@@ -0,0 +1,35 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+)
+
+// newSecret generates a random secret, encoded so it can be sent in URLs and
+// HTTP headers.
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", errors.Wrap(err, "failed to generate secret")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashSecret hashes a secret generated by newSecret, so it can be stored
+// without being exposed. The secrets are long and random, so a fast hash is
+// enough to protect them.
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// matchesSecretHash checks whether hash is the hash of secret, taking the same
+// time whatever the secret is.
+func matchesSecretHash(hash []byte, secret string) bool {
+	return subtle.ConstantTimeCompare(hash, hashSecret(secret)) == 1
+}
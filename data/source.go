@@ -1,11 +1,48 @@
 package data
 
+import (
+	"context"
+	"time"
+)
+
 type Source interface {
-	CreateBus(Bus) error
-	ReadAllBuses() ([]Bus, error)
-	ReadBus(string) (Bus, error)
-	UpdateBus(Bus) error
-	DeleteBus(string) error
+	CreateBus(context.Context, Bus) error
+	ReadAllBuses(context.Context) ([]Bus, error)
+	ReadBusesPage(context.Context, Page) ([]Bus, error)
+	CountBuses(context.Context) (int, error)
+	ReadNearbyBuses(ctx context.Context, lat, lng, radius float64) ([]Bus, error)
+	ReadBusesInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]Bus, error)
+	ReadBusesUpdatedSince(ctx context.Context, since time.Time) ([]Bus, error)
+	ReadBus(context.Context, string) (Bus, error)
+	// UpdateBus updates the bus only if its current update time is
+	// previousUpdatedAt, unless that's zero, and if its current position wasn't
+	// recorded after the new one.
+	UpdateBus(ctx context.Context, bus Bus, previousUpdatedAt time.Time) error
+	// UpdateBusTokenHash replaces the token hash of the bus, without changing
+	// anything else.
+	UpdateBusTokenHash(ctx context.Context, id string, tokenHash []byte) error
+	DeleteBus(context.Context, string) error
+	// CreateBusDeletion records that the bus was deleted at deletedAt,
+	// replacing any previous deletion of the same bus ID.
+	CreateBusDeletion(ctx context.Context, id string, deletedAt time.Time) error
+	// ReadBusDeletionsSince reads the IDs of the buses deleted at or after
+	// since which haven't been created again, ordered by their deletion time.
+	ReadBusDeletionsSince(ctx context.Context, since time.Time) ([]string, error)
+
+	CreateLocation(context.Context, Location) error
+	ReadLocations(ctx context.Context, busID string, since, until time.Time) ([]Location, error)
+
+	CreateAPIKey(context.Context, APIKey) error
+	ReadAllAPIKeys(context.Context) ([]APIKey, error)
+	ReadAPIKey(context.Context, string) (APIKey, error)
+	// RevokeAPIKey revokes the API key only if it hasn't been revoked yet.
+	RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error
+
+	// WithTx calls f with a source whose operations all happen in a single
+	// transaction, which is committed if f returns nil and rolled back
+	// otherwise. If the source is already inside a transaction, f runs in
+	// that same one.
+	WithTx(ctx context.Context, f func(Source) error) error
 
 	Close() error
 }
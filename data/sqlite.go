@@ -0,0 +1,589 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+type sqliteSource struct {
+	db              *sqlx.DB
+	tx              *sqlx.Tx // only set inside WithTx
+	insertStmt      *sqlx.Stmt
+	selectAllStmt   *sqlx.Stmt
+	countStmt       *sqlx.Stmt
+	selectNearStmt  *sqlx.Stmt
+	selectBoxStmt   *sqlx.Stmt
+	selectSinceStmt *sqlx.Stmt
+	selectStmt      *sqlx.Stmt
+	updateStmt      *sqlx.Stmt
+	updateTokenStmt *sqlx.Stmt
+	deleteStmt      *sqlx.Stmt
+
+	insertDeletionStmt  *sqlx.Stmt
+	selectDeletionsStmt *sqlx.Stmt
+
+	insertLocationStmt  *sqlx.Stmt
+	selectLocationsStmt *sqlx.Stmt
+
+	insertKeyStmt     *sqlx.Stmt
+	selectAllKeysStmt *sqlx.Stmt
+	selectKeyStmt     *sqlx.Stmt
+	revokeKeyStmt     *sqlx.Stmt
+}
+
+// NewSQLiteRepository opens a SQLite database stored in the file at path. The
+// file is created if it doesn't exist yet, but its schema must have been
+// migrated (see NewSQLiteMigrator); the special path ":memory:" creates a
+// temporary database, which is always migrated during this function. After
+// using the connection, the user must call Close.
+func NewSQLiteRepository(path string) (*Repository, error) {
+	logrus.WithFields(logrus.Fields{
+		"path": path,
+	}).Debug("opening SQLite database")
+
+	// foreign keys are disabled by default on SQLite
+	dsn := path
+	if strings.ContainsRune(dsn, '?') {
+		dsn += "&_foreign_keys=1"
+	} else {
+		dsn += "?_foreign_keys=1"
+	}
+
+	db, err := sqlx.Connect("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open a SQLite database")
+	}
+
+	// SQLite doesn't handle concurrent writers well, and each connection to
+	// ":memory:" would open a different database
+	db.SetMaxOpenConns(1)
+
+	// a new database is created for every connection to ":memory:", so it
+	// can't be migrated beforehand
+	if strings.HasPrefix(path, ":memory:") {
+		if err := migrateTo(db, sqliteMigrations, len(sqliteMigrations)); err != nil {
+			return nil, errors.WithMessage(err, "failed to migrate in-memory database")
+		}
+	}
+
+	if err := checkSchemaVersion(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	src := sqliteSource{db: db}
+	src.insertStmt, err = db.Preparex(`INSERT INTO buses (id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at, token_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare INSERT statement")
+	}
+	src.selectAllStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses ORDER BY id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (all) statement")
+	}
+	src.countStmt, err = db.Preparex(`SELECT COUNT(*) FROM buses`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (count) statement")
+	}
+	src.selectNearStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses
+		WHERE latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (near) statement")
+	}
+	src.selectBoxStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses
+		WHERE latitude BETWEEN ?1 AND ?3 AND (
+			(?2 <= ?4 AND longitude BETWEEN ?2 AND ?4) OR
+			(?2 > ?4 AND (longitude >= ?2 OR longitude <= ?4))
+		) ORDER BY id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (box) statement")
+	}
+	src.selectSinceStmt, err = db.Preparex(`SELECT id, latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at FROM buses
+		WHERE updated_at >= ? ORDER BY updated_at, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (since) statement")
+	}
+	src.selectStmt, err = db.Preparex(`SELECT latitude, longitude, speed, heading, accuracy, altitude, recorded_at, created_at, updated_at, token_hash FROM buses WHERE id = ?`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT statement")
+	}
+	src.updateStmt, err = db.Preparex(`UPDATE buses SET latitude = ?1, longitude = ?2, speed = ?3, heading = ?4, accuracy = ?5, altitude = ?6,
+			recorded_at = ?7, updated_at = ?8
+		WHERE id = ?9 AND recorded_at <= ?7 AND (?10 IS NULL OR updated_at = ?10)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare UPDATE statement")
+	}
+	src.updateTokenStmt, err = db.Preparex(`UPDATE buses SET token_hash = ? WHERE id = ?`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare UPDATE (token) statement")
+	}
+	src.deleteStmt, err = db.Preparex(`DELETE FROM buses WHERE id = ?`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare DELETE statement")
+	}
+	src.insertDeletionStmt, err = db.Preparex(`INSERT OR REPLACE INTO bus_deletions (bus_id, deleted_at) VALUES (?, ?)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare INSERT (deletion) statement")
+	}
+	src.selectDeletionsStmt, err = db.Preparex(`SELECT bus_id FROM bus_deletions
+		WHERE deleted_at >= ? AND NOT EXISTS (SELECT 1 FROM buses WHERE id = bus_id)
+		ORDER BY deleted_at, bus_id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (deletions) statement")
+	}
+	src.insertLocationStmt, err = db.Preparex(`INSERT INTO bus_locations (bus_id, latitude, longitude, recorded_at) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare INSERT (location) statement")
+	}
+	src.selectLocationsStmt, err = db.Preparex(`SELECT id, bus_id, latitude, longitude, recorded_at FROM bus_locations
+		WHERE bus_id = ?1 AND (?2 IS NULL OR recorded_at >= ?2) AND (?3 IS NULL OR recorded_at <= ?3)
+		ORDER BY recorded_at, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (locations) statement")
+	}
+	src.insertKeyStmt, err = db.Preparex(`INSERT INTO api_keys (id, name, secret_hash, created_at) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare INSERT (API key) statement")
+	}
+	src.selectAllKeysStmt, err = db.Preparex(`SELECT id, name, secret_hash, created_at, revoked_at FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (all API keys) statement")
+	}
+	src.selectKeyStmt, err = db.Preparex(`SELECT id, name, secret_hash, created_at, revoked_at FROM api_keys WHERE id = ?`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare SELECT (API key) statement")
+	}
+	src.revokeKeyStmt, err = db.Preparex(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare UPDATE (API key) statement")
+	}
+
+	return newRepositoryFromSource(src), nil
+}
+
+func (src sqliteSource) CreateBus(ctx context.Context, bus Bus) error {
+	// SQLite stores timestamps as text, so they must all be in the same time
+	// zone to be compared correctly
+	res, err := src.stmt(ctx, src.insertStmt).ExecContext(ctx, bus.ID, bus.Latitude, bus.Longitude, bus.Speed, bus.Heading, bus.Accuracy, bus.Altitude,
+		bus.RecordedAt.UTC(), bus.CreatedAt.UTC(), bus.UpdatedAt.UTC(), bus.TokenHash)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return errors.WithMessage(DuplicateError{bus.ID}, "bus with the same ID already exists")
+		}
+		return errors.Wrap(err, "error creating bus")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows != 1 {
+		return errors.New("unexpected number of rows were inserted")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) UpdateBusTokenHash(ctx context.Context, id string, tokenHash []byte) error {
+	res, err := src.stmt(ctx, src.updateTokenStmt).ExecContext(ctx, tokenHash, id)
+	if err != nil {
+		return errors.Wrap(err, "error updating bus token")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows == 0 {
+		return errors.WithMessage(ErrNoSuchRow, "no bus token has been updated")
+	}
+	if nRows > 1 {
+		return errors.New("more rows than expected were updated")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) DeleteBus(ctx context.Context, id string) error {
+	res, err := src.stmt(ctx, src.deleteStmt).ExecContext(ctx, id)
+	if err != nil {
+		return errors.Wrap(err, "error deleting bus")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows == 0 {
+		return errors.WithMessage(ErrNoSuchRow, "no rows have been deleted")
+	}
+	if nRows > 1 {
+		return errors.New("more rows than expected were deleted")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) CreateBusDeletion(ctx context.Context, id string, deletedAt time.Time) error {
+	if _, err := src.stmt(ctx, src.insertDeletionStmt).ExecContext(ctx, id, deletedAt.UTC()); err != nil {
+		return errors.Wrap(err, "error recording bus deletion")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) ReadBusDeletionsSince(ctx context.Context, since time.Time) ([]string, error) {
+	var ids []string
+
+	if err := src.stmt(ctx, src.selectDeletionsStmt).SelectContext(ctx, &ids, since.UTC()); err != nil {
+		return nil, errors.Wrap(err, "failed to read bus deletions")
+	}
+
+	return ids, nil
+}
+
+func (src sqliteSource) ReadAllBuses(ctx context.Context) ([]Bus, error) {
+	var buses []Bus
+
+	if err := src.stmt(ctx, src.selectAllStmt).SelectContext(ctx, &buses); err != nil {
+		return nil, errors.Wrap(err, "failed to read all buses")
+	}
+
+	return buses, nil
+}
+
+func (src sqliteSource) ReadBusesPage(ctx context.Context, page Page) ([]Bus, error) {
+	var cursor Bus
+	if len(page.After) > 0 || len(page.Before) > 0 {
+		var err error
+
+		cursor, err = page.cursor(ctx, src.ReadBus)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query, args := pageQuery(page, cursor)
+
+	var buses []Bus
+
+	if err := sqlx.SelectContext(ctx, src.queryer(), &buses, query, args...); err != nil {
+		return nil, errors.Wrap(err, "failed to read page of buses")
+	}
+
+	if len(page.Before) > 0 {
+		// the previous page is read backwards
+		for i, j := 0, len(buses)-1; i < j; i, j = i+1, j-1 {
+			buses[i], buses[j] = buses[j], buses[i]
+		}
+	}
+
+	return buses, nil
+}
+
+func (src sqliteSource) CountBuses(ctx context.Context) (int, error) {
+	var count int
+
+	if err := src.stmt(ctx, src.countStmt).GetContext(ctx, &count); err != nil {
+		return 0, errors.Wrap(err, "failed to count buses")
+	}
+
+	return count, nil
+}
+
+func (src sqliteSource) ReadNearbyBuses(ctx context.Context, lat, lng, radius float64) ([]Bus, error) {
+	var buses []Bus
+
+	// SQLite doesn't have trigonometric functions by default, so only the
+	// bounding box is filtered by the database
+	minLat, minLng, maxLat, maxLng := boundingBox(lat, lng, radius)
+	if err := src.stmt(ctx, src.selectNearStmt).SelectContext(ctx, &buses, minLat, maxLat, minLng, maxLng); err != nil {
+		return nil, errors.Wrap(err, "failed to read nearby buses")
+	}
+
+	return nearestBuses(buses, lat, lng, radius), nil
+}
+
+func (src sqliteSource) ReadBusesInBox(ctx context.Context, minLat, minLng, maxLat, maxLng float64) ([]Bus, error) {
+	var buses []Bus
+
+	if err := src.stmt(ctx, src.selectBoxStmt).SelectContext(ctx, &buses, minLat, minLng, maxLat, maxLng); err != nil {
+		return nil, errors.Wrap(err, "failed to read buses in box")
+	}
+
+	return buses, nil
+}
+
+func (src sqliteSource) ReadBusesUpdatedSince(ctx context.Context, since time.Time) ([]Bus, error) {
+	var buses []Bus
+
+	if err := src.stmt(ctx, src.selectSinceStmt).SelectContext(ctx, &buses, since.UTC()); err != nil {
+		return nil, errors.Wrap(err, "failed to read updated buses")
+	}
+
+	return buses, nil
+}
+
+func (src sqliteSource) ReadBus(ctx context.Context, id string) (Bus, error) {
+	bus := Bus{ID: id}
+
+	if err := src.stmt(ctx, src.selectStmt).GetContext(ctx, &bus, id); err != nil {
+		if err == sql.ErrNoRows {
+			return Bus{}, errors.WithMessage(ErrNoSuchRow, "bus not found")
+		}
+
+		return Bus{}, errors.Wrap(err, "error reading bus")
+	}
+
+	return bus, nil
+}
+
+func (src sqliteSource) UpdateBus(ctx context.Context, bus Bus, previousUpdatedAt time.Time) error {
+	res, err := src.stmt(ctx, src.updateStmt).ExecContext(ctx, bus.Latitude, bus.Longitude, bus.Speed, bus.Heading, bus.Accuracy, bus.Altitude,
+		bus.RecordedAt.UTC(), bus.UpdatedAt.UTC(), bus.ID, nullTime(previousUpdatedAt.UTC()))
+	if err != nil {
+		return errors.Wrap(err, "error updating bus")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows == 0 {
+		return updateFailure(ctx, src.ReadBus, bus)
+	}
+	if nRows > 1 {
+		return errors.New("more rows than expected were updated")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) CreateLocation(ctx context.Context, loc Location) error {
+	res, err := src.stmt(ctx, src.insertLocationStmt).ExecContext(ctx, loc.BusID, loc.Latitude, loc.Longitude, loc.RecordedAt.UTC())
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errors.WithMessage(ErrNoSuchRow, "bus not found")
+		}
+		return errors.Wrap(err, "error creating location")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows != 1 {
+		return errors.New("unexpected number of rows were inserted")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) ReadLocations(ctx context.Context, busID string, since, until time.Time) ([]Location, error) {
+	var locations []Location
+
+	if err := src.stmt(ctx, src.selectLocationsStmt).SelectContext(ctx, &locations, busID, nullTime(since.UTC()), nullTime(until.UTC())); err != nil {
+		return nil, errors.Wrap(err, "failed to read locations")
+	}
+
+	return locations, nil
+}
+
+func (src sqliteSource) CreateAPIKey(ctx context.Context, key APIKey) error {
+	_, err := src.stmt(ctx, src.insertKeyStmt).ExecContext(ctx, key.ID, key.Name, key.SecretHash, key.CreatedAt.UTC())
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return errors.WithMessage(DuplicateError{key.ID}, "API key with the same ID already exists")
+		}
+		return errors.Wrap(err, "error creating API key")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) ReadAllAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+
+	if err := src.stmt(ctx, src.selectAllKeysStmt).SelectContext(ctx, &keys); err != nil {
+		return nil, errors.Wrap(err, "failed to read all API keys")
+	}
+
+	return keys, nil
+}
+
+func (src sqliteSource) ReadAPIKey(ctx context.Context, id string) (APIKey, error) {
+	var key APIKey
+
+	if err := src.stmt(ctx, src.selectKeyStmt).GetContext(ctx, &key, id); err != nil {
+		if err == sql.ErrNoRows {
+			return APIKey{}, errors.WithMessage(ErrNoSuchRow, "API key not found")
+		}
+
+		return APIKey{}, errors.Wrap(err, "error reading API key")
+	}
+
+	return key, nil
+}
+
+func (src sqliteSource) RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error {
+	res, err := src.stmt(ctx, src.revokeKeyStmt).ExecContext(ctx, revokedAt.UTC(), id)
+	if err != nil {
+		return errors.Wrap(err, "error revoking API key")
+	}
+
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "could not get number of affected rows")
+	}
+	if nRows == 0 {
+		return errors.WithMessage(ErrNoSuchRow, "no active API key has been revoked")
+	}
+
+	return nil
+}
+
+func (src sqliteSource) WithTx(ctx context.Context, f func(Source) error) error {
+	return src.withTx(ctx, func(txSrc sqliteSource) error {
+		return f(txSrc)
+	})
+}
+
+// withTx calls f with a copy of the source whose statements run in a new
+// transaction, or in the current one if there's already one.
+func (src sqliteSource) withTx(ctx context.Context, f func(sqliteSource) error) error {
+	if src.tx != nil {
+		return f(src)
+	}
+
+	tx, err := src.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	// rolling back has no effect after the transaction is committed
+	defer tx.Rollback()
+
+	txSrc := src
+	txSrc.tx = tx
+
+	if err := f(txSrc); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return nil
+}
+
+// stmt returns the prepared statement bound to the current transaction, if
+// there's one.
+func (src sqliteSource) stmt(ctx context.Context, stmt *sqlx.Stmt) *sqlx.Stmt {
+	if src.tx == nil {
+		return stmt
+	}
+
+	return src.tx.StmtxContext(ctx, stmt)
+}
+
+// queryer returns where the statements which aren't prepared should run.
+func (src sqliteSource) queryer() sqlx.QueryerContext {
+	if src.tx == nil {
+		return src.db
+	}
+
+	return src.tx
+}
+
+func (src sqliteSource) Close() error {
+	if src.tx != nil {
+		return errors.New("cannot close the database inside a transaction")
+	}
+
+	if err := src.insertStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close INSERT statement")
+	}
+
+	if err := src.selectAllStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (all) statement")
+	}
+
+	if err := src.countStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (count) statement")
+	}
+
+	if err := src.selectNearStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (near) statement")
+	}
+
+	if err := src.selectBoxStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (box) statement")
+	}
+
+	if err := src.selectSinceStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (since) statement")
+	}
+
+	if err := src.selectStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT statement")
+	}
+
+	if err := src.updateStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close UPDATE statement")
+	}
+
+	if err := src.updateTokenStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close UPDATE (token) statement")
+	}
+
+	if err := src.deleteStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close DELETE statement")
+	}
+
+	if err := src.insertLocationStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close INSERT (location) statement")
+	}
+
+	if err := src.selectLocationsStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (locations) statement")
+	}
+
+	if err := src.insertKeyStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close INSERT (API key) statement")
+	}
+
+	if err := src.selectAllKeysStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (all API keys) statement")
+	}
+
+	if err := src.selectKeyStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SELECT (API key) statement")
+	}
+
+	if err := src.revokeKeyStmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close UPDATE (API key) statement")
+	}
+
+	if err := src.db.Close(); err != nil {
+		return errors.Wrap(err, "failed to close SQLite database")
+	}
+
+	return nil
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok {
+		return false
+	}
+
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
@@ -0,0 +1,214 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSQLiteRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motofretado")
+	require.NoError(t, err, "failed to create temporary directory")
+	defer os.RemoveAll(dir)
+
+	_, err = NewSQLiteRepository(filepath.Join(dir, "non-existing", "test.db"))
+	assert.Error(t, err, "invalid path")
+
+	path := filepath.Join(dir, "test.db")
+	bus := Bus{
+		ID:        "test-sqlite",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	_, err = NewSQLiteRepository(path)
+	assert.IsType(t, SchemaVersionError{}, errors.Cause(err), "the database hasn't been migrated")
+
+	migrator, err := NewSQLiteMigrator(path)
+	require.NoError(t, err, "failed to open database for migrations")
+	require.NoError(t, migrator.MigrateTo(migrator.LatestVersion()), "failed to migrate database")
+	require.NoError(t, migrator.Close(), "failed to close database for migrations")
+
+	testRepo, err := NewSQLiteRepository(path)
+	require.NoError(t, err, "failed to open database")
+	_, err = testRepo.CreateBus(context.Background(), bus)
+	require.NoError(t, err, "failed to create bus")
+	require.NoError(t, testRepo.Close(), "failed to close database")
+
+	// the data must survive after reopening the same file
+	testRepo, err = NewSQLiteRepository(path)
+	require.NoError(t, err, "failed to reopen database")
+	defer testRepo.Close()
+
+	_, err = testRepo.ReadBus(context.Background(), bus.ID)
+	assert.NoError(t, err, "failed to read bus from reopened database")
+}
+
+func TestSQLiteSource(t *testing.T) {
+	testRepo, err := NewSQLiteRepository(":memory:")
+	require.NoError(t, err, "failed to open database")
+	defer testRepo.Close()
+
+	bus := Bus{
+		ID:        "test-sqlite",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	createdBus, err := testRepo.CreateBus(context.Background(), bus)
+	require.NoError(t, err, "failed to create bus")
+
+	t.Run("duplicate", func(subT *testing.T) {
+		_, err := testRepo.CreateBus(context.Background(), bus)
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case DuplicateError:
+			assert.Equal(subT, bus.ID, causeErr.(DuplicateError).ID, "wrong existing row ID")
+		default:
+			assert.Fail(subT, "unexpected error", "%T: %[1]v", causeErr)
+		}
+	})
+
+	t.Run("read", func(subT *testing.T) {
+		readBus, err := testRepo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, bus.Latitude, readBus.Latitude, "bus latitude")
+		assert.Equal(subT, bus.Longitude, readBus.Longitude, "bus longitude")
+		assert.True(subT, createdBus.CreatedAt.Equal(readBus.CreatedAt), "bus creation time")
+
+		_, err = testRepo.ReadBus(context.Background(), "non-existing")
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("update", func(subT *testing.T) {
+		updatedBus := bus
+		updatedBus.Latitude = 7.89
+
+		_, err := testRepo.UpdateBus(context.Background(), updatedBus)
+		require.NoError(subT, err, "failed to update bus")
+
+		buses, err := testRepo.ReadAllBuses(context.Background())
+		require.NoError(subT, err, "failed to read all buses")
+		require.Len(subT, buses, 1)
+		assert.Equal(subT, updatedBus.Latitude, buses[0].Latitude, "bus latitude")
+	})
+
+	t.Run("page", func(subT *testing.T) {
+		buses, more, err := testRepo.ReadBusesPage(context.Background(), Page{Size: 1})
+		require.NoError(subT, err, "failed to read page of buses")
+		assert.False(subT, more, "there should be no more buses")
+		assert.Len(subT, buses, 1)
+
+		buses, _, err = testRepo.ReadBusesPage(context.Background(), Page{Size: 1, Before: bus.ID})
+		require.NoError(subT, err, "failed to read page of buses")
+		assert.Empty(subT, buses)
+
+		buses, _, err = testRepo.ReadBusesPage(context.Background(), Page{Size: 1, After: bus.ID, Sort: []SortKey{{Field: "updated_at", Descending: true}}})
+		require.NoError(subT, err, "failed to read page of buses")
+		assert.Empty(subT, buses)
+
+		count, err := testRepo.CountBuses(context.Background())
+		require.NoError(subT, err, "failed to count buses")
+		assert.Equal(subT, 1, count, "unexpected number of buses")
+	})
+
+	t.Run("nearby", func(subT *testing.T) {
+		buses, err := testRepo.ReadNearbyBuses(context.Background(), 7.88, 4.56, 5000)
+		require.NoError(subT, err, "failed to read nearby buses")
+		assert.Len(subT, buses, 1)
+
+		buses, err = testRepo.ReadNearbyBuses(context.Background(), 7.8, 4.56, 5000)
+		require.NoError(subT, err, "failed to read nearby buses")
+		assert.Empty(subT, buses)
+	})
+
+	t.Run("updated since", func(subT *testing.T) {
+		readBus, err := testRepo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+
+		buses, err := testRepo.ReadBusesUpdatedSince(context.Background(), readBus.UpdatedAt.In(time.FixedZone("BRT", -3*60*60)))
+		require.NoError(subT, err, "failed to read updated buses")
+		assert.Len(subT, buses, 1)
+
+		buses, err = testRepo.ReadBusesUpdatedSince(context.Background(), readBus.UpdatedAt.Add(time.Nanosecond))
+		require.NoError(subT, err, "failed to read updated buses")
+		assert.Empty(subT, buses)
+	})
+
+	t.Run("box", func(subT *testing.T) {
+		buses, err := testRepo.ReadBusesInBox(context.Background(), 7, 4, 8, 5)
+		require.NoError(subT, err, "failed to read buses in box")
+		assert.Len(subT, buses, 1)
+
+		buses, err = testRepo.ReadBusesInBox(context.Background(), 7, 5, 8, 4)
+		require.NoError(subT, err, "failed to read buses in box")
+		assert.Empty(subT, buses)
+	})
+
+	t.Run("locations", func(subT *testing.T) {
+		locations, err := testRepo.ReadLocations(context.Background(), bus.ID, time.Time{}, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		require.Len(subT, locations, 1)
+
+		since := locations[0].RecordedAt.Add(time.Second)
+		locations, err = testRepo.ReadLocations(context.Background(), bus.ID, since, time.Time{})
+		require.NoError(subT, err, "failed to read locations")
+		assert.Empty(subT, locations)
+	})
+
+	t.Run("conditional update", func(subT *testing.T) {
+		existingBus, err := testRepo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+
+		_, err = testRepo.UpdateBusIfMatch(context.Background(), existingBus, existingBus.UpdatedAt.Add(time.Nanosecond))
+		assert.EqualError(subT, errors.Cause(err), ErrConcurrentUpdate.Error())
+
+		updatedBus, err := testRepo.UpdateBusIfMatch(context.Background(), existingBus, existingBus.UpdatedAt)
+		require.NoError(subT, err, "failed to update bus")
+
+		err = testRepo.src.UpdateBus(context.Background(), updatedBus, existingBus.UpdatedAt)
+		assert.EqualError(subT, errors.Cause(err), ErrConcurrentUpdate.Error())
+	})
+
+	t.Run("location batch", func(subT *testing.T) {
+		existingBus, err := testRepo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+
+		locations := []Location{
+			{Latitude: 7.89, Longitude: 1.23, RecordedAt: existingBus.RecordedAt.Add(-time.Minute)},
+			{Latitude: 4.56, Longitude: 7.89, RecordedAt: existingBus.RecordedAt.Add(time.Nanosecond)},
+		}
+		require.NoError(subT, testRepo.CreateLocations(context.Background(), bus.ID, locations), "failed to create locations")
+
+		updatedBus, err := testRepo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, locations[1].Latitude, updatedBus.Latitude, "the newest location should be the bus position")
+
+		err = testRepo.CreateLocations(context.Background(), "not-found", locations)
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+
+	t.Run("expired context", func(subT *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		_, err := testRepo.ReadAllBuses(ctx)
+		assert.Equal(subT, context.DeadlineExceeded, errors.Cause(err))
+
+		_, err = testRepo.UpdateBus(ctx, bus)
+		assert.Equal(subT, context.DeadlineExceeded, errors.Cause(err))
+	})
+
+	t.Run("delete", func(subT *testing.T) {
+		require.NoError(subT, testRepo.DeleteBus(context.Background(), bus.ID), "failed to delete bus")
+
+		err := testRepo.DeleteBus(context.Background(), bus.ID)
+		assert.EqualError(subT, errors.Cause(err), ErrNoSuchRow.Error())
+	})
+}
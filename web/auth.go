@@ -0,0 +1,264 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cd1/motofretado-server/data"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/urfave/negroni"
+)
+
+// apiKeyHeader is the HTTP header which contains the API key of a request.
+const apiKeyHeader = "X-API-Key"
+
+// busTokenHeader is the HTTP header which contains the token of the bus
+// changed by a request.
+const busTokenHeader = "X-Bus-Token"
+
+// apiKeyContextKey is the request context key of the validated API key ID.
+type apiKeyContextKey struct{}
+
+// apiKeyIDFromContext returns the ID of the API key which authenticated the
+// request.
+func apiKeyIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(apiKeyContextKey{}).(string)
+	return id, ok
+}
+
+// authDisabledContextKey is the request context key which marks the requests
+// handled without authentication (see Options.DisableAuth).
+type authDisabledContextKey struct{}
+
+// isAuthDisabled returns whether the request is handled without
+// authentication.
+func isAuthDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(authDisabledContextKey{}).(bool)
+	return disabled
+}
+
+// disableAuth builds a middleware which marks every request to be handled
+// without authentication, so the handlers don't ask for bus tokens either.
+func disableAuth() negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		next(w, req.WithContext(context.WithValue(req.Context(), authDisabledContextKey{}, true)))
+	}
+}
+
+// claimsContextKey is the request context key of the JWT claims.
+type claimsContextKey struct{}
+
+// claimsFromContext returns the JWT claims of an authenticated request.
+func claimsFromContext(ctx context.Context) (jwtClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(jwtClaims)
+	return claims, ok
+}
+
+// isWriteRequest returns whether the request changes the buses. Besides the
+// write methods, that includes the WebSocket upgrades, as the drivers send
+// their positions over them.
+func isWriteRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return websocket.IsWebSocketUpgrade(req)
+	}
+}
+
+// requireAPIKey builds a middleware which only lets the requests that change
+// the buses through if they have a valid API key. The other requests don't
+// need one. Each failed authentication takes a token from the bucket of the
+// client IP address in failureLimiter, and the clients without tokens left
+// aren't authenticated at all, so guessing keys can't overload the database.
+func requireAPIKey(repo *data.Repository, failureLimiter *rateLimiter, trustForwardedFor bool) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if !isWriteRequest(req) {
+			next(w, req)
+			return
+		}
+
+		client := rateLimitIP(req, trustForwardedFor)
+		if retryAfter := failureLimiter.wait(client, time.Now()); retryAfter > 0 {
+			tooManyRequests(w, client, retryAfter)
+			return
+		}
+
+		wholeKey := req.Header.Get(apiKeyHeader)
+		if len(wholeKey) == 0 {
+			failureLimiter.allow(client, time.Now())
+			w.Header().Set("WWW-Authenticate", "APIKey")
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusUnauthorized), // 401 Unauthorized
+				Title:  "Missing API key",
+				Detail: fmt.Sprintf("Request MUST contain an API key in the header \"%v\"", apiKeyHeader),
+			})
+			return
+		}
+
+		key, err := repo.AuthenticateAPIKey(req.Context(), wholeKey)
+		if err != nil {
+			if errors.Cause(err) == data.ErrInvalidAPIKey {
+				failureLimiter.allow(client, time.Now())
+				errorResponse(w, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusForbidden), // 403 Forbidden
+					Title:  "Invalid API key",
+					Detail: "The API key doesn't exist or has been revoked",
+				})
+			} else {
+				errorResponse(w, unexpectedError(err))
+			}
+
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"id":   key.ID,
+			"name": key.Name,
+		}).Debug("request authenticated with API key")
+		next(w, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key.ID)))
+	}
+}
+
+// verifyBusToken checks whether the request has the token issued for the bus
+// identified by id, so a leaked token can only be used to change that bus. The
+// token isn't needed if the request JWT allows changing the bus, or if the
+// authentication is disabled. If the request can't change the bus, an error
+// response is written and false is returned.
+func verifyBusToken(w http.ResponseWriter, req *http.Request, repo *data.Repository, id string) bool {
+	var err error
+
+	if isAuthDisabled(req.Context()) {
+		_, err = repo.ReadBus(req.Context(), id)
+	} else if claims, ok := claimsFromContext(req.Context()); ok && claims.canChangeBus(id) {
+		// the JWT already restricts which buses can be changed
+		_, err = repo.ReadBus(req.Context(), id)
+	} else {
+		token := req.Header.Get(busTokenHeader)
+		if len(token) == 0 {
+			w.Header().Set("WWW-Authenticate", "BusToken")
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusUnauthorized), // 401 Unauthorized
+				Title:  "Missing bus token",
+				Detail: fmt.Sprintf("Request MUST contain the bus token in the header \"%v\"", busTokenHeader),
+			})
+			return false
+		}
+
+		err = repo.VerifyBusToken(req.Context(), id, token)
+	}
+
+	if err != nil {
+		switch errors.Cause(err) {
+		case data.ErrNoSuchRow:
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusNotFound), // 404 Not Found
+				Title:  "Bus ID not found",
+				Detail: fmt.Sprintf("Bus \"%v\" doesn't exist", id),
+			})
+		case data.ErrInvalidBusToken:
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusForbidden), // 403 Forbidden
+				Title:  "Invalid bus token",
+				Detail: fmt.Sprintf("The token wasn't issued for bus \"%v\"", id),
+			})
+		default:
+			errorResponse(w, unexpectedError(err))
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// requireRole builds a handler which only calls handle if the request has a
+// valid JWT whose role includes minRole. If minRole is roleDriver, the JWT must
+// also allow changing the bus identified by the route.
+func requireRole(verifier *JWTVerifier, minRole role, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		claims, verified := claimsFromContext(req.Context())
+		if !verified {
+			token, ok := bearerToken(req)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				errorResponse(w, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusUnauthorized), // 401 Unauthorized
+					Title:  "Missing bearer token",
+					Detail: "Request MUST contain a JWT in the header \"Authorization\"",
+				})
+				return
+			}
+
+			var err error
+			if claims, err = verifier.verify(token, time.Now()); err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				errorResponse(w, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusUnauthorized), // 401 Unauthorized
+					Title:  "Invalid bearer token",
+					Detail: err.Error(),
+				})
+				return
+			}
+		}
+
+		if !claims.Role.includes(minRole) {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusForbidden), // 403 Forbidden
+				Title:  "Insufficient role",
+				Detail: fmt.Sprintf("Role \"%v\" cannot perform this request", claims.Role),
+			})
+			return
+		}
+
+		if minRole == roleDriver && !claims.canChangeBus(params.ByName("id")) {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusForbidden), // 403 Forbidden
+				Title:  "Bus not allowed",
+				Detail: fmt.Sprintf("The token doesn't allow changing bus \"%v\"", params.ByName("id")),
+			})
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"subject": claims.Subject,
+			"role":    claims.Role,
+		}).Debug("request authenticated with JWT")
+		handle(w, req.WithContext(context.WithValue(req.Context(), claimsContextKey{}, claims)), params)
+	}
+}
+
+// identifyJWT builds a middleware which verifies the JWT of the requests that
+// have a valid one, so they're rate limited by its subject. The other requests
+// aren't rejected here, but by requireRole in each route.
+func identifyJWT(verifier *JWTVerifier) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if token, ok := bearerToken(req); ok {
+			if claims, err := verifier.verify(token, time.Now()); err == nil {
+				req = req.WithContext(context.WithValue(req.Context(), claimsContextKey{}, claims))
+			}
+		}
+
+		next(w, req)
+	}
+}
+
+// bearerToken returns the token from the header "Authorization" of a request,
+// if it uses the bearer scheme.
+func bearerToken(req *http.Request) (string, bool) {
+	authorization := req.Header.Get("Authorization")
+	const bearerPrefix = "bearer "
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+
+	return authorization[len(bearerPrefix):], true
+}
@@ -0,0 +1,225 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	key, wholeKey, err := repo.CreateAPIKey(context.Background(), "test-require")
+	require.NoError(t, err, "failed to create API key")
+
+	revokedKey, revokedWholeKey, err := repo.CreateAPIKey(context.Background(), "test-require-revoked")
+	require.NoError(t, err, "failed to create API key")
+	require.NoError(t, repo.RevokeAPIKey(context.Background(), revokedKey.ID), "failed to revoke API key")
+
+	var nextCalled bool
+	next := func(w http.ResponseWriter, req *http.Request) {
+		nextCalled = true
+	}
+	middleware := requireAPIKey(repo, nil, false)
+
+	subTestFunc := func(method, apiKey string, expectedStatus int) func(*testing.T) {
+		return func(subT *testing.T) {
+			nextCalled = false
+
+			req := httptest.NewRequest(method, "/bus/test", nil)
+			if len(apiKey) > 0 {
+				req.Header.Set(apiKeyHeader, apiKey)
+			}
+			w := httptest.NewRecorder()
+
+			middleware(w, req, next)
+
+			if expectedStatus == http.StatusOK {
+				assert.True(subT, nextCalled, "the request should be handled")
+				return
+			}
+
+			assert.False(subT, nextCalled, "the request shouldn't be handled")
+			require.Equal(subT, expectedStatus, w.Code, "invalid HTTP status")
+			assert.Equal(subT, jsonapi.ContentType, w.Header().Get("Content-Type"), "unexpected content type")
+
+			var doc jsonapi.ErrorsDocument
+
+			err := json.NewDecoder(w.Body).Decode(&doc)
+			require.NoError(subT, err, "failed to decode data from JSON")
+			assert.Len(subT, doc.Errors, 1)
+		}
+	}
+
+	t.Run("read without key", subTestFunc(http.MethodGet, "", http.StatusOK))
+	t.Run("create without key", subTestFunc(http.MethodPost, "", http.StatusUnauthorized))
+	t.Run("update without key", subTestFunc(http.MethodPatch, "", http.StatusUnauthorized))
+	t.Run("delete without key", subTestFunc(http.MethodDelete, "", http.StatusUnauthorized))
+	t.Run("malformed key", subTestFunc(http.MethodPatch, "foo", http.StatusForbidden))
+	t.Run("wrong secret", subTestFunc(http.MethodPatch, key.ID+".foo", http.StatusForbidden))
+	t.Run("revoked key", subTestFunc(http.MethodPatch, revokedWholeKey, http.StatusForbidden))
+	t.Run("valid key", subTestFunc(http.MethodPatch, wholeKey, http.StatusOK))
+
+	socketTestFunc := func(apiKey string, expectedStatus int) func(*testing.T) {
+		return func(subT *testing.T) {
+			nextCalled = false
+
+			req := httptest.NewRequest(http.MethodGet, "/bus/test/socket", nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			if len(apiKey) > 0 {
+				req.Header.Set(apiKeyHeader, apiKey)
+			}
+			w := httptest.NewRecorder()
+
+			middleware(w, req, next)
+
+			assert.Equal(subT, expectedStatus == http.StatusOK, nextCalled, "unexpected handling of the WebSocket upgrade")
+			if expectedStatus != http.StatusOK {
+				assert.Equal(subT, expectedStatus, w.Code, "invalid HTTP status")
+			}
+		}
+	}
+
+	t.Run("socket without key", socketTestFunc("", http.StatusUnauthorized))
+	t.Run("socket with valid key", socketTestFunc(wholeKey, http.StatusOK))
+
+	t.Run("failures limited", func(subT *testing.T) {
+		limitedMiddleware := requireAPIKey(repo, newRateLimiter(RateLimit{Rate: 0.1, Burst: 2}), false)
+		serve := func(apiKey string) int {
+			nextCalled = false
+
+			req := httptest.NewRequest(http.MethodPatch, "/bus/test", nil)
+			req.Header.Set(apiKeyHeader, apiKey)
+			w := httptest.NewRecorder()
+
+			limitedMiddleware(w, req, next)
+			if nextCalled {
+				return http.StatusOK
+			}
+
+			return w.Code
+		}
+
+		assert.Equal(subT, http.StatusOK, serve(wholeKey), "a valid key shouldn't count as a failure")
+		assert.Equal(subT, http.StatusForbidden, serve(key.ID+".foo"), "unexpected HTTP status")
+		assert.Equal(subT, http.StatusForbidden, serve(key.ID+".bar"), "unexpected HTTP status")
+		assert.Equal(subT, http.StatusTooManyRequests, serve(key.ID+".baz"), "the failures should be limited")
+		assert.Equal(subT, http.StatusTooManyRequests, serve(wholeKey), "the address shouldn't be authenticated after too many failures")
+	})
+}
+
+func TestIdentifyJWT(t *testing.T) {
+	secret := newTestSecret(t)
+	verifier, err := NewJWTVerifier(secret)
+	require.NoError(t, err, "failed to build verifier")
+
+	middleware := identifyJWT(verifier)
+
+	identify := func(authorization string) (jwtClaims, bool) {
+		var claims jwtClaims
+		var ok bool
+
+		req := httptest.NewRequest(http.MethodGet, "/bus", nil)
+		if len(authorization) > 0 {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+
+		middleware(w, req, func(w http.ResponseWriter, req *http.Request) {
+			claims, ok = claimsFromContext(req.Context())
+		})
+
+		return claims, ok
+	}
+
+	token := signJWT(t, jwtAlgorithmHS256, secret, map[string]interface{}{
+		"sub":  "test",
+		"role": roleRider,
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	})
+
+	claims, ok := identify("Bearer " + token)
+	if assert.True(t, ok, "the valid token should be verified") {
+		assert.Equal(t, "test", claims.Subject, "unexpected subject")
+	}
+
+	_, ok = identify("Bearer foo")
+	assert.False(t, ok, "the invalid token shouldn't be verified")
+
+	_, ok = identify("")
+	assert.False(t, ok, "the request without token should be let through")
+}
+
+func TestRequireRole(t *testing.T) {
+	secret := newTestSecret(t)
+	verifier, err := NewJWTVerifier(secret)
+	require.NoError(t, err, "failed to build verifier")
+
+	token := func(r role, exp time.Time) string {
+		return signJWT(t, jwtAlgorithmHS256, secret, map[string]interface{}{
+			"sub":   "test",
+			"role":  r,
+			"buses": []string{"test-bus"},
+			"exp":   exp.Unix(),
+		})
+	}
+	validUntil := time.Now().Add(time.Hour)
+
+	var handledClaims *jwtClaims
+	handle := func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		claims, _ := claimsFromContext(req.Context())
+		handledClaims = &claims
+	}
+
+	subTestFunc := func(minRole role, busID, authorization string, expectedStatus int) func(*testing.T) {
+		return func(subT *testing.T) {
+			handledClaims = nil
+
+			req := httptest.NewRequest(http.MethodGet, "/bus/"+busID, nil)
+			if len(authorization) > 0 {
+				req.Header.Set("Authorization", authorization)
+			}
+			w := httptest.NewRecorder()
+			params := httprouter.Params{
+				{
+					Key:   "id",
+					Value: busID,
+				},
+			}
+
+			requireRole(verifier, minRole, handle)(w, req, params)
+
+			if expectedStatus == http.StatusOK {
+				if assert.NotNil(subT, handledClaims, "the request should be handled") {
+					assert.Equal(subT, "test", handledClaims.Subject, "the claims should be in the request context")
+				}
+				return
+			}
+
+			assert.Nil(subT, handledClaims, "the request shouldn't be handled")
+			require.Equal(subT, expectedStatus, w.Code, "invalid HTTP status")
+			assert.Equal(subT, jsonapi.ContentType, w.Header().Get("Content-Type"), "unexpected content type")
+		}
+	}
+
+	t.Run("missing token", subTestFunc(roleRider, "test-bus", "", http.StatusUnauthorized))
+	t.Run("other scheme", subTestFunc(roleRider, "test-bus", "Basic Zm9vOmJhcg==", http.StatusUnauthorized))
+	t.Run("invalid token", subTestFunc(roleRider, "test-bus", "Bearer foo", http.StatusUnauthorized))
+	t.Run("expired token", subTestFunc(roleRider, "test-bus",
+		"Bearer "+token(roleAdmin, time.Now().Add(-time.Hour)), http.StatusUnauthorized))
+	t.Run("unknown role", subTestFunc(roleRider, "test-bus", "Bearer "+token("foo", validUntil), http.StatusForbidden))
+	t.Run("rider reads", subTestFunc(roleRider, "test-bus", "bearer "+token(roleRider, validUntil), http.StatusOK))
+	t.Run("rider changes", subTestFunc(roleDriver, "test-bus", "Bearer "+token(roleRider, validUntil), http.StatusForbidden))
+	t.Run("driver changes own bus", subTestFunc(roleDriver, "test-bus", "Bearer "+token(roleDriver, validUntil), http.StatusOK))
+	t.Run("driver changes other bus", subTestFunc(roleDriver, "other-bus", "Bearer "+token(roleDriver, validUntil), http.StatusForbidden))
+	t.Run("driver deletes", subTestFunc(roleAdmin, "test-bus", "Bearer "+token(roleDriver, validUntil), http.StatusForbidden))
+	t.Run("admin changes any bus", subTestFunc(roleDriver, "other-bus", "Bearer "+token(roleAdmin, validUntil), http.StatusOK))
+	t.Run("admin deletes", subTestFunc(roleAdmin, "test-bus", "Bearer "+token(roleAdmin, validUntil), http.StatusOK))
+}
@@ -1,10 +1,14 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cd1/motofretado-server/data"
@@ -13,6 +17,17 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// defaultNearbyRadius is the radius, in meters, used to look for nearby
+	// buses when "filter[radius]" isn't specified.
+	defaultNearbyRadius = 1000.0
+
+	// defaultPageSize is the number of buses returned when "page[size]" isn't
+	// specified, and maxPageSize is the largest value it may have.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
 // BusesHandler handles the HTTP requests on the bus collection. It is
 // responsible for listing all the buses and creating new ones.
 type BusesHandler struct {
@@ -26,23 +41,72 @@ func (h BusesHandler) get(w http.ResponseWriter, req *http.Request, params httpr
 		return
 	}
 
-	buses, err := h.repo.ReadAllBuses()
+	query := req.URL.Query()
+
+	fields, err := parseBusFields(query)
 	if err != nil {
 		errorResponse(w, jsonapi.ErrorData{
-			Status: strconv.Itoa(http.StatusInternalServerError), // 500 Internal Server Error
-			Title:  "Unexpected error",
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid sparse fieldset",
 			Detail: err.Error(),
+			Source: &jsonapi.ErrorSource{
+				Parameter: "fields[bus]",
+			},
 		})
 
 		return
 	}
 
-	busesDoc := jsonapi.ToBusesDocument(buses)
+	// the server time is taken before reading the buses, so the client doesn't
+	// miss any update when using it as "filter[updated_since]" later
+	serverTime := time.Now()
+
+	var busesDoc jsonapi.BusesDocument
+	var errData *jsonapi.ErrorData
+
+	if _, exists := query["filter[updated_since]"]; exists {
+		busesDoc, errData = h.readBusesUpdatedSince(req.Context(), query)
+	} else if isLocationFiltered(query) {
+		busesDoc, errData = h.readBusesByLocation(req.Context(), query)
+	} else {
+		busesDoc, errData = h.readBusesPage(req, query)
+	}
+	if errData != nil {
+		errorResponse(w, *errData)
+
+		return
+	}
+
+	if busesDoc.Meta == nil {
+		busesDoc.Meta = &jsonapi.BusesMeta{}
+	}
+	busesDoc.Meta.ServerTime = &serverTime
+
+	var lastModified time.Time
+
 	scheme := requestScheme(req)
 	for i, b := range busesDoc.Data {
 		busesDoc.Data[i].Links = &jsonapi.Links{
 			Self: fmt.Sprintf("%v://%v/bus/%v", scheme, req.Host, b.ID),
 		}
+
+		if fields != nil {
+			busesDoc.Data[i].Attributes.SelectFields(fields)
+		}
+
+		if b.Attributes.UpdatedAt.After(lastModified) {
+			lastModified = b.Attributes.UpdatedAt
+		}
+	}
+
+	// the deletion times aren't known, so the buses can't be validated by
+	// their modification time
+	if len(busesDoc.Meta.Deleted) > 0 {
+		lastModified = time.Time{}
+	}
+
+	if checkNotModified(w, req, sparseETag(busesETag(busesDoc), fields), lastModified) { // 304 Not Modified
+		return
 	}
 
 	w.Header().Set("Content-Type", jsonapi.ContentType)
@@ -51,6 +115,359 @@ func (h BusesHandler) get(w http.ResponseWriter, req *http.Request, params httpr
 	}
 }
 
+func isLocationFiltered(query url.Values) bool {
+	for _, param := range []string{"filter[near]", "filter[radius]", "filter[bbox]"} {
+		if _, exists := query[param]; exists {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readBusesByLocation reads the buses filtered by "filter[near]" (and
+// "filter[radius]") or "filter[bbox]". Those results aren't paginated nor
+// sorted by the user.
+func (h BusesHandler) readBusesByLocation(ctx context.Context, query url.Values) (jsonapi.BusesDocument, *jsonapi.ErrorData) {
+	if errData := checkUnpaginated(query, "Location filters"); errData != nil {
+		return jsonapi.BusesDocument{}, errData
+	}
+
+	near := query.Get("filter[near]")
+	radiusValue := query.Get("filter[radius]")
+	box := query.Get("filter[bbox]")
+
+	if len(near) == 0 && len(radiusValue) > 0 {
+		return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid location filter",
+			Detail: "\"filter[radius]\" requires \"filter[near]\"",
+			Source: &jsonapi.ErrorSource{
+				Parameter: "filter[radius]",
+			},
+		}
+	}
+
+	if len(near) > 0 && len(box) > 0 {
+		return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid location filter",
+			Detail: "\"filter[bbox]\" cannot be used together with \"filter[near]\"",
+			Source: &jsonapi.ErrorSource{
+				Parameter: "filter[bbox]",
+			},
+		}
+	}
+
+	var buses []data.Bus
+	var lat, lng float64
+	var err error
+
+	if len(near) > 0 {
+		lat, lng, err = parsePoint(near)
+		if err != nil {
+			return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid location filter",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Parameter: "filter[near]",
+				},
+			}
+		}
+
+		radius := defaultNearbyRadius
+		if len(radiusValue) > 0 {
+			radius, err = strconv.ParseFloat(radiusValue, 64)
+			if err != nil {
+				return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+					Title:  "Invalid location filter",
+					Detail: fmt.Sprintf("\"%v\" is not a valid radius in meters", radiusValue),
+					Source: &jsonapi.ErrorSource{
+						Parameter: "filter[radius]",
+					},
+				}
+			}
+		}
+
+		buses, err = h.repo.ReadNearbyBuses(ctx, lat, lng, radius)
+	} else {
+		var minLat, minLng, maxLat, maxLng float64
+
+		minLat, minLng, maxLat, maxLng, err = parseBox(box)
+		if err != nil {
+			return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid location filter",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Parameter: "filter[bbox]",
+				},
+			}
+		}
+
+		buses, err = h.repo.ReadBusesInBox(ctx, minLat, minLng, maxLat, maxLng)
+	}
+	if err != nil {
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case data.InvalidParameterError:
+			param := "filter[near]"
+			if len(box) > 0 {
+				param = "filter[bbox]"
+			} else if causeErr.(data.InvalidParameterError).Name == "radius" {
+				param = "filter[radius]"
+			}
+
+			return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid location filter",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Parameter: param,
+				},
+			}
+		default:
+			errData := unexpectedError(err)
+			return jsonapi.BusesDocument{}, &errData
+		}
+	}
+
+	busesDoc := jsonapi.ToBusesDocument(buses)
+	if len(near) > 0 {
+		for i, b := range buses {
+			distance := data.Distance(lat, lng, b.Latitude, b.Longitude)
+			busesDoc.Data[i].Meta = &jsonapi.BusMeta{
+				Distance: &distance,
+			}
+		}
+	}
+
+	return busesDoc, nil
+}
+
+// readBusesUpdatedSince reads the buses filtered by "filter[updated_since]",
+// ordered by their update time, along with the IDs of the buses deleted since
+// then in "meta.deleted". Those results aren't paginated nor sorted by the
+// user.
+func (h BusesHandler) readBusesUpdatedSince(ctx context.Context, query url.Values) (jsonapi.BusesDocument, *jsonapi.ErrorData) {
+	if errData := checkUnpaginated(query, "Time filters"); errData != nil {
+		return jsonapi.BusesDocument{}, errData
+	}
+
+	if isLocationFiltered(query) {
+		return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid time filter",
+			Detail: "\"filter[updated_since]\" cannot be used together with location filters",
+			Source: &jsonapi.ErrorSource{
+				Parameter: "filter[updated_since]",
+			},
+		}
+	}
+
+	value := query.Get("filter[updated_since]")
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid time filter",
+			Detail: fmt.Sprintf("\"%v\" is not a valid RFC 3339 time", value),
+			Source: &jsonapi.ErrorSource{
+				Parameter: "filter[updated_since]",
+			},
+		}
+	}
+
+	buses, err := h.repo.ReadBusesUpdatedSince(ctx, since)
+	if err != nil {
+		errData := unexpectedError(err)
+		return jsonapi.BusesDocument{}, &errData
+	}
+
+	deletedIDs, err := h.repo.ReadBusDeletionsSince(ctx, since)
+	if err != nil {
+		errData := unexpectedError(err)
+		return jsonapi.BusesDocument{}, &errData
+	}
+
+	busesDoc := jsonapi.ToBusesDocument(buses)
+	busesDoc.Meta = &jsonapi.BusesMeta{
+		Deleted: deletedIDs,
+	}
+
+	return busesDoc, nil
+}
+
+// checkUnpaginated returns an error if the query has any page or sort
+// parameter, which aren't supported by the filter described by name.
+func checkUnpaginated(query url.Values, name string) *jsonapi.ErrorData {
+	for _, param := range []string{"page[size]", "page[after]", "page[before]"} {
+		if _, exists := query[param]; exists {
+			return &jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid page parameter",
+				Detail: fmt.Sprintf("%v cannot be paginated", name),
+				Source: &jsonapi.ErrorSource{
+					Parameter: param,
+				},
+			}
+		}
+	}
+
+	if _, exists := query["sort"]; exists {
+		return &jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid sort parameter",
+			Detail: fmt.Sprintf("%v cannot be sorted", name),
+			Source: &jsonapi.ErrorSource{
+				Parameter: "sort",
+			},
+		}
+	}
+
+	return nil
+}
+
+// readBusesPage reads a page of buses selected by "page[size]" and
+// "page[after]" or "page[before]", and sorted by "sort", adding the pagination
+// links and the total number of buses to the document.
+func (h BusesHandler) readBusesPage(req *http.Request, query url.Values) (jsonapi.BusesDocument, *jsonapi.ErrorData) {
+	page := data.Page{
+		Size:   defaultPageSize,
+		After:  query.Get("page[after]"),
+		Before: query.Get("page[before]"),
+	}
+
+	if sizeValue := query.Get("page[size]"); len(sizeValue) > 0 {
+		size, err := strconv.Atoi(sizeValue)
+		if err != nil || size <= 0 || size > maxPageSize {
+			return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid page parameter",
+				Detail: fmt.Sprintf("Page size must be an integer between 1 and %v", maxPageSize),
+				Source: &jsonapi.ErrorSource{
+					Parameter: "page[size]",
+				},
+			}
+		}
+
+		page.Size = size
+	}
+
+	if sortValue, exists := query["sort"]; exists {
+		keys, err := parseSort(strings.Join(sortValue, ","))
+		if err != nil {
+			return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid sort parameter",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Parameter: "sort",
+				},
+			}
+		}
+
+		page.Sort = keys
+	}
+
+	buses, more, err := h.repo.ReadBusesPage(req.Context(), page)
+	if err != nil {
+		switch causeErr := errors.Cause(err); causeErr.(type) {
+		case data.InvalidParameterError:
+			if name := causeErr.(data.InvalidParameterError).Name; name == "sort" {
+				return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+					Title:  "Invalid sort parameter",
+					Detail: err.Error(),
+					Source: &jsonapi.ErrorSource{
+						Parameter: "sort",
+					},
+				}
+			}
+
+			return jsonapi.BusesDocument{}, &jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid page parameter",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Parameter: fmt.Sprintf("page[%v]", causeErr.(data.InvalidParameterError).Name),
+				},
+			}
+		default:
+			errData := unexpectedError(err)
+			return jsonapi.BusesDocument{}, &errData
+		}
+	}
+
+	total, err := h.repo.CountBuses(req.Context())
+	if err != nil {
+		errData := unexpectedError(err)
+		return jsonapi.BusesDocument{}, &errData
+	}
+
+	busesDoc := jsonapi.ToBusesDocument(buses)
+	busesDoc.Links = &jsonapi.Links{
+		Self:  fmt.Sprintf("%v://%v%v", requestScheme(req), req.Host, req.URL.RequestURI()),
+		First: pageURL(req, page.Size, "", ""),
+	}
+	busesDoc.Meta = &jsonapi.BusesMeta{
+		Total: &total,
+	}
+
+	if len(buses) > 0 {
+		firstID := buses[0].ID
+		lastID := buses[len(buses)-1].ID
+
+		// reading backwards, "more" means there's a previous page; otherwise,
+		// there's a previous page whenever the page doesn't start at the
+		// first bus
+		if len(page.Before) > 0 {
+			if more {
+				busesDoc.Links.Prev = pageURL(req, page.Size, "", firstID)
+			}
+			busesDoc.Links.Next = pageURL(req, page.Size, lastID, "")
+		} else {
+			if len(page.After) > 0 {
+				busesDoc.Links.Prev = pageURL(req, page.Size, "", firstID)
+			}
+			if more {
+				busesDoc.Links.Next = pageURL(req, page.Size, lastID, "")
+			}
+		}
+	}
+
+	return busesDoc, nil
+}
+
+// pageURL builds the URL of another page of the same request, keeping all the
+// query parameters except the page ones.
+func pageURL(req *http.Request, size int, after, before string) string {
+	query := req.URL.Query()
+	query.Del("page[after]")
+	query.Del("page[before]")
+	query.Set("page[size]", strconv.Itoa(size))
+
+	if len(after) > 0 {
+		query.Set("page[after]", after)
+	}
+	if len(before) > 0 {
+		query.Set("page[before]", before)
+	}
+
+	return fmt.Sprintf("%v://%v%v?%v", requestScheme(req), req.Host, req.URL.Path, query.Encode())
+}
+
+// busFieldPointer returns the JSON pointer of the bus field called name in a
+// JSONAPI document.
+func busFieldPointer(name string) string {
+	if name == "id" {
+		return "/data/id"
+	}
+
+	return "/data/attributes/" + name
+}
+
 func (h BusesHandler) post(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	if req.Header.Get("Accept") != jsonapi.ContentType {
 		notAcceptable(w) // 406 Not Acceptable
@@ -111,7 +528,7 @@ func (h BusesHandler) post(w http.ResponseWriter, req *http.Request, params http
 		return
 	}
 
-	createdBus, err := h.repo.CreateBus(bus)
+	createdBus, err := h.repo.CreateBus(req.Context(), bus)
 	if err != nil {
 		switch causeErr := errors.Cause(err); causeErr.(type) {
 		case data.DuplicateError:
@@ -129,7 +546,7 @@ func (h BusesHandler) post(w http.ResponseWriter, req *http.Request, params http
 				Title:  "Invalid bus field",
 				Detail: err.Error(),
 				Source: &jsonapi.ErrorSource{
-					Pointer: "/data/attributes/" + causeErr.(data.InvalidParameterError).Name,
+					Pointer: busFieldPointer(causeErr.(data.InvalidParameterError).Name),
 				},
 			})
 		case data.MissingParameterError:
@@ -138,15 +555,11 @@ func (h BusesHandler) post(w http.ResponseWriter, req *http.Request, params http
 				Title:  "Missing bus field",
 				Detail: err.Error(),
 				Source: &jsonapi.ErrorSource{
-					Pointer: "/data/attributes/" + causeErr.(data.MissingParameterError).Name,
+					Pointer: busFieldPointer(causeErr.(data.MissingParameterError).Name),
 				},
 			})
 		default:
-			errorResponse(w, jsonapi.ErrorData{
-				Status: strconv.Itoa(http.StatusInternalServerError), // 500 Internal Server Error
-				Title:  "Unexpected error",
-				Detail: err.Error(),
-			})
+			errorResponse(w, unexpectedError(err))
 		}
 
 		return
@@ -160,6 +573,7 @@ func (h BusesHandler) post(w http.ResponseWriter, req *http.Request, params http
 
 	w.Header().Set("Content-Type", jsonapi.ContentType)
 	w.Header().Set("Location", selfURL)
+	w.Header().Set("ETag", busETag(createdBus))
 	w.WriteHeader(http.StatusCreated) // 201 Created
 	if err := json.NewEncoder(w).Encode(createdBusDoc); err != nil {
 		logrus.WithError(err).Error("could not encode bus to JSON")
@@ -2,10 +2,13 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -53,6 +56,389 @@ func TestBusesHandler_get(t *testing.T) {
 	t.Run("success", subTestFunc(h, http.StatusOK))
 }
 
+func TestBusesHandler_get_conditional(t *testing.T) {
+	get := func(method, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/bus", nil)
+		req.Header.Set("Accept", jsonapi.ContentType)
+		if len(ifNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		w := httptest.NewRecorder()
+		var params httprouter.Params
+
+		busesHandler.get(w, req, params)
+
+		return w
+	}
+
+	w := get(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, w.Code, "invalid HTTP status")
+	etag := w.HeaderMap.Get("ETag")
+	require.NotEmpty(t, etag, "\"ETag\" header should be set")
+	assert.NotEmpty(t, w.HeaderMap.Get("Last-Modified"), "\"Last-Modified\" header should be set")
+
+	t.Run("not modified", func(subT *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			w := get(method, etag)
+			assert.Equal(subT, http.StatusNotModified, w.Code, "invalid HTTP status on %v", method)
+		}
+	})
+
+	t.Run("created", func(subT *testing.T) {
+		bus := data.Bus{
+			ID:        "test-get-conditional",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			subT.Skipf("failed to create bus: %v", err)
+		}
+
+		w := get(http.MethodGet, etag)
+		assert.Equal(subT, http.StatusOK, w.Code, "invalid HTTP status after creation")
+
+		if err := repo.DeleteBus(context.Background(), bus.ID); err != nil {
+			subT.Skipf("failed to delete bus: %v", err)
+		}
+
+		// the collection is the same as before now
+		w = get(http.MethodGet, etag)
+		assert.Equal(subT, http.StatusNotModified, w.Code, "invalid HTTP status after deletion")
+	})
+}
+
+func TestBusesHandler_get_page(t *testing.T) {
+	getPage := func(t *testing.T, target string) jsonapi.BusesDocument {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", jsonapi.ContentType)
+
+		w := httptest.NewRecorder()
+		var params httprouter.Params
+
+		busesHandler.get(w, req, params)
+		require.Equal(t, http.StatusOK, w.Code, "invalid HTTP status")
+
+		var doc jsonapi.BusesDocument
+
+		err := json.NewDecoder(w.Body).Decode(&doc)
+		require.NoError(t, err, "failed to decode data from JSON")
+		require.NotNil(t, doc.Links, "document links should be set")
+		require.NotNil(t, doc.Meta, "document meta should be set")
+		require.NotNil(t, doc.Meta.Total, "total number of buses should be set")
+		assert.Equal(t, busesCount, *doc.Meta.Total, "unexpected total number of buses")
+
+		return doc
+	}
+
+	for _, query := range []string{
+		"page[size]=foo",
+		"page[size]=0",
+		"page[size]=1001",
+		"page[after]=a&page[before]=b",
+		"page[size]=1&filter[near]=1.23,4.56",
+	} {
+		t.Run(fmt.Sprintf("invalid %q", query), func(subT *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/bus?"+query, nil)
+			req.Header.Set("Accept", jsonapi.ContentType)
+
+			w := httptest.NewRecorder()
+			var params httprouter.Params
+
+			busesHandler.get(w, req, params)
+			assert.Equal(subT, http.StatusBadRequest, w.Code, "invalid HTTP status")
+		})
+	}
+
+	t.Run("links", func(subT *testing.T) {
+		doc := getPage(subT, "/bus?page[size]=2")
+		require.Len(subT, doc.Data, 2)
+		assert.Equal(subT, "initial-bus-0", doc.Data[0].ID, "unexpected first bus")
+		assert.NotEmpty(subT, doc.Links.First, "first link should be set")
+		assert.Empty(subT, doc.Links.Prev, "there should be no previous page")
+		require.NotEmpty(subT, doc.Links.Next, "next link should be set")
+
+		doc = getPage(subT, doc.Links.Next)
+		require.Len(subT, doc.Data, 1)
+		assert.Equal(subT, "initial-bus-2", doc.Data[0].ID, "unexpected bus on next page")
+		assert.Empty(subT, doc.Links.Next, "there should be no next page")
+		require.NotEmpty(subT, doc.Links.Prev, "previous link should be set")
+
+		doc = getPage(subT, doc.Links.Prev)
+		require.Len(subT, doc.Data, 2)
+		assert.Equal(subT, "initial-bus-0", doc.Data[0].ID, "unexpected first bus on previous page")
+		assert.Empty(subT, doc.Links.Prev, "there should be no previous page")
+		assert.NotEmpty(subT, doc.Links.Next, "next link should be set")
+	})
+}
+
+func TestBusesHandler_get_sort(t *testing.T) {
+	subTestFunc := func(query string, expectedStatus int, expectedParameter string, expectedIDs ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/bus?"+query, nil)
+			req.Header.Set("Accept", jsonapi.ContentType)
+
+			w := httptest.NewRecorder()
+			var params httprouter.Params
+
+			busesHandler.get(w, req, params)
+			require.Equal(subT, expectedStatus, w.Code, "invalid HTTP status")
+
+			if expectedStatus == http.StatusOK {
+				var doc jsonapi.BusesDocument
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+
+				var ids []string
+				for _, d := range doc.Data {
+					ids = append(ids, d.ID)
+				}
+				assert.Equal(subT, expectedIDs, ids, "unexpected bus order")
+			} else {
+				var doc jsonapi.ErrorsDocument
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+				require.Len(subT, doc.Errors, 1)
+				require.NotNil(subT, doc.Errors[0].Source, "error source should be set")
+				assert.Equal(subT, expectedParameter, doc.Errors[0].Source.Parameter, "unexpected error parameter")
+			}
+		}
+	}
+
+	t.Run("malformed", subTestFunc("sort=id,", http.StatusBadRequest, "sort"))
+	t.Run("unknown field", subTestFunc("sort=foo", http.StatusBadRequest, "sort"))
+	t.Run("location filter", subTestFunc("sort=id&filter[near]=1.23,4.56", http.StatusBadRequest, "sort"))
+	t.Run("unknown sparse field", subTestFunc("fields[bus]=foo", http.StatusBadRequest, "fields[bus]"))
+	t.Run("descending ID", subTestFunc("sort=-id", http.StatusOK, "", "initial-bus-2", "initial-bus-1", "initial-bus-0"))
+	t.Run("update time", subTestFunc("sort=-updated_at,id&page[size]=2", http.StatusOK, "", "initial-bus-2", "initial-bus-1"))
+
+	t.Run("sparse fieldset", func(subT *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/bus?fields[bus]=latitude", nil)
+		req.Header.Set("Accept", jsonapi.ContentType)
+
+		w := httptest.NewRecorder()
+		var params httprouter.Params
+
+		busesHandler.get(w, req, params)
+		require.Equal(subT, http.StatusOK, w.Code, "invalid HTTP status")
+
+		var doc struct {
+			Data []struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+
+		err := json.NewDecoder(w.Body).Decode(&doc)
+		require.NoError(subT, err, "failed to decode data from JSON")
+		require.NotEmpty(subT, doc.Data)
+		for _, d := range doc.Data {
+			assert.Len(subT, d.Attributes, 1, "only the selected attributes should be returned")
+			assert.Contains(subT, d.Attributes, "latitude")
+		}
+	})
+}
+
+func TestBusesHandler_get_updatedSince(t *testing.T) {
+	get := func(t *testing.T, query string, expectedStatus int) jsonapi.BusesDocument {
+		req := httptest.NewRequest(http.MethodGet, "/bus?"+query, nil)
+		req.Header.Set("Accept", jsonapi.ContentType)
+
+		w := httptest.NewRecorder()
+		var params httprouter.Params
+
+		busesHandler.get(w, req, params)
+		require.Equal(t, expectedStatus, w.Code, "invalid HTTP status")
+
+		var doc jsonapi.BusesDocument
+
+		if expectedStatus == http.StatusOK {
+			err := json.NewDecoder(w.Body).Decode(&doc)
+			require.NoError(t, err, "failed to decode data from JSON")
+			require.NotNil(t, doc.Meta, "document meta should be set")
+			require.NotNil(t, doc.Meta.ServerTime, "server time should be set")
+		}
+
+		return doc
+	}
+
+	t.Run("invalid time", func(subT *testing.T) {
+		get(subT, "filter[updated_since]=foo", http.StatusBadRequest)
+	})
+
+	t.Run("location filter", func(subT *testing.T) {
+		get(subT, "filter[updated_since]=2017-01-01T00:00:00Z&filter[near]=1.23,4.56", http.StatusBadRequest)
+	})
+
+	t.Run("page", func(subT *testing.T) {
+		get(subT, "filter[updated_since]=2017-01-01T00:00:00Z&page[size]=1", http.StatusBadRequest)
+	})
+
+	t.Run("success", func(subT *testing.T) {
+		doc := get(subT, "", http.StatusOK)
+		serverTime := *doc.Meta.ServerTime
+
+		bus := data.Bus{
+			ID:        "test-updated-since",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			subT.Skipf("failed to create bus: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), bus.ID)
+
+		query := url.Values{}
+		query.Set("filter[updated_since]", serverTime.Format(time.RFC3339Nano))
+
+		doc = get(subT, query.Encode(), http.StatusOK)
+		require.Len(subT, doc.Data, 1, "only the new bus should be returned")
+		assert.Equal(subT, bus.ID, doc.Data[0].ID, "unexpected updated bus")
+		assert.True(subT, doc.Meta.ServerTime.After(serverTime), "server time should advance")
+		assert.Empty(subT, doc.Meta.Deleted, "no bus should have been deleted")
+	})
+
+	t.Run("deleted", func(subT *testing.T) {
+		bus := data.Bus{
+			ID:        "test-deleted-since",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			subT.Skipf("failed to create bus: %v", err)
+		}
+
+		doc := get(subT, "", http.StatusOK)
+		serverTime := *doc.Meta.ServerTime
+
+		if err := repo.DeleteBus(context.Background(), bus.ID); err != nil {
+			subT.Skipf("failed to delete bus: %v", err)
+		}
+
+		query := url.Values{}
+		query.Set("filter[updated_since]", serverTime.Format(time.RFC3339Nano))
+
+		doc = get(subT, query.Encode(), http.StatusOK)
+		assert.Empty(subT, doc.Data, "no bus should have been updated")
+		assert.Equal(subT, []string{bus.ID}, doc.Meta.Deleted, "unexpected deleted buses")
+	})
+}
+
+func TestBusesHandler_get_nearby(t *testing.T) {
+	subTestFunc := func(query string, expectedStatus int, expectedParameter string) func(*testing.T) {
+		return func(subT *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/bus?"+query, nil)
+			req.Header.Set("Accept", jsonapi.ContentType)
+
+			w := httptest.NewRecorder()
+			var params httprouter.Params
+
+			busesHandler.get(w, req, params)
+			require.Equal(subT, expectedStatus, w.Code, "invalid HTTP status")
+
+			if expectedStatus != http.StatusOK {
+				var doc jsonapi.ErrorsDocument
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+				require.Len(subT, doc.Errors, 1)
+				require.NotNil(subT, doc.Errors[0].Source, "error source should be set")
+				assert.Equal(subT, expectedParameter, doc.Errors[0].Source.Parameter, "unexpected error parameter")
+			}
+		}
+	}
+
+	t.Run("missing point", subTestFunc("filter[radius]=100", http.StatusBadRequest, "filter[radius]"))
+	t.Run("malformed point", subTestFunc("filter[near]=foo", http.StatusBadRequest, "filter[near]"))
+	t.Run("invalid point", subTestFunc("filter[near]=91,4.56", http.StatusBadRequest, "filter[near]"))
+	t.Run("malformed radius", subTestFunc("filter[near]=1.23,4.56&filter[radius]=foo", http.StatusBadRequest, "filter[radius]"))
+	t.Run("invalid radius", subTestFunc("filter[near]=1.23,4.56&filter[radius]=-1", http.StatusBadRequest, "filter[radius]"))
+
+	t.Run("success", func(subT *testing.T) {
+		bus := data.Bus{
+			ID:        "test-nearby",
+			Latitude:  1.2345,
+			Longitude: 4.56,
+		}
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			subT.Skipf("failed to create bus which would be read: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), bus.ID)
+
+		req := httptest.NewRequest(http.MethodGet, "/bus?filter[near]=1.24,4.56&filter[radius]=1000", nil)
+		req.Header.Set("Accept", jsonapi.ContentType)
+
+		w := httptest.NewRecorder()
+		var params httprouter.Params
+
+		busesHandler.get(w, req, params)
+		require.Equal(subT, http.StatusOK, w.Code, "invalid HTTP status")
+
+		var doc jsonapi.BusesDocument
+
+		err := json.NewDecoder(w.Body).Decode(&doc)
+		require.NoError(subT, err, "failed to decode data from JSON")
+		require.Len(subT, doc.Data, 1, "only the nearby bus should be returned")
+		assert.Equal(subT, bus.ID, doc.Data[0].ID, "unexpected bus ID")
+		require.NotNil(subT, doc.Data[0].Meta, "bus meta should be set")
+		require.NotNil(subT, doc.Data[0].Meta.Distance, "bus distance should be set")
+		assert.InDelta(subT, 611, *doc.Data[0].Meta.Distance, 1, "unexpected bus distance")
+	})
+}
+
+func TestBusesHandler_get_box(t *testing.T) {
+	subTestFunc := func(query string, expectedStatus int, expectedIDs ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/bus?"+query, nil)
+			req.Header.Set("Accept", jsonapi.ContentType)
+
+			w := httptest.NewRecorder()
+			var params httprouter.Params
+
+			busesHandler.get(w, req, params)
+			require.Equal(subT, expectedStatus, w.Code, "invalid HTTP status")
+
+			if expectedStatus == http.StatusOK {
+				var doc jsonapi.BusesDocument
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+
+				var ids []string
+				for _, d := range doc.Data {
+					ids = append(ids, d.ID)
+				}
+				assert.Equal(subT, expectedIDs, ids, "unexpected buses in box")
+			} else {
+				var doc jsonapi.ErrorsDocument
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+				require.Len(subT, doc.Errors, 1)
+				require.NotNil(subT, doc.Errors[0].Source, "error source should be set")
+				assert.Equal(subT, "filter[bbox]", doc.Errors[0].Source.Parameter, "unexpected error parameter")
+			}
+		}
+	}
+
+	bus := data.Bus{
+		ID:        "test-box",
+		Latitude:  -23.55,
+		Longitude: -46.63,
+	}
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to create bus which would be read: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	t.Run("malformed box", subTestFunc("filter[bbox]=1,2,3", http.StatusBadRequest))
+	t.Run("invalid coordinate", subTestFunc("filter[bbox]=-46.7,-91,-46.6,-23.5", http.StatusBadRequest))
+	t.Run("inverted latitudes", subTestFunc("filter[bbox]=-46.7,-23.5,-46.6,-23.6", http.StatusBadRequest))
+	t.Run("with nearby filter", subTestFunc("filter[bbox]=-46.7,-23.6,-46.6,-23.5&filter[near]=-23.55,-46.63", http.StatusBadRequest))
+	t.Run("success", subTestFunc("filter[bbox]=-46.7,-23.6,-46.6,-23.5", http.StatusOK, bus.ID))
+}
+
 func TestBusesHandler_post(t *testing.T) {
 	subTestFunc := func(bus data.Bus, body io.Reader, header http.Header, expectedStatus int, deleteOnExit bool) func(*testing.T) {
 		return func(subT *testing.T) {
@@ -75,7 +461,7 @@ func TestBusesHandler_post(t *testing.T) {
 
 			busesHandler.post(w, req, params)
 			if deleteOnExit {
-				defer repo.DeleteBus(bus.ID)
+				defer repo.DeleteBus(context.Background(), bus.ID)
 			}
 
 			require.Equal(subT, expectedStatus, w.Code, "invalid HTTP status")
@@ -88,12 +474,16 @@ func TestBusesHandler_post(t *testing.T) {
 
 				err := json.NewDecoder(w.Body).Decode(&createdBusDoc)
 				require.NoError(subT, err, "failed to decode data from JSON")
+				if assert.NotNil(subT, createdBusDoc.Meta, "the bus token should be returned") {
+					assert.NotEmpty(subT, createdBusDoc.Meta.Token, "the bus token should be returned")
+				}
 
 				createdBus, err = jsonapi.FromBusDocument(createdBusDoc)
 				require.NoError(subT, err, "failed to convert JSONAPI data")
 				assert.Equal(subT, bus.ID, createdBus.ID, "unexpected bus ID")
 				assert.Equal(subT, bus.Latitude, createdBus.Latitude, "unexpected bus latitude")
 				assert.Equal(subT, bus.Longitude, createdBus.Longitude, "unexpected bus longitude")
+				assert.Equal(subT, bus.Heading, createdBus.Heading, "unexpected bus heading")
 			}
 		}
 	}
@@ -139,12 +529,27 @@ func TestBusesHandler_post(t *testing.T) {
 	t.Run("missing ID",
 		subTestFunc(bus, nil, h, http.StatusUnprocessableEntity, true))
 
+	bus.ID = allBusesStreamID
+	t.Run("reserved ID",
+		subTestFunc(bus, nil, h, http.StatusUnprocessableEntity, true))
+
 	bus.ID = "foo"
 	bus.CreatedAt = time.Now()
 	t.Run("creation time specified",
 		subTestFunc(bus, nil, h, http.StatusUnprocessableEntity, true))
 
 	bus.CreatedAt = time.Time{}
+	bus.Longitude = 200
+	t.Run("invalid position",
+		subTestFunc(bus, nil, h, http.StatusUnprocessableEntity, true))
+
+	bus.Longitude = 4.56
+	heading := 400.0
+	bus.Heading = &heading
+	t.Run("invalid telemetry",
+		subTestFunc(bus, nil, h, http.StatusUnprocessableEntity, true))
+
+	heading = 90
 	t.Run("success",
 		subTestFunc(bus, nil, h, http.StatusCreated, false))
 
@@ -180,7 +585,11 @@ func BenchmarkBusesHandler_get(b *testing.B) {
 func BenchmarkBusesHandler_post(b *testing.B) {
 	var body bytes.Buffer
 
-	bus := data.Bus{ID: "bench-post"}
+	bus := data.Bus{
+		ID:        "bench-post",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 	doc := jsonapi.ToBusDocument(bus)
 
 	w := httptest.NewRecorder()
@@ -205,7 +614,7 @@ func BenchmarkBusesHandler_post(b *testing.B) {
 		}
 		b.StopTimer()
 
-		if err := repo.DeleteBus(bus.ID); err != nil {
+		if err := repo.DeleteBus(context.Background(), bus.ID); err != nil {
 			b.Error(err)
 		}
 	}
@@ -1,10 +1,12 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cd1/motofretado-server/data"
@@ -31,7 +33,11 @@ func (h BusHandler) doDelete(w http.ResponseWriter, req *http.Request, params ht
 		return
 	}
 
-	if err := h.repo.DeleteBus(id); err != nil {
+	if !verifyBusToken(w, req, h.repo, id) {
+		return
+	}
+
+	if err := h.repo.DeleteBus(req.Context(), id); err != nil {
 		if errors.Cause(err) == data.ErrNoSuchRow {
 			errorResponse(w, jsonapi.ErrorData{
 				Status: strconv.Itoa(http.StatusNotFound), // 404 Not Found
@@ -39,11 +45,7 @@ func (h BusHandler) doDelete(w http.ResponseWriter, req *http.Request, params ht
 				Detail: fmt.Sprintf("Bus \"%v\" doesn't exist", id),
 			})
 		} else {
-			errorResponse(w, jsonapi.ErrorData{
-				Status: strconv.Itoa(http.StatusInternalServerError), // 500 Internal Server Error
-				Title:  "Unexpected error",
-				Detail: err.Error(),
-			})
+			errorResponse(w, unexpectedError(err))
 		}
 
 		return
@@ -69,7 +71,36 @@ func (h BusHandler) get(w http.ResponseWriter, req *http.Request, params httprou
 		return
 	}
 
-	bus, err := h.repo.ReadBus(id)
+	query := req.URL.Query()
+
+	if _, exists := query["sort"]; exists {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid sort parameter",
+			Detail: "A single bus cannot be sorted",
+			Source: &jsonapi.ErrorSource{
+				Parameter: "sort",
+			},
+		})
+
+		return
+	}
+
+	fields, err := parseBusFields(query)
+	if err != nil {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid sparse fieldset",
+			Detail: err.Error(),
+			Source: &jsonapi.ErrorSource{
+				Parameter: "fields[bus]",
+			},
+		})
+
+		return
+	}
+
+	bus, err := h.repo.ReadBus(req.Context(), id)
 	if err != nil {
 		if errors.Cause(err) == data.ErrNoSuchRow {
 			errorResponse(w, jsonapi.ErrorData{
@@ -78,11 +109,7 @@ func (h BusHandler) get(w http.ResponseWriter, req *http.Request, params httprou
 				Detail: fmt.Sprintf("Bus \"%v\" doesn't exist", id),
 			})
 		} else {
-			errorResponse(w, jsonapi.ErrorData{
-				Status: strconv.Itoa(http.StatusInternalServerError), // 500 Internal Server Error
-				Title:  "Unexpected error",
-				Detail: err.Error(),
-			})
+			errorResponse(w, unexpectedError(err))
 		}
 
 		return
@@ -93,6 +120,14 @@ func (h BusHandler) get(w http.ResponseWriter, req *http.Request, params httprou
 		Self: fmt.Sprintf("%v://%v/bus/%v", requestScheme(req), req.Host, id),
 	}
 
+	if fields != nil {
+		busDoc.Data.Attributes.SelectFields(fields)
+	}
+
+	if checkNotModified(w, req, sparseETag(busETag(bus), fields), bus.UpdatedAt) { // 304 Not Modified
+		return
+	}
+
 	w.Header().Set("Content-Type", jsonapi.ContentType)
 	if err := json.NewEncoder(w).Encode(busDoc); err != nil { // 200 OK
 		logrus.WithError(err).Error("could not encode bus to JSON")
@@ -183,7 +218,17 @@ func (h BusHandler) patch(w http.ResponseWriter, req *http.Request, params httpr
 		return
 	}
 
-	updatedBus, err := h.repo.UpdateBus(bus)
+	if !verifyBusToken(w, req, h.repo, id) {
+		return
+	}
+
+	var updatedBus data.Bus
+
+	if ifMatch := req.Header.Get("If-Match"); len(ifMatch) > 0 {
+		updatedBus, err = h.updateBusIfMatch(req.Context(), bus, ifMatch)
+	} else {
+		updatedBus, err = h.repo.UpdateBus(req.Context(), bus)
+	}
 	if err != nil {
 		causeErr := errors.Cause(err)
 		if causeErr == data.ErrNoSuchRow {
@@ -195,6 +240,21 @@ func (h BusHandler) patch(w http.ResponseWriter, req *http.Request, params httpr
 					Pointer: "/data/id",
 				},
 			})
+		} else if causeErr == data.ErrOutdatedPosition {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusConflict), // 409 Conflict
+				Title:  "Outdated bus position",
+				Detail: fmt.Sprintf("Bus \"%v\" already has a position recorded after \"%v\"", id, bus.RecordedAt),
+				Source: &jsonapi.ErrorSource{
+					Pointer: "/data/attributes/recorded_at",
+				},
+			})
+		} else if causeErr == data.ErrConcurrentUpdate {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusPreconditionFailed), // 412 Precondition Failed
+				Title:  "Bus has been modified",
+				Detail: fmt.Sprintf("Bus \"%v\" doesn't match \"If-Match\"", id),
+			})
 		} else {
 			switch causeErr.(type) {
 			case data.InvalidParameterError:
@@ -207,11 +267,7 @@ func (h BusHandler) patch(w http.ResponseWriter, req *http.Request, params httpr
 					},
 				})
 			default:
-				errorResponse(w, jsonapi.ErrorData{
-					Status: strconv.Itoa(http.StatusInternalServerError), // 500 Internal Server Error
-					Title:  "Unexpected error",
-					Detail: err.Error(),
-				})
+				errorResponse(w, unexpectedError(err))
 			}
 		}
 
@@ -224,7 +280,46 @@ func (h BusHandler) patch(w http.ResponseWriter, req *http.Request, params httpr
 	}
 
 	w.Header().Set("Content-Type", jsonapi.ContentType)
+	w.Header().Set("ETag", busETag(updatedBus))
 	if err := json.NewEncoder(w).Encode(updatedBusDoc); err != nil { // 200 OK
 		logrus.WithError(err).Error("could not encode bus to JSON")
 	}
 }
+
+// updateBusIfMatch updates the bus only if it matches one of the entity tags
+// from the HTTP header "If-Match".
+func (h BusHandler) updateBusIfMatch(ctx context.Context, bus data.Bus, ifMatch string) (data.Bus, error) {
+	updatedAts, any := parseIfMatch(ifMatch)
+	if any {
+		return h.repo.UpdateBus(ctx, bus)
+	}
+
+	if len(updatedAts) == 0 {
+		return data.Bus{}, errors.WithMessage(data.ErrConcurrentUpdate, "no valid entity tags")
+	}
+
+	updatedAt := updatedAts[0]
+
+	// the update can only be conditional on one of the tags, so the matching
+	// one must be found first
+	if len(updatedAts) > 1 {
+		existingBus, err := h.repo.ReadBus(ctx, bus.ID)
+		if err != nil {
+			return data.Bus{}, err
+		}
+
+		updatedAt = time.Time{}
+		for _, t := range updatedAts {
+			if t.Equal(existingBus.UpdatedAt) {
+				updatedAt = t
+				break
+			}
+		}
+
+		if updatedAt.IsZero() {
+			return data.Bus{}, errors.WithMessage(data.ErrConcurrentUpdate, "no matching entity tags")
+		}
+	}
+
+	return h.repo.UpdateBusIfMatch(ctx, bus, updatedAt)
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,15 +15,19 @@ import (
 	"github.com/cd1/motofretado-server/data"
 	"github.com/cd1/motofretado-server/web/jsonapi"
 	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 var busHandler BusHandler
 
 func TestBusHandler_doDelete(t *testing.T) {
-	subTestFunc := func(id string, expectedStatus int) func(*testing.T) {
+	subTestFunc := func(id, token string, expectedStatus int) func(*testing.T) {
 		return func(subT *testing.T) {
 			req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/bus/%v", id), nil)
+			if len(token) > 0 {
+				req.Header.Set(busTokenHeader, token)
+			}
 
 			w := httptest.NewRecorder()
 			params := httprouter.Params{
@@ -37,17 +42,24 @@ func TestBusHandler_doDelete(t *testing.T) {
 		}
 	}
 
-	t.Run("empty ID", subTestFunc("", http.StatusBadRequest))
+	t.Run("empty ID", subTestFunc("", "", http.StatusBadRequest))
 
-	t.Run("not found", subTestFunc("not-found", http.StatusNotFound))
+	t.Run("not found", subTestFunc("not-found", "foo", http.StatusNotFound))
 
 	t.Run("success", func(subT *testing.T) {
-		bus := data.Bus{ID: "test-delete"}
-		if _, err := repo.CreateBus(bus); err != nil {
+		bus := data.Bus{
+			ID:        "test-delete",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		createdBus, err := repo.CreateBus(context.Background(), bus)
+		if err != nil {
 			subT.Skipf("failed to create bus which would be deleted: %v", err)
 		}
 
-		subTestFunc(bus.ID, http.StatusNoContent)(subT)
+		subTestFunc(bus.ID, "", http.StatusUnauthorized)(subT)
+		subTestFunc(bus.ID, busTokens["initial-bus-0"], http.StatusForbidden)(subT)
+		subTestFunc(bus.ID, createdBus.Token, http.StatusNoContent)(subT)
 	})
 }
 
@@ -81,19 +93,140 @@ func TestBusHandler_get(t *testing.T) {
 	t.Run("not found", subTestFunc("not-found", h, http.StatusNotFound))
 
 	t.Run("success", subTestFunc(id, h, http.StatusOK))
+
+	queryTestFunc := func(query string, expectedStatus int) func(*testing.T) {
+		return func(subT *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/bus/%v?%v", id, query), nil)
+			req.Header = h
+
+			w := httptest.NewRecorder()
+			params := httprouter.Params{
+				{
+					Key:   "id",
+					Value: id,
+				},
+			}
+
+			busHandler.get(w, req, params)
+			require.Equal(subT, expectedStatus, w.Code, "unexpected HTTP status code")
+
+			if expectedStatus == http.StatusOK {
+				var doc struct {
+					Data struct {
+						Attributes map[string]interface{} `json:"attributes"`
+					} `json:"data"`
+				}
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+				assert.Len(subT, doc.Data.Attributes, 2, "only the selected attributes should be returned")
+			}
+		}
+	}
+
+	t.Run("sort", queryTestFunc("sort=id", http.StatusBadRequest))
+	t.Run("unknown sparse field", queryTestFunc("fields[bus]=foo", http.StatusBadRequest))
+	t.Run("sparse fieldset", queryTestFunc("fields[bus]=latitude,longitude", http.StatusOK))
+}
+
+func TestBusHandler_get_conditional(t *testing.T) {
+	bus := data.Bus{
+		ID:        "test-get-conditional",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to create bus which would be read: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	get := func(method, query string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, fmt.Sprintf("/bus/%v%v", bus.ID, query), nil)
+		req.Header = header
+		req.Header.Set("Accept", jsonapi.ContentType)
+
+		w := httptest.NewRecorder()
+		params := httprouter.Params{
+			{
+				Key:   "id",
+				Value: bus.ID,
+			},
+		}
+
+		busHandler.get(w, req, params)
+
+		return w
+	}
+
+	w := get(http.MethodGet, "", make(http.Header))
+	require.Equal(t, http.StatusOK, w.Code, "unexpected HTTP status code")
+	etag := w.HeaderMap.Get("ETag")
+	lastModified := w.HeaderMap.Get("Last-Modified")
+	require.NotEmpty(t, etag, "\"ETag\" header should be set")
+	require.NotEmpty(t, lastModified, "\"Last-Modified\" header should be set")
+
+	subTestFunc := func(name, value string, expectedStatus int) func(*testing.T) {
+		return func(subT *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				h := make(http.Header)
+				h.Set(name, value)
+
+				w := get(method, "", h)
+				assert.Equal(subT, expectedStatus, w.Code, "unexpected HTTP status code on %v", method)
+				if expectedStatus == http.StatusNotModified {
+					assert.Equal(subT, 0, w.Body.Len(), "response shouldn't have a body on %v", method)
+				}
+			}
+		}
+	}
+
+	t.Run("matching tag", subTestFunc("If-None-Match", etag, http.StatusNotModified))
+	t.Run("weak matching tag", subTestFunc("If-None-Match", "W/"+etag, http.StatusNotModified))
+	t.Run("any tag", subTestFunc("If-None-Match", "*", http.StatusNotModified))
+	t.Run("other tag", subTestFunc("If-None-Match", "\"foo\"", http.StatusOK))
+	t.Run("not modified since", subTestFunc("If-Modified-Since", lastModified, http.StatusNotModified))
+	t.Run("modified since", subTestFunc("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK))
+
+	t.Run("sparse fieldset", func(subT *testing.T) {
+		h := make(http.Header)
+		h.Set("If-None-Match", etag)
+
+		w := get(http.MethodGet, "?fields[bus]=latitude", h)
+		require.Equal(subT, http.StatusOK, w.Code, "the whole bus tag shouldn't match a sparse fieldset")
+		sparseTag := w.HeaderMap.Get("ETag")
+		assert.NotEqual(subT, etag, sparseTag, "each fieldset should have its own tag")
+
+		h.Set("If-None-Match", sparseTag)
+		w = get(http.MethodGet, "?fields[bus]=latitude", h)
+		assert.Equal(subT, http.StatusNotModified, w.Code, "the same fieldset should match")
+
+		w = get(http.MethodGet, "?fields[bus]=latitude,longitude", h)
+		assert.Equal(subT, http.StatusOK, w.Code, "another fieldset shouldn't match")
+	})
+
+	if _, err := repo.UpdateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to update bus: %v", err)
+	}
+	t.Run("updated", subTestFunc("If-None-Match", etag, http.StatusOK))
 }
 
 func TestBusHandler_patch(t *testing.T) {
 	subTestFunc := func(bus data.Bus, body io.Reader, header http.Header, expectedStatus int, create bool) func(*testing.T) {
 		return func(subT *testing.T) {
+			token := "foo"
 			if create {
-				busToCreate := data.Bus{ID: bus.ID}
+				busToCreate := data.Bus{
+					ID:        bus.ID,
+					Latitude:  1.23,
+					Longitude: 4.56,
+				}
 
-				_, err := repo.CreateBus(busToCreate)
+				createdBus, err := repo.CreateBus(context.Background(), busToCreate)
 				if err != nil {
 					subT.Skipf("failed to create bus which would be updated: %v", err)
 				}
-				defer repo.DeleteBus(bus.ID)
+				defer repo.DeleteBus(context.Background(), bus.ID)
+				token = createdBus.Token
 			}
 
 			if body == nil {
@@ -108,7 +241,12 @@ func TestBusHandler_patch(t *testing.T) {
 			}
 
 			req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/bus/%v", bus.ID), body)
-			req.Header = header
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			if len(req.Header.Get(busTokenHeader)) == 0 {
+				req.Header.Set(busTokenHeader, token)
+			}
 
 			w := httptest.NewRecorder()
 			params := httprouter.Params{
@@ -141,6 +279,8 @@ func TestBusHandler_patch(t *testing.T) {
 		subTestFunc(bus, nil, h, http.StatusBadRequest, false))
 
 	bus.ID = "test-patch"
+	bus.Latitude = 1.23
+	bus.Longitude = 4.56
 	t.Run("not acceptable",
 		subTestFunc(bus, nil, h, http.StatusNotAcceptable, false))
 
@@ -200,12 +340,164 @@ func TestBusHandler_patch(t *testing.T) {
 		subTestFunc(bus, nil, h, http.StatusUnprocessableEntity, true))
 
 	bus.CreatedAt = time.Time{}
+	bus.Latitude = 100
+	t.Run("invalid position",
+		subTestFunc(bus, nil, h, http.StatusUnprocessableEntity, true))
+
+	bus.Latitude = 1.23
 	t.Run("success",
 		subTestFunc(bus, nil, h, http.StatusOK, true))
+
+	h.Set(busTokenHeader, busTokens["initial-bus-0"])
+	t.Run("invalid token",
+		subTestFunc(bus, nil, h, http.StatusForbidden, true))
+}
+
+func TestBusHandler_patch_ifMatch(t *testing.T) {
+	bus := data.Bus{
+		ID:        "test-patch-if-match",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	patch := func(ifMatch string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+
+		doc := jsonapi.ToBusDocument(bus)
+		if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+			t.Skipf("failed to encode bus to JSON: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/bus/%v", bus.ID), &buf)
+		req.Header.Set("Accept", jsonapi.ContentType)
+		req.Header.Set("Content-Type", jsonapi.ContentType)
+		req.Header.Set("If-Match", ifMatch)
+		req.Header.Set(busTokenHeader, createdBus.Token)
+
+		w := httptest.NewRecorder()
+		params := httprouter.Params{
+			{
+				Key:   "id",
+				Value: bus.ID,
+			},
+		}
+
+		busHandler.patch(w, req, params)
+
+		return w
+	}
+
+	createdETag := busETag(createdBus)
+	var currentETag string
+
+	t.Run("malformed", func(subT *testing.T) {
+		w := patch("foo")
+		assert.Equal(subT, http.StatusPreconditionFailed, w.Code, "unexpected HTTP status code")
+	})
+
+	t.Run("match", func(subT *testing.T) {
+		w := patch(createdETag)
+		require.Equal(subT, http.StatusOK, w.Code, "unexpected HTTP status code")
+
+		currentETag = w.HeaderMap.Get("ETag")
+		assert.NotEmpty(subT, currentETag, "\"ETag\" header should be set")
+		assert.NotEqual(subT, createdETag, currentETag, "\"ETag\" should change after the update")
+	})
+
+	t.Run("match after update", func(subT *testing.T) {
+		w := patch(currentETag)
+		require.Equal(subT, http.StatusOK, w.Code, "the \"ETag\" of the update should match the stored bus")
+
+		currentETag = w.HeaderMap.Get("ETag")
+	})
+
+	t.Run("mismatch", func(subT *testing.T) {
+		w := patch(createdETag)
+		assert.Equal(subT, http.StatusPreconditionFailed, w.Code, "unexpected HTTP status code")
+	})
+
+	t.Run("multiple tags", func(subT *testing.T) {
+		w := patch(fmt.Sprintf("%v, %v", createdETag, currentETag))
+		assert.Equal(subT, http.StatusOK, w.Code, "unexpected HTTP status code")
+	})
+
+	t.Run("any", func(subT *testing.T) {
+		w := patch("*")
+		assert.Equal(subT, http.StatusOK, w.Code, "unexpected HTTP status code")
+	})
+}
+
+func TestBusHandler_patch_recordedAt(t *testing.T) {
+	bus := data.Bus{
+		ID:         "test-patch-recorded-at",
+		Latitude:   1.23,
+		Longitude:  4.56,
+		RecordedAt: time.Now(),
+	}
+
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	patch := func(recordedAt time.Time) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+
+		patchedBus := bus
+		patchedBus.RecordedAt = recordedAt
+
+		doc := jsonapi.ToBusDocument(patchedBus)
+		if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+			t.Skipf("failed to encode bus to JSON: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/bus/%v", bus.ID), &buf)
+		req.Header.Set("Accept", jsonapi.ContentType)
+		req.Header.Set("Content-Type", jsonapi.ContentType)
+		req.Header.Set(busTokenHeader, createdBus.Token)
+
+		w := httptest.NewRecorder()
+		params := httprouter.Params{
+			{
+				Key:   "id",
+				Value: bus.ID,
+			},
+		}
+
+		busHandler.patch(w, req, params)
+
+		return w
+	}
+
+	t.Run("outdated", func(subT *testing.T) {
+		w := patch(bus.RecordedAt.Add(-time.Minute))
+		assert.Equal(subT, http.StatusConflict, w.Code, "unexpected HTTP status code")
+	})
+
+	t.Run("future", func(subT *testing.T) {
+		w := patch(time.Now().Add(time.Hour))
+		assert.Equal(subT, http.StatusUnprocessableEntity, w.Code, "unexpected HTTP status code")
+	})
+
+	t.Run("success", func(subT *testing.T) {
+		w := patch(bus.RecordedAt.Add(time.Second))
+		assert.Equal(subT, http.StatusOK, w.Code, "unexpected HTTP status code")
+	})
 }
 
 func BenchmarkBusHandler_doDelete(b *testing.B) {
-	bus := data.Bus{ID: "bench-delete"}
+	bus := data.Bus{
+		ID:        "bench-delete",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
 
 	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/bus/%v", bus.ID), nil)
 
@@ -220,9 +512,11 @@ func BenchmarkBusHandler_doDelete(b *testing.B) {
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		b.StopTimer()
-		if _, err := repo.CreateBus(bus); err != nil {
+		createdBus, err := repo.CreateBus(context.Background(), bus)
+		if err != nil {
 			b.Fatal(err)
 		}
+		req.Header.Set(busTokenHeader, createdBus.Token)
 		b.StartTimer()
 
 		busHandler.doDelete(w, req, params)
@@ -263,11 +557,16 @@ func BenchmarkBusHandler_get(b *testing.B) {
 }
 
 func BenchmarkBusHandler_patch(b *testing.B) {
-	bus := data.Bus{ID: "bench-patch"}
-	if _, err := repo.CreateBus(bus); err != nil {
+	bus := data.Bus{
+		ID:        "bench-patch",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
 		b.Fatal(err)
 	}
-	defer repo.DeleteBus(bus.ID)
+	defer repo.DeleteBus(context.Background(), bus.ID)
 
 	w := httptest.NewRecorder()
 	params := httprouter.Params{
@@ -281,7 +580,7 @@ func BenchmarkBusHandler_patch(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		b.StopTimer()
 		updatedBus := bus
-		updatedBus.Latitude = float64(n)
+		updatedBus.Latitude = float64(n%90) + 0.5
 
 		doc := jsonapi.ToBusDocument(updatedBus)
 
@@ -294,6 +593,7 @@ func BenchmarkBusHandler_patch(b *testing.B) {
 		req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/bus/%v", bus.ID), &buf)
 		req.Header.Set("Accept", jsonapi.ContentType)
 		req.Header.Set("Content-Type", jsonapi.ContentType)
+		req.Header.Set(busTokenHeader, createdBus.Token)
 		b.StartTimer()
 
 		busHandler.patch(w, req, params)
@@ -0,0 +1,126 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/negroni"
+)
+
+// corsAnyOrigin allows requests from any origin.
+const corsAnyOrigin = "*"
+
+// DefaultCORSMethods contains the HTTP methods which browsers may send to the
+// API from other origins, unless others are configured.
+var DefaultCORSMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// DefaultCORSHeaders contains the HTTP headers which browsers may send to the
+// API from other origins, unless others are configured. "Content-Type" is
+// needed because "application/vnd.api+json" isn't allowed by default.
+var DefaultCORSHeaders = []string{
+	"Accept",
+	"Authorization",
+	"Content-Type",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"X-HTTP-Method-Override",
+	apiKeyHeader,
+	busTokenHeader,
+}
+
+// corsExposedHeaders contains the response headers which browsers may read,
+// besides the ones always allowed.
+var corsExposedHeaders = []string{"ETag", "Location", "Retry-After", "WWW-Authenticate"}
+
+// CORSOptions allows browser apps from other origins (e.g. dashboards) to use
+// the API. No origin is allowed if AllowedOrigins is empty.
+type CORSOptions struct {
+	// AllowedOrigins may contain "*" to allow any origin.
+	AllowedOrigins []string
+
+	// AllowedMethods and AllowedHeaders use DefaultCORSMethods and
+	// DefaultCORSHeaders, respectively, if they're empty.
+	AllowedMethods []string
+	AllowedHeaders []string
+
+	// MaxAge is how long browsers may cache the preflight responses; they
+	// choose it themselves if it's zero.
+	MaxAge time.Duration
+}
+
+func (opts CORSOptions) allowsOrigin(origin string) bool {
+	for _, o := range opts.AllowedOrigins {
+		if o == corsAnyOrigin || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (opts CORSOptions) allowsAnyOrigin() bool {
+	for _, o := range opts.AllowedOrigins {
+		if o == corsAnyOrigin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowCORS builds a middleware which adds the CORS headers to the responses
+// of the requests from the allowed origins. The preflight requests (i.e.
+// OPTIONS) get them too, and are then answered by the router.
+func allowCORS(opts CORSOptions) negroni.HandlerFunc {
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = DefaultCORSMethods
+	}
+	if len(opts.AllowedHeaders) == 0 {
+		opts.AllowedHeaders = DefaultCORSHeaders
+	}
+
+	allowedMethods := strings.Join(opts.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(opts.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(corsExposedHeaders, ", ")
+	anyOrigin := opts.allowsAnyOrigin()
+
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if !anyOrigin {
+			// the response depends on the origin, so it can't be cached for another one
+			w.Header().Add("Vary", "Origin")
+		}
+
+		origin := req.Header.Get("Origin")
+		if len(origin) == 0 || !opts.allowsOrigin(origin) {
+			next(w, req)
+			return
+		}
+
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", corsAnyOrigin)
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if req.Method == http.MethodOptions && len(req.Header.Get("Access-Control-Request-Method")) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+			if opts.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+			}
+		} else {
+			w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,106 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowCORS(t *testing.T) {
+	const dashboardOrigin = "https://dashboard.example.com"
+
+	mux := BuildMux(repo, Options{
+		CORS: CORSOptions{
+			AllowedOrigins: []string{dashboardOrigin},
+			MaxAge:         time.Minute,
+		},
+	})
+
+	serve := func(method, origin string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/bus", nil)
+		if len(origin) > 0 {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+
+		return w
+	}
+
+	t.Run("preflight", func(subT *testing.T) {
+		w := serve(http.MethodOptions, dashboardOrigin, map[string]string{
+			"Access-Control-Request-Method":  http.MethodPost,
+			"Access-Control-Request-Headers": "Content-Type, X-API-Key",
+		})
+
+		require.Equal(subT, http.StatusOK, w.Code, "the router should answer the preflight request")
+		assert.Equal(subT, dashboardOrigin, w.Header().Get("Access-Control-Allow-Origin"), "unexpected allowed origin")
+		assert.Contains(subT, w.Header().Get("Access-Control-Allow-Methods"), http.MethodPatch, "PATCH should be allowed")
+		assert.Contains(subT, w.Header().Get("Access-Control-Allow-Headers"), "Content-Type", "\"Content-Type\" should be allowed")
+		assert.Contains(subT, w.Header().Get("Access-Control-Allow-Headers"), apiKeyHeader, "the API key should be allowed")
+		assert.Equal(subT, "60", w.Header().Get("Access-Control-Max-Age"), "unexpected max age")
+		assert.Contains(subT, w.Header().Get("Vary"), "Origin", "the response should vary by origin")
+	})
+
+	t.Run("request", func(subT *testing.T) {
+		w := serve(http.MethodGet, dashboardOrigin, map[string]string{"Accept": jsonapi.ContentType})
+
+		require.Equal(subT, http.StatusOK, w.Code, "unexpected HTTP status")
+		assert.Equal(subT, dashboardOrigin, w.Header().Get("Access-Control-Allow-Origin"), "unexpected allowed origin")
+		assert.Contains(subT, w.Header().Get("Access-Control-Expose-Headers"), "ETag", "\"ETag\" should be readable")
+	})
+
+	t.Run("rejected request", func(subT *testing.T) {
+		w := serve(http.MethodPost, dashboardOrigin, nil)
+
+		require.Equal(subT, http.StatusUnauthorized, w.Code, "unexpected HTTP status")
+		assert.Equal(subT, dashboardOrigin, w.Header().Get("Access-Control-Allow-Origin"), "the error should be readable")
+	})
+
+	t.Run("other origin", func(subT *testing.T) {
+		w := serve(http.MethodOptions, "https://example.com", map[string]string{
+			"Access-Control-Request-Method": http.MethodPost,
+		})
+
+		assert.Empty(subT, w.Header().Get("Access-Control-Allow-Origin"), "the origin shouldn't be allowed")
+		assert.Empty(subT, w.Header().Get("Access-Control-Allow-Methods"), "no method should be allowed")
+	})
+
+	t.Run("same origin", func(subT *testing.T) {
+		w := serve(http.MethodGet, "", map[string]string{"Accept": jsonapi.ContentType})
+
+		require.Equal(subT, http.StatusOK, w.Code, "unexpected HTTP status")
+		assert.Empty(subT, w.Header().Get("Access-Control-Allow-Origin"), "CORS headers are only needed by other origins")
+	})
+
+	t.Run("any origin", func(subT *testing.T) {
+		middleware := allowCORS(CORSOptions{
+			AllowedOrigins: []string{corsAnyOrigin},
+			AllowedMethods: []string{http.MethodGet},
+			AllowedHeaders: []string{"Accept"},
+		})
+
+		req := httptest.NewRequest(http.MethodOptions, "/bus", nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+
+		middleware(w, req, func(http.ResponseWriter, *http.Request) {})
+
+		assert.Equal(subT, corsAnyOrigin, w.Header().Get("Access-Control-Allow-Origin"), "any origin should be allowed")
+		assert.Equal(subT, http.MethodGet, w.Header().Get("Access-Control-Allow-Methods"), "only the configured methods should be allowed")
+		assert.Equal(subT, "Accept", w.Header().Get("Access-Control-Allow-Headers"), "only the configured headers should be allowed")
+		assert.Empty(subT, w.Header().Get("Access-Control-Max-Age"), "the browser should choose the max age")
+		assert.False(subT, strings.Contains(w.Header().Get("Vary"), "Origin"), "the response shouldn't vary by origin")
+	})
+}
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -8,33 +9,42 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/pkg/errors"
 )
 
 func errorResponse(w http.ResponseWriter, e jsonapi.ErrorData) {
-	statusInt, err := strconv.Atoi(e.Status)
+	errorsResponse(w, []jsonapi.ErrorData{e})
+}
+
+// errorsResponse writes multiple errors to the same response, e.g. one for each
+// invalid item of a batch. The HTTP status is taken from the first error.
+func errorsResponse(w http.ResponseWriter, errs []jsonapi.ErrorData) {
+	statusInt, err := strconv.Atoi(errs[0].Status)
 	if err != nil {
 		logrus.WithError(err).WithFields(logrus.Fields{
-			"status": e.Status,
+			"status": errs[0].Status,
 		}).Warn("invalid HTTP error status; using 500 Internal Server Error")
 		statusInt = http.StatusInternalServerError
 	}
 
-	logFields := logrus.WithFields(logrus.Fields{
-		"status": fmt.Sprintf("%v %v", e.Status, http.StatusText(statusInt)),
-		"title":  e.Title,
-		"detail": e.Detail,
-	})
-	if statusInt < http.StatusInternalServerError {
-		logFields.Info("HTTP error")
-	} else {
-		logFields.Error("HTTP error")
+	for _, e := range errs {
+		logFields := logrus.WithFields(logrus.Fields{
+			"status": fmt.Sprintf("%v %v", e.Status, http.StatusText(statusInt)),
+			"title":  e.Title,
+			"detail": e.Detail,
+		})
+		if statusInt < http.StatusInternalServerError {
+			logFields.Info("HTTP error")
+		} else {
+			logFields.Error("HTTP error")
+		}
 	}
 
 	doc := jsonapi.ErrorsDocument{
 		JSONAPI: &jsonapi.Root{
 			Version: jsonapi.CurrentVersion,
 		},
-		Errors: []jsonapi.ErrorData{e},
+		Errors: errs,
 	}
 
 	w.Header().Set("Content-Type", jsonapi.ContentType)
@@ -43,3 +53,22 @@ func errorResponse(w http.ResponseWriter, e jsonapi.ErrorData) {
 		logrus.WithError(err).Warn("error encoding Errors to JSON")
 	}
 }
+
+// unexpectedError describes an error which wasn't caused by the request. If the
+// database took too long to answer, the same request may work later, so that's
+// reported as a temporary failure.
+func unexpectedError(err error) jsonapi.ErrorData {
+	if errors.Cause(err) == context.DeadlineExceeded {
+		return jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusServiceUnavailable), // 503 Service Unavailable
+			Title:  "Database timeout",
+			Detail: err.Error(),
+		}
+	}
+
+	return jsonapi.ErrorData{
+		Status: strconv.Itoa(http.StatusInternalServerError), // 500 Internal Server Error
+		Title:  "Unexpected error",
+		Detail: err.Error(),
+	}
+}
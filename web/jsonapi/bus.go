@@ -1,6 +1,7 @@
 package jsonapi
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -12,15 +13,29 @@ import (
 const BusType = "bus"
 
 type BusDocument struct {
-	JSONAPI *Root   `json:"jsonapi,omitempty"`
-	Data    BusData `json:"data"`
-	Links   *Links  `json:"links,omitempty"`
+	JSONAPI *Root            `json:"jsonapi,omitempty"`
+	Data    BusData          `json:"data"`
+	Links   *Links           `json:"links,omitempty"`
+	Meta    *BusDocumentMeta `json:"meta,omitempty"`
+}
+
+// BusDocumentMeta contains the bus token, which is only sent once, when the bus
+// is created.
+type BusDocumentMeta struct {
+	Token string `json:"token,omitempty"`
 }
 
 type BusesDocument struct {
-	JSONAPI *Root     `json:"jsonapi,omitempty"`
-	Data    []BusData `json:"data"`
-	Links   *Links    `json:"links,omitempty"`
+	JSONAPI *Root      `json:"jsonapi,omitempty"`
+	Data    []BusData  `json:"data"`
+	Links   *Links     `json:"links,omitempty"`
+	Meta    *BusesMeta `json:"meta,omitempty"`
+}
+
+type BusesMeta struct {
+	Total      *int       `json:"total,omitempty"`
+	ServerTime *time.Time `json:"server_time,omitempty"`
+	Deleted    []string   `json:"deleted,omitempty"`
 }
 
 type BusData struct {
@@ -28,13 +43,62 @@ type BusData struct {
 	ID         string         `json:"id"`
 	Attributes *BusAttributes `json:"attributes"`
 	Links      *Links         `json:"links,omitempty"`
+	Meta       *BusMeta       `json:"meta,omitempty"`
 }
 
 type BusAttributes struct {
-	Latitude  float64   `json:"latitude"`
-	Longitude float64   `json:"longitude"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Speed      *float64  `json:"speed"`
+	Heading    *float64  `json:"heading"`
+	Accuracy   *float64  `json:"accuracy"`
+	Altitude   *float64  `json:"altitude"`
+	RecordedAt time.Time `json:"recorded_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// fields contains the attributes encoded to JSON; all of them are encoded
+	// if it's nil
+	fields map[string]bool
+}
+
+// BusFields contains the names of all bus attributes.
+var BusFields = []string{"latitude", "longitude", "speed", "heading", "accuracy", "altitude", "recorded_at", "created_at", "updated_at"}
+
+// SelectFields restricts the attributes encoded to JSON to fields (i.e. a
+// JSONAPI sparse fieldset). No attribute is encoded if fields is empty.
+func (attrs *BusAttributes) SelectFields(fields []string) {
+	attrs.fields = make(map[string]bool, len(fields))
+	for _, f := range fields {
+		attrs.fields[f] = true
+	}
+}
+
+func (attrs BusAttributes) MarshalJSON() ([]byte, error) {
+	// the new type doesn't have this method, so it's encoded as usual
+	type busAttributes BusAttributes
+
+	allFields, err := json.Marshal(busAttributes(attrs))
+	if err != nil || attrs.fields == nil {
+		return allFields, err
+	}
+
+	var fieldValues map[string]json.RawMessage
+	if err := json.Unmarshal(allFields, &fieldValues); err != nil {
+		return nil, err
+	}
+
+	for f := range fieldValues {
+		if !attrs.fields[f] {
+			delete(fieldValues, f)
+		}
+	}
+
+	return json.Marshal(fieldValues)
+}
+
+type BusMeta struct {
+	Distance *float64 `json:"distance,omitempty"`
 }
 
 func ToBusDocument(bus data.Bus) BusDocument {
@@ -45,6 +109,12 @@ func ToBusDocument(bus data.Bus) BusDocument {
 		Data: toBusData(bus),
 	}
 
+	if len(bus.Token) > 0 {
+		doc.Meta = &BusDocumentMeta{
+			Token: bus.Token,
+		}
+	}
+
 	return doc
 }
 
@@ -119,10 +189,15 @@ func toBusData(bus data.Bus) BusData {
 		Type: BusType,
 		ID:   bus.ID,
 		Attributes: &BusAttributes{
-			Latitude:  bus.Latitude,
-			Longitude: bus.Longitude,
-			CreatedAt: bus.CreatedAt,
-			UpdatedAt: bus.UpdatedAt,
+			Latitude:   bus.Latitude,
+			Longitude:  bus.Longitude,
+			Speed:      bus.Speed,
+			Heading:    bus.Heading,
+			Accuracy:   bus.Accuracy,
+			Altitude:   bus.Altitude,
+			RecordedAt: bus.RecordedAt,
+			CreatedAt:  bus.CreatedAt,
+			UpdatedAt:  bus.UpdatedAt,
 		},
 	}
 
@@ -145,6 +220,11 @@ func fromBusData(busData BusData) (data.Bus, error) {
 	if busData.Attributes != nil {
 		bus.Latitude = busData.Attributes.Latitude
 		bus.Longitude = busData.Attributes.Longitude
+		bus.Speed = busData.Attributes.Speed
+		bus.Heading = busData.Attributes.Heading
+		bus.Accuracy = busData.Attributes.Accuracy
+		bus.Altitude = busData.Attributes.Altitude
+		bus.RecordedAt = busData.Attributes.RecordedAt
 		bus.CreatedAt = busData.Attributes.CreatedAt
 		bus.UpdatedAt = busData.Attributes.UpdatedAt
 	}
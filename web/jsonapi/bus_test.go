@@ -1,7 +1,9 @@
 package jsonapi
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -31,6 +33,50 @@ func TestToBusDocument(t *testing.T) {
 	assert.Equal(t, bus.Longitude, doc.Data.Attributes.Longitude, "bad longitude")
 	assert.Equal(t, bus.CreatedAt, doc.Data.Attributes.CreatedAt, "bad creation time")
 	assert.Equal(t, bus.UpdatedAt, doc.Data.Attributes.UpdatedAt, "bad update time")
+	assert.Nil(t, doc.Meta, "only a created bus should have a token")
+
+	bus.Token = "foo"
+	doc = ToBusDocument(bus)
+
+	if assert.NotNil(t, doc.Meta, "the bus token should be set") {
+		assert.Equal(t, bus.Token, doc.Meta.Token, "bad token")
+	}
+}
+
+func TestBusAttributes_SelectFields(t *testing.T) {
+	attrs := BusAttributes{
+		Latitude:  1.23,
+		Longitude: 4.56,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	subTestFunc := func(fields []string, expectedFields ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			selectedAttrs := attrs
+			if fields != nil {
+				selectedAttrs.SelectFields(fields)
+			}
+
+			data, err := json.Marshal(selectedAttrs)
+			require.NoError(subT, err, "failed to encode attributes to JSON")
+
+			var values map[string]interface{}
+			require.NoError(subT, json.Unmarshal(data, &values), "failed to decode attributes from JSON")
+
+			var encodedFields []string
+			for f := range values {
+				encodedFields = append(encodedFields, f)
+			}
+			sort.Strings(expectedFields)
+			sort.Strings(encodedFields)
+			assert.Equal(subT, expectedFields, encodedFields, "unexpected encoded fields")
+		}
+	}
+
+	t.Run("all", subTestFunc(nil, "accuracy", "altitude", "created_at", "heading", "latitude", "longitude", "recorded_at", "speed", "updated_at"))
+	t.Run("some", subTestFunc([]string{"latitude", "longitude"}, "latitude", "longitude"))
+	t.Run("none", subTestFunc([]string{}))
 }
 
 func TestToBusesDocument(t *testing.T) {
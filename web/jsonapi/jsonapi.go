@@ -14,5 +14,17 @@ type Root struct {
 }
 
 type Links struct {
-	Self string `json:"self"`
+	Self  string `json:"self"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+}
+
+type Relationship struct {
+	Data *ResourceIdentifier `json:"data"`
+}
+
+type ResourceIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
 }
@@ -0,0 +1,114 @@
+package jsonapi
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cd1/motofretado-server/data"
+	"github.com/pkg/errors"
+)
+
+const LocationType = "location"
+
+type LocationsDocument struct {
+	JSONAPI *Root          `json:"jsonapi,omitempty"`
+	Data    []LocationData `json:"data"`
+	Links   *Links         `json:"links,omitempty"`
+}
+
+type LocationData struct {
+	Type          string                 `json:"type"`
+	ID            string                 `json:"id,omitempty"`
+	Attributes    *LocationAttributes    `json:"attributes"`
+	Relationships *LocationRelationships `json:"relationships,omitempty"`
+}
+
+type LocationAttributes struct {
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+type LocationRelationships struct {
+	Bus *Relationship `json:"bus,omitempty"`
+}
+
+func ToLocationsDocument(locations []data.Location) LocationsDocument {
+	doc := LocationsDocument{
+		JSONAPI: &Root{
+			Version: CurrentVersion,
+		},
+		Data: make([]LocationData, len(locations)),
+	}
+
+	for i, l := range locations {
+		doc.Data[i] = toLocationData(l)
+	}
+
+	return doc
+}
+
+func FromLocationsDocument(doc LocationsDocument) ([]data.Location, error) {
+	if err := validateVersion(doc.JSONAPI); err != nil {
+		return nil, err
+	}
+
+	locations := make([]data.Location, len(doc.Data))
+
+	for i, d := range doc.Data {
+		loc, err := fromLocationData(d)
+		if err != nil {
+			return nil, err
+		}
+
+		locations[i] = loc
+	}
+
+	return locations, nil
+}
+
+func toLocationData(loc data.Location) LocationData {
+	locData := LocationData{
+		Type: LocationType,
+		ID:   strconv.FormatInt(loc.ID, 10),
+		Attributes: &LocationAttributes{
+			Latitude:   loc.Latitude,
+			Longitude:  loc.Longitude,
+			RecordedAt: loc.RecordedAt,
+		},
+		Relationships: &LocationRelationships{
+			Bus: &Relationship{
+				Data: &ResourceIdentifier{
+					Type: BusType,
+					ID:   loc.BusID,
+				},
+			},
+		},
+	}
+
+	return locData
+}
+
+func fromLocationData(locData LocationData) (data.Location, error) {
+	if locData.Type != LocationType {
+		err := InvalidTypeError{
+			Type:         locData.Type,
+			ExpectedType: LocationType,
+		}
+		return data.Location{}, errors.WithMessage(err, "invalid JSONAPI data type")
+	}
+
+	var loc data.Location
+
+	if locData.Attributes != nil {
+		loc.Latitude = locData.Attributes.Latitude
+		loc.Longitude = locData.Attributes.Longitude
+		loc.RecordedAt = locData.Attributes.RecordedAt
+	}
+
+	if locData.Relationships != nil && locData.Relationships.Bus != nil && locData.Relationships.Bus.Data != nil {
+		loc.BusID = locData.Relationships.Bus.Data.ID
+	}
+
+	return loc, nil
+}
@@ -0,0 +1,97 @@
+package jsonapi
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/data"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToLocationsDocument(t *testing.T) {
+	nLocations := 2
+	locations := make([]data.Location, nLocations)
+
+	for i := range locations {
+		locations[i] = data.Location{
+			ID:         int64(i + 1),
+			BusID:      "test-jsonapi",
+			Latitude:   1.23,
+			Longitude:  4.56,
+			RecordedAt: time.Now(),
+		}
+	}
+
+	doc := ToLocationsDocument(locations)
+
+	assert.Len(t, doc.Data, nLocations, "bad locations size")
+	for i, d := range doc.Data {
+		originalLocation := locations[i]
+
+		assert.Equal(t, LocationType, d.Type, "bad data type")
+		assert.Equal(t, strconv.FormatInt(originalLocation.ID, 10), d.ID, "bad ID")
+		assert.Equal(t, originalLocation.Latitude, d.Attributes.Latitude, "bad latitude")
+		assert.Equal(t, originalLocation.Longitude, d.Attributes.Longitude, "bad longitude")
+		assert.Equal(t, originalLocation.RecordedAt, d.Attributes.RecordedAt, "bad record time")
+		if assert.NotNil(t, d.Relationships, "missing relationships") {
+			assert.Equal(t, BusType, d.Relationships.Bus.Data.Type, "bad bus relationship type")
+			assert.Equal(t, originalLocation.BusID, d.Relationships.Bus.Data.ID, "bad bus relationship ID")
+		}
+	}
+}
+
+func BenchmarkToLocationsDocument(b *testing.B) {
+	nLocations := []int{1, 2, 4, 8}
+
+	for _, nl := range nLocations {
+		b.Run(strconv.Itoa(nl), func(subB *testing.B) {
+			locations := make([]data.Location, nl)
+
+			for i := range locations {
+				locations[i] = data.Location{
+					ID:         int64(i + 1),
+					BusID:      fmt.Sprintf("bench-jsonapi-%v", i),
+					Latitude:   1.23,
+					Longitude:  4.56,
+					RecordedAt: time.Now(),
+				}
+			}
+
+			subB.ResetTimer()
+
+			for n := 0; n < subB.N; n++ {
+				_ = ToLocationsDocument(locations)
+			}
+		})
+	}
+}
+
+func TestFromLocationsDocument(t *testing.T) {
+	locations := []data.Location{
+		{
+			BusID:      "test-jsonapi",
+			Latitude:   1.23,
+			Longitude:  4.56,
+			RecordedAt: time.Now(),
+		},
+	}
+
+	t.Run("success", func(subT *testing.T) {
+		convertedLocations, err := FromLocationsDocument(ToLocationsDocument(locations))
+		require.NoError(subT, err, "failed to convert JSONAPI data")
+		require.Len(subT, convertedLocations, len(locations), "bad locations size")
+		assert.Equal(subT, locations[0], convertedLocations[0], "bad location")
+	})
+
+	t.Run("invalid type", func(subT *testing.T) {
+		doc := ToLocationsDocument(locations)
+		doc.Data[0].Type = BusType
+
+		_, err := FromLocationsDocument(doc)
+		assert.IsType(subT, InvalidTypeError{}, errors.Cause(err))
+	})
+}
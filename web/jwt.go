@@ -0,0 +1,208 @@
+package web
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	jwtAlgorithmHS256 = "HS256"
+	jwtAlgorithmRS256 = "RS256"
+
+	// jwtMinSecretSize is the smallest HS256 secret allowed by RFC 7518, in bytes
+	jwtMinSecretSize = 32
+
+	// jwtLeeway tolerates the clock differences between the server and whoever
+	// issued the tokens
+	jwtLeeway = time.Minute
+)
+
+// role defines what a user authenticated by a JWT may do. Each role may do
+// everything the previous ones may.
+type role string
+
+const (
+	roleRider  role = "rider"  // reads the buses
+	roleDriver role = "driver" // also changes the buses listed in the token
+	roleAdmin  role = "admin"  // also creates, changes and deletes any bus
+)
+
+var roleLevels = map[role]int{
+	roleRider:  1,
+	roleDriver: 2,
+	roleAdmin:  3,
+}
+
+// includes returns whether r may do everything other may. Unknown roles may do
+// nothing.
+func (r role) includes(other role) bool {
+	level, known := roleLevels[r]
+	return known && level >= roleLevels[other]
+}
+
+// jwtClaims contains the JWT claims used by the server; the other ones are
+// ignored.
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Role      role     `json:"role"`
+	Buses     []string `json:"buses"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+// canChangeBus returns whether the claims allow changing the bus identified by
+// id.
+func (c jwtClaims) canChangeBus(id string) bool {
+	if c.Role.includes(roleAdmin) {
+		return true
+	}
+
+	if !c.Role.includes(roleDriver) {
+		return false
+	}
+
+	for _, b := range c.Buses {
+		if b == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// JWTVerifier verifies the signature and the validity of JWTs. It only accepts
+// the algorithm of its key, so a token can't pick a weaker one.
+type JWTVerifier struct {
+	algorithm string
+	secret    []byte
+	publicKey *rsa.PublicKey
+}
+
+// NewJWTVerifier builds a verifier from the contents of a key file. A PEM
+// encoded RSA public key (or a certificate containing one) verifies RS256
+// tokens; anything else is used as the secret which verifies HS256 tokens.
+func NewJWTVerifier(key []byte) (*JWTVerifier, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		secret := bytes.TrimSpace(key)
+		if len(secret) < jwtMinSecretSize {
+			return nil, errors.Errorf("HS256 secret must have at least %v bytes", jwtMinSecretSize)
+		}
+
+		return &JWTVerifier{
+			algorithm: jwtAlgorithmHS256,
+			secret:    secret,
+		}, nil
+	}
+
+	var publicKey interface{}
+	var err error
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			publicKey = cert.PublicKey
+		}
+	default:
+		return nil, errors.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key")
+	}
+
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	return &JWTVerifier{
+		algorithm: jwtAlgorithmRS256,
+		publicKey: rsaKey,
+	}, nil
+}
+
+// verify checks whether token has been signed by the verifier key and is valid
+// at now, returning its claims.
+func (v *JWTVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("token must have 3 parts")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return jwtClaims{}, errors.WithMessage(err, "invalid token header")
+	}
+
+	if header.Algorithm != v.algorithm {
+		return jwtClaims{}, errors.Errorf("token algorithm must be %v, not %q", v.algorithm, header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.Wrap(err, "invalid token signature encoding")
+	}
+
+	if !v.validSignature(parts[0]+"."+parts[1], signature) {
+		return jwtClaims{}, errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return jwtClaims{}, errors.WithMessage(err, "invalid token claims")
+	}
+
+	if claims.ExpiresAt == 0 {
+		return jwtClaims{}, errors.New("token must have an expiration time")
+	}
+
+	if now.Add(-jwtLeeway).After(time.Unix(claims.ExpiresAt, 0)) {
+		return jwtClaims{}, errors.New("token has expired")
+	}
+
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return jwtClaims{}, errors.New("token isn't valid yet")
+	}
+
+	return claims, nil
+}
+
+func (v *JWTVerifier) validSignature(signingInput string, signature []byte) bool {
+	switch v.algorithm {
+	case jwtAlgorithmHS256:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(signature, mac.Sum(nil))
+	case jwtAlgorithmRS256:
+		hash := sha256.Sum256([]byte(signingInput))
+		return rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, hash[:], signature) == nil
+	default:
+		return false
+	}
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a JWT into v.
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.Wrap(err, "invalid base64 encoding")
+	}
+
+	return errors.Wrap(json.Unmarshal(data, v), "invalid JSON")
+}
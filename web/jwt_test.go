@@ -0,0 +1,191 @@
+package web
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signJWT builds a JWT with claims, signed by key: a []byte secret for HS256,
+// an *rsa.PrivateKey for RS256 or nil for an unsigned token.
+func signJWT(t *testing.T, algorithm string, key interface{}, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err, "failed to encode JWT part to JSON")
+
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signingInput := encode(map[string]string{"alg": algorithm, "typ": "JWT"}) + "." + encode(claims)
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256([]byte(signingInput))
+
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		require.NoError(t, err, "failed to sign JWT")
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestSecret generates a secret which can be used by a HS256 verifier.
+func newTestSecret(t *testing.T) []byte {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err, "failed to generate secret")
+
+	// the key files are text, so the secret must be too
+	return []byte(base64.RawURLEncoding.EncodeToString(secret))
+}
+
+// newTestRSAKey generates an RSA key along with its public key encoded as PEM.
+func newTestRSAKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "failed to generate RSA key")
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err, "failed to encode RSA public key")
+
+	return privateKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	t.Run("secret", func(subT *testing.T) {
+		verifier, err := NewJWTVerifier(append(newTestSecret(subT), '\n'))
+		require.NoError(subT, err, "failed to build verifier")
+		assert.Equal(subT, jwtAlgorithmHS256, verifier.algorithm, "unexpected algorithm")
+	})
+
+	t.Run("short secret", func(subT *testing.T) {
+		_, err := NewJWTVerifier([]byte("foo"))
+		assert.Error(subT, err, "a short secret should be rejected")
+	})
+
+	t.Run("RSA public key", func(subT *testing.T) {
+		_, publicKey := newTestRSAKey(subT)
+
+		verifier, err := NewJWTVerifier(publicKey)
+		require.NoError(subT, err, "failed to build verifier")
+		assert.Equal(subT, jwtAlgorithmRS256, verifier.algorithm, "unexpected algorithm")
+	})
+
+	t.Run("unsupported PEM block", func(subT *testing.T) {
+		privateKey, _ := newTestRSAKey(subT)
+		key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+		_, err := NewJWTVerifier(key)
+		assert.Error(subT, err, "a private key shouldn't be accepted")
+	})
+}
+
+func TestJWTVerifier_verify(t *testing.T) {
+	secret := newTestSecret(t)
+	hsVerifier, err := NewJWTVerifier(secret)
+	require.NoError(t, err, "failed to build HS256 verifier")
+
+	privateKey, publicKey := newTestRSAKey(t)
+	rsVerifier, err := NewJWTVerifier(publicKey)
+	require.NoError(t, err, "failed to build RS256 verifier")
+
+	now := time.Now()
+	claims := func(exp, nbf time.Time) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "test",
+			"role":  "driver",
+			"buses": []string{"test-bus"},
+		}
+		if !exp.IsZero() {
+			c["exp"] = exp.Unix()
+		}
+		if !nbf.IsZero() {
+			c["nbf"] = nbf.Unix()
+		}
+
+		return c
+	}
+	validClaims := claims(now.Add(time.Hour), time.Time{})
+
+	t.Run("HS256", func(subT *testing.T) {
+		c, err := hsVerifier.verify(signJWT(subT, jwtAlgorithmHS256, secret, validClaims), now)
+		require.NoError(subT, err, "a valid token should be accepted")
+		assert.Equal(subT, "test", c.Subject, "unexpected subject")
+		assert.Equal(subT, roleDriver, c.Role, "unexpected role")
+		assert.Equal(subT, []string{"test-bus"}, c.Buses, "unexpected buses")
+	})
+
+	t.Run("RS256", func(subT *testing.T) {
+		_, err := rsVerifier.verify(signJWT(subT, jwtAlgorithmRS256, privateKey, validClaims), now)
+		assert.NoError(subT, err, "a valid token should be accepted")
+	})
+
+	subTestFunc := func(verifier *JWTVerifier, token string) func(*testing.T) {
+		return func(subT *testing.T) {
+			_, err := verifier.verify(token, now)
+			assert.Error(subT, err, "the token should be rejected")
+		}
+	}
+
+	otherKey, _ := newTestRSAKey(t)
+	hsToken := signJWT(t, jwtAlgorithmHS256, secret, validClaims)
+
+	t.Run("malformed", subTestFunc(hsVerifier, "foo.bar"))
+	t.Run("wrong secret", subTestFunc(hsVerifier, signJWT(t, jwtAlgorithmHS256, newTestSecret(t), validClaims)))
+	t.Run("wrong RSA key", subTestFunc(rsVerifier, signJWT(t, jwtAlgorithmRS256, otherKey, validClaims)))
+	// the public key is known by everyone, so it can't be used as an HMAC secret
+	t.Run("algorithm confusion", subTestFunc(rsVerifier, signJWT(t, jwtAlgorithmHS256, publicKey, validClaims)))
+	t.Run("no algorithm", subTestFunc(hsVerifier, signJWT(t, "none", nil, validClaims)))
+
+	adminClaims := claims(now.Add(time.Hour), time.Time{})
+	adminClaims["role"] = "admin"
+	tamperedToken := strings.Split(hsToken, ".")
+	tamperedToken[1] = strings.Split(signJWT(t, jwtAlgorithmHS256, newTestSecret(t), adminClaims), ".")[1]
+	t.Run("tampered claims", subTestFunc(hsVerifier, strings.Join(tamperedToken, ".")))
+	t.Run("expired", subTestFunc(hsVerifier, signJWT(t, jwtAlgorithmHS256, secret, claims(now.Add(-time.Hour), time.Time{}))))
+	t.Run("not valid yet", subTestFunc(hsVerifier, signJWT(t, jwtAlgorithmHS256, secret, claims(now.Add(time.Hour), now.Add(time.Hour)))))
+	t.Run("no expiration", subTestFunc(hsVerifier, signJWT(t, jwtAlgorithmHS256, secret, claims(time.Time{}, time.Time{}))))
+
+	t.Run("leeway", func(subT *testing.T) {
+		token := signJWT(subT, jwtAlgorithmHS256, secret, claims(now.Add(-jwtLeeway/2), now.Add(jwtLeeway/2)))
+
+		_, err := hsVerifier.verify(token, now)
+		assert.NoError(subT, err, "small clock differences should be tolerated")
+	})
+}
+
+func TestJWTClaims_canChangeBus(t *testing.T) {
+	claims := jwtClaims{Buses: []string{"test-bus"}}
+
+	for _, tc := range []struct {
+		role     role
+		id       string
+		expected bool
+	}{
+		{roleRider, "test-bus", false},
+		{roleDriver, "test-bus", true},
+		{roleDriver, "other-bus", false},
+		{roleAdmin, "other-bus", true},
+		{"foo", "test-bus", false},
+	} {
+		claims.Role = tc.role
+		assert.Equal(t, tc.expected, claims.canChangeBus(tc.id), "role %q, bus %q", tc.role, tc.id)
+	}
+}
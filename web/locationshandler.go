@@ -0,0 +1,294 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cd1/motofretado-server/data"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// maxLocationsBatchSize is the maximum number of locations which can be
+// uploaded at once.
+const maxLocationsBatchSize = 1000
+
+// maxLocationsBodySize is the maximum size of a location batch, in bytes. Each
+// location takes around 150 bytes, so it's generous but it still stops huge
+// bodies before they're read.
+const maxLocationsBodySize = maxLocationsBatchSize * 512
+
+// bodyTooLargeMessage is the message of the error returned by the readers from
+// http.MaxBytesReader after the limit.
+const bodyTooLargeMessage = "http: request body too large"
+
+// LocationsHandler handles the HTTP requests on the location history of a
+// bus. It is responsible for listing the positions reported by the bus over
+// time, and for uploading the positions buffered by the bus while offline.
+type LocationsHandler struct {
+	repo *data.Repository
+}
+
+func (h LocationsHandler) get(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+	if len(id) == 0 {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Empty bus ID",
+		})
+
+		return
+	}
+
+	if req.Header.Get("Accept") != jsonapi.ContentType {
+		notAcceptable(w) // 406 Not Acceptable
+
+		return
+	}
+
+	query := req.URL.Query()
+	var since, until time.Time
+
+	for param, t := range map[string]*time.Time{
+		"filter[since]": &since,
+		"filter[until]": &until,
+	} {
+		value := query.Get(param)
+		if len(value) == 0 {
+			continue
+		}
+
+		parsedTime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid time filter",
+				Detail: fmt.Sprintf("\"%v\" is not a valid RFC 3339 time", value),
+				Source: &jsonapi.ErrorSource{
+					Parameter: param,
+				},
+			})
+
+			return
+		}
+
+		*t = parsedTime
+	}
+
+	locations, err := h.repo.ReadLocations(req.Context(), id, since, until)
+	if err != nil {
+		causeErr := errors.Cause(err)
+		if causeErr == data.ErrNoSuchRow {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusNotFound), // 404 Not Found
+				Title:  "Bus ID not found",
+				Detail: fmt.Sprintf("Bus \"%v\" doesn't exist", id),
+			})
+		} else {
+			switch causeErr.(type) {
+			case data.InvalidParameterError:
+				errorResponse(w, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+					Title:  "Invalid time filter",
+					Detail: err.Error(),
+					Source: &jsonapi.ErrorSource{
+						Parameter: fmt.Sprintf("filter[%v]", causeErr.(data.InvalidParameterError).Name),
+					},
+				})
+			default:
+				errorResponse(w, unexpectedError(err))
+			}
+		}
+
+		return
+	}
+
+	locationsDoc := jsonapi.ToLocationsDocument(locations)
+	locationsDoc.Links = &jsonapi.Links{
+		Self: fmt.Sprintf("%v://%v%v", requestScheme(req), req.Host, req.URL.RequestURI()),
+	}
+
+	w.Header().Set("Content-Type", jsonapi.ContentType)
+	if err := json.NewEncoder(w).Encode(locationsDoc); err != nil { // 200 OK
+		logrus.WithError(err).Error("could not encode locations to JSON")
+	}
+}
+
+func (h LocationsHandler) post(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+	if len(id) == 0 {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Empty bus ID",
+		})
+
+		return
+	}
+
+	if req.Header.Get("Accept") != jsonapi.ContentType {
+		notAcceptable(w) // 406 Not Acceptable
+
+		return
+	}
+
+	if req.Header.Get("Content-Type") != jsonapi.ContentType {
+		unsupportedMediaType(w) // 415 Unsupported Media Type
+
+		return
+	}
+
+	var locationsDoc jsonapi.LocationsDocument
+
+	body := http.MaxBytesReader(w, req.Body, maxLocationsBodySize)
+	if err := json.NewDecoder(body).Decode(&locationsDoc); err != nil {
+		if err.Error() == bodyTooLargeMessage {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusRequestEntityTooLarge), // 413 Request Entity Too Large
+				Title:  "Too many locations",
+				Detail: fmt.Sprintf("At most %v locations (%v bytes) can be uploaded at once", maxLocationsBatchSize, maxLocationsBodySize),
+			})
+
+			return
+		}
+
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Invalid JSON format",
+			Detail: err.Error(),
+		})
+
+		return
+	}
+
+	locations, err := jsonapi.FromLocationsDocument(locationsDoc)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case jsonapi.UnsupportedVersionError:
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Unsupported JSONAPI version",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Pointer: "/jsonapi/version",
+				},
+			})
+		case jsonapi.InvalidTypeError:
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusConflict), // 409 Conflict
+				Title:  "Invalid JSONAPI data type",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Pointer: "/data",
+				},
+			})
+		default:
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Invalid JSONAPI data",
+				Detail: err.Error(),
+				Source: &jsonapi.ErrorSource{
+					Pointer: "/data",
+				},
+			})
+		}
+
+		return
+	}
+
+	if len(locations) > maxLocationsBatchSize {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusRequestEntityTooLarge), // 413 Request Entity Too Large
+			Title:  "Too many locations",
+			Detail: fmt.Sprintf("At most %v locations can be uploaded at once", maxLocationsBatchSize),
+			Source: &jsonapi.ErrorSource{
+				Pointer: "/data",
+			},
+		})
+
+		return
+	}
+
+	for i, loc := range locations {
+		if len(loc.BusID) > 0 && loc.BusID != id {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+				Title:  "Incompatible bus IDs",
+				Detail: fmt.Sprintf("Bus ID \"%v\" from URL doesn't match bus ID \"%v\" from JSONAPI data",
+					id, loc.BusID),
+				Source: &jsonapi.ErrorSource{
+					Pointer: fmt.Sprintf("/data/%v/relationships/bus/data/id", i),
+				},
+			})
+
+			return
+		}
+	}
+
+	if !verifyBusToken(w, req, h.repo, id) {
+		return
+	}
+
+	if err := h.repo.CreateLocations(req.Context(), id, locations); err != nil {
+		causeErr := errors.Cause(err)
+		if causeErr == data.ErrNoSuchRow {
+			errorResponse(w, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusNotFound), // 404 Not Found
+				Title:  "Bus ID not found",
+				Detail: fmt.Sprintf("Bus \"%v\" doesn't exist", id),
+			})
+		} else {
+			switch causeErr.(type) {
+			case data.BatchError:
+				errorsResponse(w, locationErrors(causeErr.(data.BatchError)))
+			case data.MissingParameterError:
+				errorResponse(w, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+					Title:  "Empty location batch",
+					Detail: err.Error(),
+					Source: &jsonapi.ErrorSource{
+						Pointer: "/data",
+					},
+				})
+			default:
+				errorResponse(w, unexpectedError(err))
+			}
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent) // 204 No Content
+}
+
+// locationErrors converts the errors of each invalid location from a batch to
+// JSONAPI errors pointing to that location.
+func locationErrors(batchErr data.BatchError) []jsonapi.ErrorData {
+	errs := make([]jsonapi.ErrorData, len(batchErr.Errors))
+
+	for i, itemErr := range batchErr.Errors {
+		errData := jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusUnprocessableEntity), // 422 Unprocessable Entity
+			Title:  "Invalid location",
+			Detail: itemErr.Err.Error(),
+			Source: &jsonapi.ErrorSource{
+				Pointer: fmt.Sprintf("/data/%v", itemErr.Index),
+			},
+		}
+
+		switch causeErr := errors.Cause(itemErr.Err); causeErr.(type) {
+		case data.InvalidParameterError:
+			errData.Source.Pointer += "/attributes/" + causeErr.(data.InvalidParameterError).Name
+		case data.MissingParameterError:
+			errData.Source.Pointer += "/attributes/" + causeErr.(data.MissingParameterError).Name
+		}
+
+		errs[i] = errData
+	}
+
+	return errs
+}
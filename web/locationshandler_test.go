@@ -0,0 +1,190 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/data"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var locationsHandler LocationsHandler
+
+func TestLocationsHandler_get(t *testing.T) {
+	bus := data.Bus{
+		ID:        "test-locations",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	bus.Latitude = 1.23
+	bus.Longitude = 4.56
+	updatedBus, err := repo.UpdateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to update bus: %v", err)
+	}
+
+	subTestFunc := func(id string, query url.Values, header http.Header, expectedStatus int, expectedLocations int) func(*testing.T) {
+		return func(subT *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/bus/%v/locations?%v", id, query.Encode()), nil)
+			req.Header = header
+
+			w := httptest.NewRecorder()
+			params := httprouter.Params{
+				{
+					Key:   "id",
+					Value: id,
+				},
+			}
+
+			locationsHandler.get(w, req, params)
+			require.Equal(subT, expectedStatus, w.Code, "unexpected HTTP status code")
+
+			if expectedStatus == http.StatusOK {
+				var doc jsonapi.LocationsDocument
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+				assert.Len(subT, doc.Data, expectedLocations, "unexpected number of locations")
+			}
+		}
+	}
+
+	h := make(http.Header)
+	q := make(url.Values)
+
+	t.Run("empty ID", subTestFunc("", q, h, http.StatusBadRequest, 0))
+
+	t.Run("not acceptable", subTestFunc(bus.ID, q, h, http.StatusNotAcceptable, 0))
+
+	h.Set("Accept", jsonapi.ContentType)
+	t.Run("not found", subTestFunc("not-found", q, h, http.StatusNotFound, 0))
+
+	t.Run("success", subTestFunc(bus.ID, q, h, http.StatusOK, 1))
+
+	q.Set("filter[since]", "foo")
+	t.Run("invalid time", subTestFunc(bus.ID, q, h, http.StatusBadRequest, 0))
+
+	q.Set("filter[since]", updatedBus.UpdatedAt.Add(time.Minute).Format(time.RFC3339))
+	q.Set("filter[until]", updatedBus.UpdatedAt.Add(-time.Minute).Format(time.RFC3339))
+	t.Run("invalid time range", subTestFunc(bus.ID, q, h, http.StatusBadRequest, 0))
+
+	q.Del("filter[until]")
+	t.Run("empty time range", subTestFunc(bus.ID, q, h, http.StatusOK, 0))
+}
+
+func TestLocationsHandler_post(t *testing.T) {
+	bus := data.Bus{
+		ID:        "test-post-locations",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	subTestFunc := func(id string, body io.Reader, header http.Header, expectedStatus int, expectedPointers ...string) func(*testing.T) {
+		return func(subT *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/bus/%v/locations", id), body)
+			req.Header = header
+
+			w := httptest.NewRecorder()
+			params := httprouter.Params{
+				{
+					Key:   "id",
+					Value: id,
+				},
+			}
+
+			locationsHandler.post(w, req, params)
+			require.Equal(subT, expectedStatus, w.Code, "unexpected HTTP status code")
+
+			if len(expectedPointers) > 0 {
+				var doc jsonapi.ErrorsDocument
+
+				err := json.NewDecoder(w.Body).Decode(&doc)
+				require.NoError(subT, err, "failed to decode data from JSON")
+				require.Len(subT, doc.Errors, len(expectedPointers), "unexpected number of errors")
+				for i, e := range doc.Errors {
+					require.NotNil(subT, e.Source, "error source should be set")
+					assert.Equal(subT, expectedPointers[i], e.Source.Pointer, "unexpected error pointer")
+				}
+			}
+		}
+	}
+
+	encode := func(locations ...data.Location) io.Reader {
+		var buf bytes.Buffer
+
+		doc := jsonapi.ToLocationsDocument(locations)
+		if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+			t.Skipf("failed to encode locations to JSON: %v", err)
+		}
+
+		return &buf
+	}
+
+	location := data.Location{
+		Latitude:   7.89,
+		Longitude:  1.23,
+		RecordedAt: createdBus.RecordedAt.Add(time.Millisecond),
+	}
+
+	h := make(http.Header)
+	h.Set(busTokenHeader, createdBus.Token)
+	t.Run("not acceptable", subTestFunc(bus.ID, encode(location), h, http.StatusNotAcceptable))
+
+	h.Set("Accept", jsonapi.ContentType)
+	t.Run("unsupported media type", subTestFunc(bus.ID, encode(location), h, http.StatusUnsupportedMediaType))
+
+	h.Set("Content-Type", jsonapi.ContentType)
+	t.Run("invalid JSON format", subTestFunc(bus.ID, strings.NewReader("foo bar {{{"), h, http.StatusBadRequest))
+	t.Run("not found", subTestFunc("not-found", encode(location), h, http.StatusNotFound))
+	t.Run("empty", subTestFunc(bus.ID, encode(), h, http.StatusBadRequest))
+	t.Run("too large", subTestFunc(bus.ID, io.MultiReader(strings.NewReader(`{"data": [`), strings.NewReader(strings.Repeat(" ", maxLocationsBodySize))), h,
+		http.StatusRequestEntityTooLarge))
+
+	otherBusLocation := location
+	otherBusLocation.BusID = "foo"
+	t.Run("incompatible bus IDs", subTestFunc(bus.ID, encode(location, otherBusLocation), h, http.StatusBadRequest,
+		"/data/1/relationships/bus/data/id"))
+
+	invalidLocation := location
+	invalidLocation.Latitude = 100
+	missingTimeLocation := location
+	missingTimeLocation.RecordedAt = time.Time{}
+	t.Run("invalid locations", subTestFunc(bus.ID, encode(invalidLocation, location, missingTimeLocation), h,
+		http.StatusUnprocessableEntity, "/data/0/attributes/latitude", "/data/2/attributes/recorded_at"))
+
+	otherBusHeader := make(http.Header)
+	otherBusHeader.Set("Accept", jsonapi.ContentType)
+	otherBusHeader.Set("Content-Type", jsonapi.ContentType)
+	otherBusHeader.Set(busTokenHeader, busTokens["initial-bus-0"])
+	t.Run("invalid token", subTestFunc(bus.ID, encode(location), otherBusHeader, http.StatusForbidden))
+
+	t.Run("success", func(subT *testing.T) {
+		subTestFunc(bus.ID, encode(location), h, http.StatusNoContent)(subT)
+
+		updatedBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.Equal(subT, location.Latitude, updatedBus.Latitude, "the bus should be moved to the uploaded location")
+	})
+}
@@ -17,28 +17,105 @@ import (
 
 var logOutput = os.Stderr
 
+// Options changes the optional behaviour of the HTTP mux.
+type Options struct {
+	// DisableAuth lets anyone change the buses, without an API key or a bus
+	// token. It should only be used for local development.
+	DisableAuth bool
+
+	// JWTVerifier replaces the API keys with JWT bearer tokens, if it's set.
+	// Every request then needs a token whose role allows it.
+	JWTVerifier *JWTVerifier
+
+	// ReadLimit and WriteLimit limit the requests of each client which read
+	// and change the buses, respectively.
+	ReadLimit  RateLimit
+	WriteLimit RateLimit
+
+	// TrustForwardedFor identifies the clients without valid API keys or JWTs
+	// by the "X-Forwarded-For" header. It should only be set behind a proxy
+	// which adds it.
+	TrustForwardedFor bool
+
+	// CORS allows browser apps from other origins to use the API.
+	CORS CORSOptions
+
+	// Sockets keeps track of the WebSocket connections, so they can be closed
+	// when the server shuts down. A new one is used if it's nil.
+	Sockets *Sockets
+}
+
 // BuildMux builds the HTTP mux for the web server. It is responsible for
 // creating and chaining all available HTTP handlers.
-func BuildMux(repo *data.Repository) http.Handler {
+func BuildMux(repo *data.Repository, opts Options) http.Handler {
+	// the WebSocket frames share the limit of the other writes
+	readLimiter := newRateLimiter(opts.ReadLimit)
+	writeLimiter := newRateLimiter(opts.WriteLimit)
+
 	router := httprouter.New()
+	authorize := func(minRole role, handle httprouter.Handle) httprouter.Handle {
+		if opts.DisableAuth || opts.JWTVerifier == nil {
+			return handle
+		}
+		return requireRole(opts.JWTVerifier, minRole, handle)
+	}
 
 	logrus.WithFields(logrus.Fields{
 		"path": "/bus",
 	}).Debug("registering HTTP handler")
 	buses := BusesHandler{repo: repo}
-	router.GET("/bus", buses.get)
-	router.HEAD("/bus", buses.get)
-	router.POST("/bus", buses.post)
+	router.GET("/bus", authorize(roleRider, buses.get))
+	router.HEAD("/bus", authorize(roleRider, buses.get))
+	router.POST("/bus", authorize(roleAdmin, buses.post))
 
 	logrus.WithFields(logrus.Fields{
 		"path": "/bus/:id",
 	}).Debug("registering HTTP handler")
 	bus := BusHandler{repo: repo}
-	router.GET("/bus/:id", bus.get)
-	router.HEAD("/bus/:id", bus.get)
-	router.PATCH("/bus/:id", bus.patch)
-	router.DELETE("/bus/:id", bus.doDelete)
+	stream := StreamHandler{repo: repo}
+	getBus := authorize(roleRider, func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if params.ByName("id") == allBusesStreamID {
+			stream.get(w, req, nil)
+		} else {
+			bus.get(w, req, params)
+		}
+	})
+	router.GET("/bus/:id", getBus)
+	router.HEAD("/bus/:id", getBus)
+	router.PATCH("/bus/:id", authorize(roleDriver, bus.patch))
+	router.DELETE("/bus/:id", authorize(roleAdmin, bus.doDelete))
+
+	logrus.WithFields(logrus.Fields{
+		"path": "/bus/:id/locations",
+	}).Debug("registering HTTP handler")
+	locations := LocationsHandler{repo: repo}
+	router.GET("/bus/:id/locations", authorize(roleRider, locations.get))
+	router.HEAD("/bus/:id/locations", authorize(roleRider, locations.get))
+	router.POST("/bus/:id/locations", authorize(roleDriver, locations.post))
+
+	logrus.WithFields(logrus.Fields{
+		"path": "/bus/:id/stream",
+	}).Debug("registering HTTP handler")
+	router.GET("/bus/:id/stream", authorize(roleRider, stream.get))
+	router.HEAD("/bus/:id/stream", authorize(roleRider, stream.get))
+
+	logrus.WithFields(logrus.Fields{
+		"path": "/bus/:id/socket",
+	}).Debug("registering HTTP handler")
+	sockets := opts.Sockets
+	if sockets == nil {
+		sockets = NewSockets()
+	}
+	socket := SocketHandler{
+		repo:              repo,
+		sockets:           sockets,
+		writeLimiter:      writeLimiter,
+		trustForwardedFor: opts.TrustForwardedFor,
+	}
+	router.GET("/bus/:id/socket", authorize(roleDriver, socket.get))
 
+	// the CORS preflight requests are answered with the allowed methods
+	router.HandleOPTIONS = true
 	router.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
 	router.NotFound = http.HandlerFunc(notFound)
 	router.PanicHandler = panicRecovery
@@ -47,9 +124,26 @@ func BuildMux(repo *data.Repository) http.Handler {
 	n.UseFunc(func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 		handlers.LoggingHandler(logOutput, next).ServeHTTP(w, req)
 	})
+	// before anything which may reject the request, so browsers can read why
+	if len(opts.CORS.AllowedOrigins) > 0 {
+		n.UseFunc(allowCORS(opts.CORS))
+	}
 	n.UseFunc(func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 		handlers.HTTPMethodOverrideHandler(next).ServeHTTP(w, req)
 	})
+	if opts.DisableAuth {
+		n.UseFunc(disableAuth())
+	} else {
+		if opts.JWTVerifier != nil {
+			n.UseFunc(identifyJWT(opts.JWTVerifier))
+		} else {
+			// the failures take from the write limit of each IP address
+			n.UseFunc(requireAPIKey(repo, writeLimiter, opts.TrustForwardedFor))
+		}
+	}
+	// after the clients are authenticated, so nobody can spend the limit of
+	// someone else's key just by sending its ID
+	n.UseFunc(limitRate(readLimiter, writeLimiter, opts.TrustForwardedFor))
 	n.UseFunc(func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 		handlers.CompressHandler(next).ServeHTTP(w, req)
 	})
@@ -1,17 +1,20 @@
 package web
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/cd1/motofretado-server/data"
 	"github.com/cd1/motofretado-server/web/jsonapi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestBuildMux(t *testing.T) {
-	mux := BuildMux(repo)
+	mux := BuildMux(repo, Options{})
 
 	t.Run("URL not found", func(subT *testing.T) {
 		w := httptest.NewRecorder()
@@ -53,10 +56,73 @@ func TestBuildMux(t *testing.T) {
 		require.Equal(subT, http.StatusOK, w.Code, "unexpected status code")
 		assert.Equal(subT, w.Header().Get("Content-Encoding"), "gzip", "\"Content-Encoding\" header should contain the encoding \"gzip\"")
 	})
+
+	t.Run("authentication", func(subT *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/bus/not-found", nil)
+		req.Header.Set(busTokenHeader, "foo")
+
+		mux.ServeHTTP(w, req)
+
+		assert.Equal(subT, http.StatusUnauthorized, w.Code, "a request without API key shouldn't change buses")
+
+		w = httptest.NewRecorder()
+		BuildMux(repo, Options{DisableAuth: true}).ServeHTTP(w, req)
+
+		assert.Equal(subT, http.StatusNotFound, w.Code, "the authentication should be disabled")
+
+		bus := data.Bus{
+			ID:        "test-disabled-auth",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+
+		if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+			subT.Skipf("failed to create bus which would be deleted: %v", err)
+		}
+		defer repo.DeleteBus(context.Background(), bus.ID)
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodDelete, "/bus/"+bus.ID, nil)
+
+		BuildMux(repo, Options{DisableAuth: true}).ServeHTTP(w, req)
+
+		assert.Equal(subT, http.StatusNoContent, w.Code, "a bus token shouldn't be needed when the authentication is disabled")
+	})
+
+	t.Run("JWT", func(subT *testing.T) {
+		secret := newTestSecret(subT)
+		verifier, err := NewJWTVerifier(secret)
+		require.NoError(subT, err, "failed to build verifier")
+
+		jwtMux := BuildMux(repo, Options{JWTVerifier: verifier})
+		serve := func(method, path string, r role) int {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("Accept", jsonapi.ContentType)
+			if len(r) > 0 {
+				token := signJWT(subT, jwtAlgorithmHS256, secret, map[string]interface{}{
+					"role": r,
+					"exp":  time.Now().Add(time.Hour).Unix(),
+				})
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+
+			jwtMux.ServeHTTP(w, req)
+
+			return w.Code
+		}
+
+		assert.Equal(subT, http.StatusUnauthorized, serve(http.MethodGet, "/bus", ""), "a token should be required to read buses")
+		assert.Equal(subT, http.StatusOK, serve(http.MethodGet, "/bus", roleRider), "a rider should read buses")
+		assert.Equal(subT, http.StatusForbidden, serve(http.MethodDelete, "/bus/not-found", roleDriver), "a driver shouldn't delete buses")
+		// neither an API key nor a bus token is needed
+		assert.Equal(subT, http.StatusNotFound, serve(http.MethodDelete, "/bus/not-found", roleAdmin), "an admin should delete buses")
+	})
 }
 
 func BenchmarkBuildMux(b *testing.B) {
 	for n := 0; n < b.N; n++ {
-		_ = BuildMux(repo)
+		_ = BuildMux(repo, Options{})
 	}
 }
@@ -0,0 +1,222 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/urfave/negroni"
+)
+
+// RateLimit limits how many requests a client may send. Each client may send
+// Burst requests at once, and then Rate requests per second. A zero Rate
+// disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// tokenBucket holds the requests a client may still send. It's refilled at the
+// limit rate, up to the limit burst.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps a token bucket for each client.
+type rateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter builds a limiter for limit, or returns nil if it's disabled.
+// A nil limiter allows every request.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// fillTime returns how long an empty bucket takes to be full again.
+func (l *rateLimiter) fillTime() time.Duration {
+	return time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+}
+
+// allow takes a token from the bucket of client. If it's empty, the request
+// isn't allowed, and the time until the next token is returned.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.refill(client, now)
+	if bucket.tokens < 1 {
+		return false, l.timeUntilToken(bucket)
+	}
+
+	bucket.tokens--
+
+	return true, 0
+}
+
+// wait returns the time until the bucket of client has a token, without taking
+// it; i.e. zero if a request would be allowed now.
+func (l *rateLimiter) wait(client string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.refill(client, now)
+	if bucket.tokens < 1 {
+		return l.timeUntilToken(bucket)
+	}
+
+	return 0
+}
+
+// refill returns the bucket of client with the tokens added since it was last
+// used. The caller must hold the lock.
+func (l *rateLimiter) refill(client string, now time.Time) *tokenBucket {
+	l.sweep(now)
+
+	bucket, exists := l.buckets[client]
+	if !exists {
+		bucket = &tokenBucket{
+			tokens:  float64(l.limit.Burst),
+			updated: now,
+		}
+		l.buckets[client] = bucket
+	}
+
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(float64(l.limit.Burst), bucket.tokens+elapsed*l.limit.Rate)
+	bucket.updated = now
+
+	return bucket
+}
+
+// timeUntilToken returns how long an empty bucket takes to get a token.
+func (l *rateLimiter) timeUntilToken(bucket *tokenBucket) time.Duration {
+	missing := (1 - bucket.tokens) / l.limit.Rate
+	return time.Duration(missing * float64(time.Second))
+}
+
+// sweep forgets the buckets which are full by now, as they're the same as new
+// ones. Otherwise, every client ever seen would be kept.
+func (l *rateLimiter) sweep(now time.Time) {
+	fillTime := l.fillTime()
+	if now.Sub(l.lastSweep) < fillTime {
+		return
+	}
+
+	for client, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= fillTime {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// retryAfterSeconds rounds up the time until the next request is allowed, as
+// the clients are told to wait whole seconds.
+func retryAfterSeconds(retryAfter time.Duration) int {
+	return int(math.Ceil(retryAfter.Seconds()))
+}
+
+// rateLimitClient identifies the client of a request: its API key, if it has
+// been validated by requireAPIKey, the subject of its JWT, if it has been
+// verified by identifyJWT, or its IP address (see rateLimitIP).
+func rateLimitClient(req *http.Request, trustForwardedFor bool) string {
+	if keyID, ok := apiKeyIDFromContext(req.Context()); ok {
+		return "key:" + keyID
+	}
+
+	if claims, ok := claimsFromContext(req.Context()); ok {
+		return "jwt:" + claims.Subject
+	}
+
+	return rateLimitIP(req, trustForwardedFor)
+}
+
+// rateLimitIP identifies the client of a request by its IP address.
+// X-Forwarded-For is only used if trustForwardedFor is set, as anyone can send
+// it; the last address is the one added by the proxy.
+func rateLimitIP(req *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwardedFor := req.Header.Get("X-Forwarded-For"); len(forwardedFor) > 0 {
+			addrs := strings.Split(forwardedFor, ",")
+			return "ip:" + strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// limitRate builds a middleware which rejects the requests of the clients that
+// exceed their limits. The requests which change the buses are limited by
+// writeLimiter, and the others by readLimiter. It must come after requireAPIKey
+// and identifyJWT, so the authenticated clients are identified by them.
+func limitRate(readLimiter, writeLimiter *rateLimiter, trustForwardedFor bool) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		limiter := readLimiter
+		if isWriteRequest(req) {
+			limiter = writeLimiter
+		}
+
+		client := rateLimitClient(req, trustForwardedFor)
+		if ok, retryAfter := limiter.allow(client, time.Now()); !ok {
+			tooManyRequests(w, client, retryAfter)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// tooManyRequests tells the client to wait for retryAfter before sending
+// another request.
+func tooManyRequests(w http.ResponseWriter, client string, retryAfter time.Duration) {
+	retryAfterSecs := retryAfterSeconds(retryAfter)
+
+	logrus.WithFields(logrus.Fields{
+		"client":      client,
+		"retry_after": retryAfter,
+	}).Debug("request rate limit exceeded")
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSecs))
+	errorResponse(w, jsonapi.ErrorData{
+		Status: strconv.Itoa(http.StatusTooManyRequests), // 429 Too Many Requests
+		Title:  "Too many requests",
+		Detail: fmt.Sprintf("Request rate limit exceeded; retry after %v second(s)", retryAfterSecs),
+	})
+}
@@ -0,0 +1,163 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_allow(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+
+	t.Run("burst", func(subT *testing.T) {
+		for n := 0; n < 3; n++ {
+			ok, _ := limiter.allow("test", now)
+			assert.True(subT, ok, "request %v should be allowed", n)
+		}
+
+		ok, retryAfter := limiter.allow("test", now)
+		assert.False(subT, ok, "the burst should be exceeded")
+		assert.Equal(subT, 500*time.Millisecond, retryAfter, "unexpected time until the next token")
+	})
+
+	t.Run("other client", func(subT *testing.T) {
+		ok, _ := limiter.allow("test-other", now)
+		assert.True(subT, ok, "each client should have its own limit")
+	})
+
+	t.Run("refill", func(subT *testing.T) {
+		now = now.Add(500 * time.Millisecond)
+
+		ok, _ := limiter.allow("test", now)
+		assert.True(subT, ok, "a token should be added after a while")
+
+		ok, _ = limiter.allow("test", now)
+		assert.False(subT, ok, "only one token should be added")
+	})
+
+	t.Run("sweep", func(subT *testing.T) {
+		now = now.Add(limiter.fillTime())
+
+		_, _ = limiter.allow("test-sweep", now)
+		assert.Len(subT, limiter.buckets, 1, "only the bucket which isn't full should be kept")
+	})
+
+	t.Run("disabled", func(subT *testing.T) {
+		disabledLimiter := newRateLimiter(RateLimit{Burst: 1})
+		require.Nil(subT, disabledLimiter, "a zero rate should disable the limit")
+
+		for n := 0; n < 10; n++ {
+			ok, _ := disabledLimiter.allow("test", now)
+			assert.True(subT, ok, "requests shouldn't be limited")
+		}
+	})
+}
+
+func TestRateLimitClient(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		header            map[string]string
+		keyID             string
+		trustForwardedFor bool
+		expected          string
+	}{
+		{"remote address", nil, "", false, "ip:192.0.2.1"},
+		{"API key", map[string]string{apiKeyHeader: "foo.bar"}, "foo", false, "key:foo"},
+		{"unvalidated API key", map[string]string{apiKeyHeader: "foo.bar"}, "", false, "ip:192.0.2.1"},
+		{"untrusted proxy", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "", false, "ip:192.0.2.1"},
+		{"trusted proxy", map[string]string{"X-Forwarded-For": "198.51.100.1, 198.51.100.2"}, "", true, "ip:198.51.100.2"},
+		{"API key behind proxy", map[string]string{apiKeyHeader: "foo.bar", "X-Forwarded-For": "198.51.100.1"}, "foo", true, "key:foo"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/bus", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		if len(tc.keyID) > 0 {
+			req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, tc.keyID))
+		}
+
+		assert.Equal(t, tc.expected, rateLimitClient(req, tc.trustForwardedFor), tc.name)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/bus", nil)
+	req = req.WithContext(context.WithValue(req.Context(), claimsContextKey{}, jwtClaims{Subject: "foo"}))
+	assert.Equal(t, "jwt:foo", rateLimitClient(req, false), "JWT")
+}
+
+func TestLimitRate(t *testing.T) {
+	middleware := limitRate(newRateLimiter(RateLimit{Rate: 1, Burst: 2}), newRateLimiter(RateLimit{Rate: 0.1, Burst: 1}), false)
+	next := func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/bus/test", nil)
+		w := httptest.NewRecorder()
+
+		middleware(w, req, next)
+
+		return w
+	}
+
+	t.Run("writes", func(subT *testing.T) {
+		require.Equal(subT, http.StatusOK, serve(http.MethodPatch).Code, "the first write should be allowed")
+
+		w := serve(http.MethodPatch)
+		require.Equal(subT, http.StatusTooManyRequests, w.Code, "unexpected HTTP status")
+		assert.Equal(subT, jsonapi.ContentType, w.Header().Get("Content-Type"), "unexpected content type")
+
+		retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		require.NoError(subT, err, "\"Retry-After\" should be a number of seconds")
+		assert.Equal(subT, 10, retryAfter, "unexpected \"Retry-After\"")
+
+		var doc jsonapi.ErrorsDocument
+
+		require.NoError(subT, json.NewDecoder(w.Body).Decode(&doc), "failed to decode data from JSON")
+		assert.Len(subT, doc.Errors, 1)
+	})
+
+	t.Run("reads", func(subT *testing.T) {
+		for n := 0; n < 2; n++ {
+			assert.Equal(subT, http.StatusOK, serve(http.MethodGet).Code, "reads should have their own limit")
+		}
+		assert.Equal(subT, http.StatusTooManyRequests, serve(http.MethodGet).Code, "unexpected HTTP status")
+	})
+
+	t.Run("invalid API keys", func(subT *testing.T) {
+		mux := BuildMux(repo, Options{
+			WriteLimit: RateLimit{Rate: 0.1, Burst: 2},
+		})
+		serveBadKey := func() int {
+			req := httptest.NewRequest(http.MethodPost, "/bus", nil)
+			req.Header.Set(apiKeyHeader, "foo.bar")
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, req)
+
+			return w.Code
+		}
+
+		for n := 0; n < 2; n++ {
+			require.Equal(subT, http.StatusForbidden, serveBadKey(), "the invalid key should be rejected")
+		}
+		assert.Equal(subT, http.StatusTooManyRequests, serveBadKey(), "the invalid keys should be limited")
+	})
+
+	t.Run("disabled", func(subT *testing.T) {
+		middleware = limitRate(nil, nil, false)
+
+		for n := 0; n < 10; n++ {
+			assert.Equal(subT, http.StatusOK, serve(http.MethodPatch).Code, "requests shouldn't be limited")
+		}
+	})
+}
@@ -0,0 +1,364 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cd1/motofretado-server/data"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+const (
+	// socketMaxFrameSize is the maximum size of a position frame, in bytes.
+	socketMaxFrameSize = 512
+
+	// socketPongWait is how long the server waits for any message (including
+	// pongs) from the client before closing the connection.
+	socketPongWait = 60 * time.Second
+
+	// socketPingInterval is how often the server pings the client. It must be
+	// shorter than socketPongWait.
+	socketPingInterval = socketPongWait / 2
+
+	// socketWriteWait is the time allowed to write a message to the client.
+	socketWriteWait = 10 * time.Second
+
+	// closeBusNotFound is the WebSocket close code sent when the bus doesn't
+	// exist; the application range (4000-4999) mirrors the HTTP status codes.
+	closeBusNotFound = 4404
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// positionFrame is the compact message sent by the drivers' apps through the
+// WebSocket with the latest bus position. The sequence number is chosen by the
+// client and it's echoed back in the acknowledgement. The telemetry fields and
+// the device time are optional, like the bus attributes.
+type positionFrame struct {
+	Seq        int64      `json:"seq"`
+	Latitude   *float64   `json:"lat"`
+	Longitude  *float64   `json:"lng"`
+	Speed      *float64   `json:"speed"`
+	Heading    *float64   `json:"heading"`
+	Accuracy   *float64   `json:"accuracy"`
+	Altitude   *float64   `json:"altitude"`
+	RecordedAt *time.Time `json:"recorded_at"`
+}
+
+// ackFrame is the message sent back to the client after a position frame has
+// been applied to the bus.
+type ackFrame struct {
+	Seq       int64     `json:"seq"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// rejectFrame is the message sent back to the client after a position frame
+// has been rejected without closing the connection (e.g. it's older than the
+// bus position).
+type rejectFrame struct {
+	Seq    int64               `json:"seq"`
+	Errors []jsonapi.ErrorData `json:"errors"`
+}
+
+// Sockets keeps track of the open WebSocket connections, so they can be closed
+// when the web server shuts down; http.Server.Shutdown doesn't wait for them.
+type Sockets struct {
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewSockets builds an empty set of WebSocket connections.
+func NewSockets() *Sockets {
+	return &Sockets{
+		closing: make(chan struct{}),
+	}
+}
+
+// open registers a new connection, unless the connections are being closed.
+// Each successful call must be followed by a call to release.
+func (s *Sockets) open() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.wg.Add(1)
+
+	return true
+}
+
+// release unregisters a connection after its handler has finished.
+func (s *Sockets) release() {
+	s.wg.Done()
+}
+
+// Close asks the clients of all connections to go away, and then waits until
+// their handlers have finished or ctx is done. No connection can be opened
+// afterwards.
+func (s *Sockets) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.closing)
+	}
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SocketHandler handles the WebSocket connections opened by the drivers' apps.
+// Each connection is bound to a single bus, and every position frame received
+// through it updates that bus. The frames are limited like the other requests
+// which change the buses.
+type SocketHandler struct {
+	repo              *data.Repository
+	sockets           *Sockets
+	writeLimiter      *rateLimiter
+	trustForwardedFor bool
+}
+
+func (h SocketHandler) get(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+	if len(id) == 0 {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+			Title:  "Empty bus ID",
+		})
+
+		return
+	}
+
+	if !verifyBusToken(w, req, h.repo, id) {
+		return
+	}
+
+	if !h.sockets.open() {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusServiceUnavailable), // 503 Service Unavailable
+			Title:  "Server shutting down",
+			Detail: "No WebSocket connection can be opened while the server shuts down",
+		})
+
+		return
+	}
+	defer h.sockets.release()
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already replied with an HTTP error
+		logrus.WithError(err).Info("could not upgrade connection to WebSocket")
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(socketMaxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go pingSocket(conn, done, h.sockets.closing)
+
+	client := rateLimitClient(req, h.trustForwardedFor)
+	logFields := logrus.WithFields(logrus.Fields{
+		"bus_id": id,
+		"client": client,
+	})
+	logFields.Debug("WebSocket connection opened")
+
+	for {
+		var frame positionFrame
+
+		if err := conn.ReadJSON(&frame); err != nil {
+			switch err.(type) {
+			case *websocket.CloseError:
+				logFields.WithError(err).Debug("WebSocket connection closed by the client")
+			case net.Error:
+				logFields.WithError(err).Info("WebSocket connection lost")
+			default:
+				closeSocket(conn, websocket.CloseInvalidFramePayloadData, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusBadRequest), // 400 Bad Request
+					Title:  "Invalid JSON format",
+					Detail: err.Error(),
+				})
+			}
+
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(socketPongWait))
+
+		if ok, retryAfter := h.writeLimiter.allow(client, time.Now()); !ok {
+			closeSocket(conn, websocket.CloseTryAgainLater, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusTooManyRequests), // 429 Too Many Requests
+				Title:  "Too many requests",
+				Detail: fmt.Sprintf("Frame %v exceeded the rate limit; retry after %v second(s)", frame.Seq, retryAfterSeconds(retryAfter)),
+			})
+
+			return
+		}
+
+		if frame.Latitude == nil || frame.Longitude == nil {
+			closeSocket(conn, websocket.CloseInvalidFramePayloadData, jsonapi.ErrorData{
+				Status: strconv.Itoa(http.StatusUnprocessableEntity), // 422 Unprocessable Entity
+				Title:  "Missing bus field",
+				Detail: fmt.Sprintf("Frame %v MUST contain both \"lat\" and \"lng\"", frame.Seq),
+			})
+
+			return
+		}
+
+		bus := data.Bus{
+			ID:        id,
+			Latitude:  *frame.Latitude,
+			Longitude: *frame.Longitude,
+			Speed:     frame.Speed,
+			Heading:   frame.Heading,
+			Accuracy:  frame.Accuracy,
+			Altitude:  frame.Altitude,
+		}
+		if frame.RecordedAt != nil {
+			bus.RecordedAt = *frame.RecordedAt
+		}
+
+		updatedBus, err := h.repo.UpdateBus(req.Context(), bus)
+		if err != nil {
+			causeErr := errors.Cause(err)
+			if causeErr == data.ErrOutdatedPosition {
+				// delayed frames are expected from drivers with a bad connection
+				reject := rejectFrame{
+					Seq: frame.Seq,
+					Errors: []jsonapi.ErrorData{{
+						Status: strconv.Itoa(http.StatusConflict), // 409 Conflict
+						Title:  "Outdated bus position",
+						Detail: fmt.Sprintf("Bus \"%v\" already has a position recorded after \"%v\"", id, bus.RecordedAt),
+					}},
+				}
+
+				conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+				if err := conn.WriteJSON(reject); err != nil {
+					logFields.WithError(err).Info("could not reject position frame")
+					return
+				}
+
+				continue
+			} else if causeErr == data.ErrNoSuchRow {
+				closeSocket(conn, closeBusNotFound, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusNotFound), // 404 Not Found
+					Title:  "Bus ID not found",
+					Detail: fmt.Sprintf("Bus \"%v\" doesn't exist", id),
+				})
+			} else {
+				switch causeErr.(type) {
+				case data.InvalidParameterError:
+					closeSocket(conn, websocket.CloseInvalidFramePayloadData, jsonapi.ErrorData{
+						Status: strconv.Itoa(http.StatusUnprocessableEntity), // 422 Unprocessable Entity
+						Title:  "Invalid bus field",
+						Detail: err.Error(),
+					})
+				default:
+					closeSocket(conn, websocket.CloseInternalServerErr, unexpectedError(err))
+				}
+			}
+
+			return
+		}
+
+		ack := ackFrame{
+			Seq:       frame.Seq,
+			UpdatedAt: updatedBus.UpdatedAt,
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+		if err := conn.WriteJSON(ack); err != nil {
+			logFields.WithError(err).Info("could not acknowledge position frame")
+			return
+		}
+	}
+}
+
+// pingSocket pings the client periodically until done is closed, so dead
+// connections are detected by the read deadline. If closing is closed first,
+// the client is asked to go away.
+func pingSocket(conn *websocket.Conn, done, closing <-chan struct{}) {
+	ticker := time.NewTicker(socketPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-closing:
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down")
+			if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(socketWriteWait)); err != nil {
+				logrus.WithError(err).Debug("could not send WebSocket close message")
+			}
+
+			// the reply of the client ends the connection; if it doesn't
+			// come, the deadline does
+			conn.SetReadDeadline(time.Now().Add(socketWriteWait))
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait)); err != nil {
+				logrus.WithError(err).Debug("could not ping WebSocket client")
+				return
+			}
+		}
+	}
+}
+
+// closeSocket sends the error to the client as a JSONAPI Errors document and
+// then closes the WebSocket connection with the specified code.
+func closeSocket(conn *websocket.Conn, code int, e jsonapi.ErrorData) {
+	logrus.WithFields(logrus.Fields{
+		"code":   code,
+		"status": e.Status,
+		"title":  e.Title,
+		"detail": e.Detail,
+	}).Info("WebSocket error")
+
+	doc := jsonapi.ErrorsDocument{
+		JSONAPI: &jsonapi.Root{
+			Version: jsonapi.CurrentVersion,
+		},
+		Errors: []jsonapi.ErrorData{e},
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	if err := conn.WriteJSON(doc); err != nil {
+		logrus.WithError(err).Warn("error encoding Errors to JSON")
+	}
+
+	msg := websocket.FormatCloseMessage(code, e.Title)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(socketWriteWait)); err != nil {
+		logrus.WithError(err).Debug("could not send WebSocket close message")
+	}
+}
@@ -0,0 +1,348 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/data"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketHandler_get(t *testing.T) {
+	server := httptest.NewServer(BuildMux(repo, Options{}))
+	defer server.Close()
+
+	socketURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	bus := data.Bus{
+		ID:        "test-socket",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	_, wholeKey, err := repo.CreateAPIKey(context.Background(), "test-socket")
+	require.NoError(t, err, "failed to create API key")
+
+	tokenHeader := func(token string) http.Header {
+		h := make(http.Header)
+		h.Set(apiKeyHeader, wholeKey)
+		h.Set(busTokenHeader, token)
+
+		return h
+	}
+
+	dial := func(subT *testing.T, id, token string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(socketURL+"/bus/"+id+"/socket", tokenHeader(token))
+		require.NoError(subT, err, "failed to open WebSocket connection")
+
+		return conn
+	}
+
+	// expectClose reads the error document and the close frame sent by the server
+	expectClose := func(subT *testing.T, conn *websocket.Conn, expectedCode int) {
+		var doc jsonapi.ErrorsDocument
+
+		require.NoError(subT, conn.ReadJSON(&doc), "failed to read error document")
+		assert.Len(subT, doc.Errors, 1, "unexpected number of errors")
+
+		_, _, err := conn.ReadMessage()
+		if assert.IsType(subT, &websocket.CloseError{}, err) {
+			assert.Equal(subT, expectedCode, err.(*websocket.CloseError).Code, "unexpected close code")
+		}
+	}
+
+	t.Run("not found", func(subT *testing.T) {
+		_, res, err := websocket.DefaultDialer.Dial(socketURL+"/bus/not-found/socket", tokenHeader("foo"))
+		require.Error(subT, err, "connection to a non-existing bus should fail")
+		assert.Equal(subT, http.StatusNotFound, res.StatusCode, "unexpected HTTP status code")
+	})
+
+	t.Run("missing API key", func(subT *testing.T) {
+		h := tokenHeader(createdBus.Token)
+		h.Del(apiKeyHeader)
+
+		_, res, err := websocket.DefaultDialer.Dial(socketURL+"/bus/"+bus.ID+"/socket", h)
+		require.Error(subT, err, "connection without an API key should fail")
+		assert.Equal(subT, http.StatusUnauthorized, res.StatusCode, "unexpected HTTP status code")
+	})
+
+	t.Run("missing token", func(subT *testing.T) {
+		h := tokenHeader("")
+		h.Del(busTokenHeader)
+
+		_, res, err := websocket.DefaultDialer.Dial(socketURL+"/bus/"+bus.ID+"/socket", h)
+		require.Error(subT, err, "connection without the bus token should fail")
+		assert.Equal(subT, http.StatusUnauthorized, res.StatusCode, "unexpected HTTP status code")
+	})
+
+	t.Run("invalid token", func(subT *testing.T) {
+		_, res, err := websocket.DefaultDialer.Dial(socketURL+"/bus/"+bus.ID+"/socket", tokenHeader(busTokens["initial-bus-0"]))
+		require.Error(subT, err, "connection with the token of another bus should fail")
+		assert.Equal(subT, http.StatusForbidden, res.StatusCode, "unexpected HTTP status code")
+	})
+
+	t.Run("not a WebSocket", func(subT *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/bus/"+bus.ID+"/socket", nil)
+		require.NoError(subT, err, "failed to build request")
+		req.Header = tokenHeader(createdBus.Token)
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(subT, err, "failed to send request")
+		defer res.Body.Close()
+
+		assert.Equal(subT, http.StatusBadRequest, res.StatusCode, "unexpected HTTP status code")
+	})
+
+	t.Run("success", func(subT *testing.T) {
+		conn := dial(subT, bus.ID, createdBus.Token)
+		defer conn.Close()
+
+		for seq, lat := range []float64{1.23, 4.56} {
+			frame := map[string]interface{}{
+				"seq": seq,
+				"lat": lat,
+				"lng": 7.89,
+			}
+			require.NoError(subT, conn.WriteJSON(frame), "failed to send frame")
+
+			var ack ackFrame
+			require.NoError(subT, conn.ReadJSON(&ack), "failed to read acknowledgement")
+			assert.Equal(subT, int64(seq), ack.Seq, "unexpected acknowledged sequence number")
+
+			updatedBus, err := repo.ReadBus(context.Background(), bus.ID)
+			require.NoError(subT, err, "failed to read bus")
+			assert.Equal(subT, lat, updatedBus.Latitude, "unexpected bus latitude")
+		}
+	})
+
+	t.Run("telemetry", func(subT *testing.T) {
+		conn := dial(subT, bus.ID, createdBus.Token)
+		defer conn.Close()
+
+		frame := map[string]interface{}{
+			"seq":      1,
+			"lat":      1.23,
+			"lng":      4.56,
+			"speed":    12.5,
+			"heading":  90,
+			"accuracy": 5,
+			"altitude": 760,
+		}
+		require.NoError(subT, conn.WriteJSON(frame), "failed to send frame")
+
+		var ack ackFrame
+		require.NoError(subT, conn.ReadJSON(&ack), "failed to read acknowledgement")
+
+		updatedBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		for name, value := range map[string]*float64{
+			"speed":    updatedBus.Speed,
+			"heading":  updatedBus.Heading,
+			"accuracy": updatedBus.Accuracy,
+			"altitude": updatedBus.Altitude,
+		} {
+			if assert.NotNil(subT, value, "the bus %v should be stored", name) {
+				assert.EqualValues(subT, frame[name], *value, "unexpected bus %v", name)
+			}
+		}
+	})
+
+	t.Run("invalid telemetry", func(subT *testing.T) {
+		conn := dial(subT, bus.ID, createdBus.Token)
+		defer conn.Close()
+
+		require.NoError(subT, conn.WriteJSON(map[string]interface{}{"lat": 1.23, "lng": 4.56, "speed": -1}), "failed to send frame")
+		expectClose(subT, conn, websocket.CloseInvalidFramePayloadData)
+	})
+
+	t.Run("recording time", func(subT *testing.T) {
+		conn := dial(subT, bus.ID, createdBus.Token)
+		defer conn.Close()
+
+		recordedAt := time.Now().Truncate(time.Microsecond)
+		require.NoError(subT, conn.WriteJSON(map[string]interface{}{"seq": 1, "lat": 1.23, "lng": 4.56, "recorded_at": recordedAt}), "failed to send frame")
+
+		var ack ackFrame
+		require.NoError(subT, conn.ReadJSON(&ack), "failed to read acknowledgement")
+
+		updatedBus, err := repo.ReadBus(context.Background(), bus.ID)
+		require.NoError(subT, err, "failed to read bus")
+		assert.True(subT, recordedAt.Equal(updatedBus.RecordedAt), "the device time should be kept; expected %v, got %v", recordedAt, updatedBus.RecordedAt)
+
+		// the connection must stay open after an outdated frame
+		require.NoError(subT, conn.WriteJSON(map[string]interface{}{"seq": 2, "lat": 7.89, "lng": 4.56, "recorded_at": recordedAt.Add(-time.Minute)}), "failed to send frame")
+
+		var reject rejectFrame
+		require.NoError(subT, conn.ReadJSON(&reject), "failed to read rejection")
+		assert.Equal(subT, int64(2), reject.Seq, "unexpected rejected sequence number")
+		if assert.Len(subT, reject.Errors, 1, "unexpected number of errors") {
+			assert.Equal(subT, strconv.Itoa(http.StatusConflict), reject.Errors[0].Status, "unexpected error status")
+		}
+
+		require.NoError(subT, conn.WriteJSON(map[string]interface{}{"seq": 3, "lat": 7.89, "lng": 4.56}), "failed to send frame")
+		require.NoError(subT, conn.ReadJSON(&ack), "failed to read acknowledgement")
+		assert.Equal(subT, int64(3), ack.Seq, "unexpected acknowledged sequence number")
+	})
+
+	t.Run("future recording time", func(subT *testing.T) {
+		conn := dial(subT, bus.ID, createdBus.Token)
+		defer conn.Close()
+
+		require.NoError(subT, conn.WriteJSON(map[string]interface{}{"lat": 1.23, "lng": 4.56, "recorded_at": time.Now().Add(time.Hour)}), "failed to send frame")
+		expectClose(subT, conn, websocket.CloseInvalidFramePayloadData)
+	})
+
+	t.Run("invalid JSON format", func(subT *testing.T) {
+		conn := dial(subT, bus.ID, createdBus.Token)
+		defer conn.Close()
+
+		require.NoError(subT, conn.WriteMessage(websocket.TextMessage, []byte("foo bar {{{")), "failed to send frame")
+		expectClose(subT, conn, websocket.CloseInvalidFramePayloadData)
+	})
+
+	t.Run("missing field", func(subT *testing.T) {
+		conn := dial(subT, bus.ID, createdBus.Token)
+		defer conn.Close()
+
+		require.NoError(subT, conn.WriteJSON(map[string]interface{}{"lat": 1.23}), "failed to send frame")
+		expectClose(subT, conn, websocket.CloseInvalidFramePayloadData)
+	})
+
+	t.Run("bus deleted", func(subT *testing.T) {
+		deletedBus := data.Bus{
+			ID:        "test-socket-deleted",
+			Latitude:  1.23,
+			Longitude: 4.56,
+		}
+		createdDeletedBus, err := repo.CreateBus(context.Background(), deletedBus)
+		if err != nil {
+			subT.Skipf("failed to create bus which would be deleted: %v", err)
+		}
+
+		conn := dial(subT, deletedBus.ID, createdDeletedBus.Token)
+		defer conn.Close()
+
+		if err := repo.DeleteBus(context.Background(), deletedBus.ID); err != nil {
+			subT.Skipf("failed to delete bus: %v", err)
+		}
+
+		require.NoError(subT, conn.WriteJSON(map[string]interface{}{"lat": 1.23, "lng": 4.56}), "failed to send frame")
+		expectClose(subT, conn, closeBusNotFound)
+	})
+}
+
+func TestSocketHandler_get_rateLimit(t *testing.T) {
+	// the upgrade request takes a token too
+	server := httptest.NewServer(BuildMux(repo, Options{
+		WriteLimit: RateLimit{Rate: 0.1, Burst: 3},
+	}))
+	defer server.Close()
+
+	bus := data.Bus{
+		ID:        "test-socket-rate-limit",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	_, wholeKey, err := repo.CreateAPIKey(context.Background(), "test-socket-rate-limit")
+	require.NoError(t, err, "failed to create API key")
+
+	h := make(http.Header)
+	h.Set(apiKeyHeader, wholeKey)
+	h.Set(busTokenHeader, createdBus.Token)
+
+	socketURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/bus/" + bus.ID + "/socket"
+	conn, _, err := websocket.DefaultDialer.Dial(socketURL, h)
+	require.NoError(t, err, "failed to open WebSocket connection")
+	defer conn.Close()
+
+	for seq := 0; seq < 2; seq++ {
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{"seq": seq, "lat": 1.23, "lng": 4.56}), "failed to send frame")
+
+		var ack ackFrame
+		require.NoError(t, conn.ReadJSON(&ack), "frame %v should be allowed", seq)
+	}
+
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"seq": 2, "lat": 1.23, "lng": 4.56}), "failed to send frame")
+
+	var doc jsonapi.ErrorsDocument
+
+	require.NoError(t, conn.ReadJSON(&doc), "failed to read error document")
+	require.Len(t, doc.Errors, 1, "unexpected number of errors")
+	assert.Equal(t, strconv.Itoa(http.StatusTooManyRequests), doc.Errors[0].Status, "unexpected error status")
+
+	_, _, err = conn.ReadMessage()
+	if assert.IsType(t, &websocket.CloseError{}, err) {
+		assert.Equal(t, websocket.CloseTryAgainLater, err.(*websocket.CloseError).Code, "unexpected close code")
+	}
+
+	_, res, err := websocket.DefaultDialer.Dial(socketURL, h)
+	require.Error(t, err, "the limit should be shared with the other writes")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "unexpected HTTP status code")
+}
+
+func TestSockets_Close(t *testing.T) {
+	sockets := NewSockets()
+	server := httptest.NewServer(BuildMux(repo, Options{Sockets: sockets}))
+	defer server.Close()
+
+	bus := data.Bus{
+		ID:        "test-socket-close",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	createdBus, err := repo.CreateBus(context.Background(), bus)
+	if err != nil {
+		t.Skipf("failed to create bus which would be updated: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	_, wholeKey, err := repo.CreateAPIKey(context.Background(), "test-socket-close")
+	require.NoError(t, err, "failed to create API key")
+
+	h := make(http.Header)
+	h.Set(apiKeyHeader, wholeKey)
+	h.Set(busTokenHeader, createdBus.Token)
+
+	socketURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/bus/" + bus.ID + "/socket"
+	conn, _, err := websocket.DefaultDialer.Dial(socketURL, h)
+	require.NoError(t, err, "failed to open WebSocket connection")
+	defer conn.Close()
+
+	closeErrs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		closeErrs <- sockets.Close(ctx)
+	}()
+
+	// the client replies to the close message while reading
+	_, _, err = conn.ReadMessage()
+	if assert.IsType(t, &websocket.CloseError{}, err) {
+		assert.Equal(t, websocket.CloseGoingAway, err.(*websocket.CloseError).Code, "unexpected close code")
+	}
+	assert.NoError(t, <-closeErrs, "the connection handlers should finish")
+
+	_, res, err := websocket.DefaultDialer.Dial(socketURL, h)
+	require.Error(t, err, "no connection should be opened after closing")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "unexpected HTTP status code")
+}
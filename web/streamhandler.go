@@ -0,0 +1,135 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cd1/motofretado-server/data"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+const (
+	eventStreamContentType = "text/event-stream"
+
+	// allBusesStreamID is the bus ID reserved for the stream of all buses;
+	// httprouter doesn't allow the path "/bus/stream" to be registered
+	// alongside "/bus/:id".
+	allBusesStreamID = data.StreamBusID
+
+	// streamKeepAliveInterval is how often a comment is sent to idle streams,
+	// so proxies don't close the connection.
+	streamKeepAliveInterval = 15 * time.Second
+)
+
+// StreamHandler handles the HTTP requests which follow the changes on the
+// buses. Every time a bus is created, updated or deleted, its JSONAPI document
+// is pushed to the client as a Server-Sent Event.
+type StreamHandler struct {
+	repo *data.Repository
+}
+
+func (h StreamHandler) get(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if req.Header.Get("Accept") != eventStreamContentType {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusNotAcceptable), // 406 Not Acceptable
+			Title:  "HTTP method not acceptable",
+			Detail: fmt.Sprintf("Request MUST accept \"%v\"", eventStreamContentType),
+		})
+
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorResponse(w, jsonapi.ErrorData{
+			Status: strconv.Itoa(http.StatusInternalServerError), // 500 Internal Server Error
+			Title:  "Streaming not supported",
+		})
+
+		return
+	}
+
+	// an empty ID means that all buses should be streamed
+	id := params.ByName("id")
+	if len(id) > 0 {
+		if _, err := h.repo.ReadBus(req.Context(), id); err != nil {
+			if errors.Cause(err) == data.ErrNoSuchRow {
+				errorResponse(w, jsonapi.ErrorData{
+					Status: strconv.Itoa(http.StatusNotFound), // 404 Not Found
+					Title:  "Bus ID not found",
+					Detail: fmt.Sprintf("Bus \"%v\" doesn't exist", id),
+				})
+			} else {
+				errorResponse(w, unexpectedError(err))
+			}
+
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if req.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK) // 200 OK
+		return
+	}
+
+	events, unsubscribe := h.repo.Subscribe(id)
+	defer unsubscribe()
+
+	w.WriteHeader(http.StatusOK) // 200 OK
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	scheme := requestScheme(req)
+
+	for {
+		select {
+		case <-req.Context().Done():
+			logrus.WithFields(logrus.Fields{
+				"bus_id": id,
+			}).Debug("client closed the event stream")
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+
+			busDoc := jsonapi.ToBusDocument(e.Bus)
+			if e.Type == data.BusDeleted {
+				busDoc.Data.Attributes = nil
+			} else {
+				busDoc.Data.Links = &jsonapi.Links{
+					Self: fmt.Sprintf("%v://%v/bus/%v", scheme, req.Host, e.Bus.ID),
+				}
+			}
+
+			payload, err := json.Marshal(busDoc)
+			if err != nil {
+				logrus.WithError(err).Error("could not encode bus to JSON")
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", e.Type, payload); err != nil {
+				logrus.WithError(err).Info("could not write to the event stream")
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				logrus.WithError(err).Info("could not write to the event stream")
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/data"
+	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamHandler_get(t *testing.T) {
+	server := httptest.NewServer(BuildMux(repo, Options{}))
+	defer server.Close()
+
+	subTestFunc := func(method, path string, accept string, expectedStatus int) func(*testing.T) {
+		return func(subT *testing.T) {
+			req, err := http.NewRequest(method, server.URL+path, nil)
+			require.NoError(subT, err, "failed to create request")
+			req.Header.Set("Accept", accept)
+
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(subT, err, "failed to send request")
+			defer res.Body.Close()
+
+			require.Equal(subT, expectedStatus, res.StatusCode, "unexpected HTTP status code")
+		}
+	}
+
+	t.Run("not acceptable", subTestFunc(http.MethodGet, "/bus/stream", jsonapi.ContentType, http.StatusNotAcceptable))
+
+	t.Run("not found", subTestFunc(http.MethodGet, "/bus/not-found/stream", eventStreamContentType, http.StatusNotFound))
+
+	t.Run("HEAD", subTestFunc(http.MethodHead, "/bus/stream", eventStreamContentType, http.StatusOK))
+
+	t.Run("HEAD not found", subTestFunc(http.MethodHead, "/bus/not-found/stream", eventStreamContentType, http.StatusNotFound))
+
+	streamFunc := func(path string, bus data.Bus) func(*testing.T) {
+		return func(subT *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+			require.NoError(subT, err, "failed to create request")
+			req.Header.Set("Accept", eventStreamContentType)
+
+			// the response headers are only sent after the handler has subscribed
+			// to the bus events
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(subT, err, "failed to send request")
+			defer res.Body.Close()
+			require.Equal(subT, http.StatusOK, res.StatusCode, "unexpected HTTP status code")
+			assert.Equal(subT, eventStreamContentType, res.Header.Get("Content-Type"), "unexpected content type")
+
+			bus.Latitude = 1.23
+			if _, err := repo.UpdateBus(context.Background(), bus); err != nil {
+				subT.Skipf("failed to update bus: %v", err)
+			}
+
+			lines := make(chan string)
+			go func() {
+				scanner := bufio.NewScanner(res.Body)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+				close(lines)
+			}()
+
+			var event, payload string
+			for len(payload) == 0 {
+				select {
+				case line, ok := <-lines:
+					require.True(subT, ok, "stream closed before receiving an event")
+					if strings.HasPrefix(line, "event: ") {
+						event = strings.TrimPrefix(line, "event: ")
+					} else if strings.HasPrefix(line, "data: ") {
+						payload = strings.TrimPrefix(line, "data: ")
+					}
+				case <-time.After(time.Second):
+					require.FailNow(subT, "event not received")
+				}
+			}
+
+			assert.Equal(subT, string(data.BusUpdated), event, "unexpected event type")
+
+			var doc jsonapi.BusDocument
+			require.NoError(subT, json.Unmarshal([]byte(payload), &doc), "failed to decode data from JSON")
+
+			streamedBus, err := jsonapi.FromBusDocument(doc)
+			require.NoError(subT, err, "failed to convert JSONAPI data")
+			assert.Equal(subT, bus.ID, streamedBus.ID, "unexpected bus ID")
+			assert.Equal(subT, bus.Latitude, streamedBus.Latitude, "unexpected bus latitude")
+		}
+	}
+
+	bus := data.Bus{
+		ID:        "test-stream",
+		Latitude:  1.23,
+		Longitude: 4.56,
+	}
+	if _, err := repo.CreateBus(context.Background(), bus); err != nil {
+		t.Skipf("failed to create bus which would be streamed: %v", err)
+	}
+	defer repo.DeleteBus(context.Background(), bus.ID)
+
+	t.Run("single bus", streamFunc("/bus/test-stream/stream", bus))
+
+	t.Run("all buses", streamFunc("/bus/stream", bus))
+}
@@ -2,10 +2,17 @@ package web
 
 import (
 	"fmt"
+	"hash/fnv"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cd1/motofretado-server/data"
 	"github.com/cd1/motofretado-server/web/jsonapi"
+	"github.com/pkg/errors"
 )
 
 func notAcceptable(w http.ResponseWriter) {
@@ -35,3 +42,219 @@ func requestScheme(req *http.Request) string {
 
 	return scheme
 }
+
+// parsePoint parses a point in the format "latitude,longitude". The range of
+// the coordinates isn't validated here.
+func parsePoint(value string) (lat, lng float64, err error) {
+	coords := strings.Split(value, ",")
+	if len(coords) != 2 {
+		return 0, 0, errors.Errorf("\"%v\" is not a point in the format \"latitude,longitude\"", value)
+	}
+
+	if lat, err = strconv.ParseFloat(strings.TrimSpace(coords[0]), 64); err != nil {
+		return 0, 0, errors.Errorf("\"%v\" is not a valid latitude", coords[0])
+	}
+
+	if lng, err = strconv.ParseFloat(strings.TrimSpace(coords[1]), 64); err != nil {
+		return 0, 0, errors.Errorf("\"%v\" is not a valid longitude", coords[1])
+	}
+
+	return lat, lng, nil
+}
+
+// parseBox parses a bounding box in the format
+// "minLongitude,minLatitude,maxLongitude,maxLatitude" (the same order used by
+// GeoJSON). The range of the coordinates isn't validated here.
+func parseBox(value string) (minLat, minLng, maxLat, maxLng float64, err error) {
+	coords := strings.Split(value, ",")
+	if len(coords) != 4 {
+		return 0, 0, 0, 0, errors.Errorf("\"%v\" is not a box in the format \"minLongitude,minLatitude,maxLongitude,maxLatitude\"", value)
+	}
+
+	var values [4]float64
+
+	for i, c := range coords {
+		if values[i], err = strconv.ParseFloat(strings.TrimSpace(c), 64); err != nil {
+			return 0, 0, 0, 0, errors.Errorf("\"%v\" is not a valid coordinate", c)
+		}
+	}
+
+	return values[1], values[0], values[3], values[2], nil
+}
+
+// parseSort parses a JSONAPI sort parameter (e.g. "-updated_at,id"). The field
+// names aren't validated here.
+func parseSort(value string) ([]data.SortKey, error) {
+	var keys []data.SortKey
+
+	for _, field := range strings.Split(value, ",") {
+		key := data.SortKey{
+			Field: strings.TrimSpace(field),
+		}
+
+		if strings.HasPrefix(key.Field, "-") {
+			key.Field = key.Field[1:]
+			key.Descending = true
+		}
+
+		if len(key.Field) == 0 {
+			return nil, errors.Errorf("\"%v\" contains an empty sort field", value)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// parseBusFields parses the JSONAPI sparse fieldset of buses ("fields[bus]").
+// It returns nil if the parameter isn't specified.
+func parseBusFields(query url.Values) ([]string, error) {
+	values, exists := query["fields[bus]"]
+	if !exists {
+		return nil, nil
+	}
+
+	fields := []string{}
+
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if len(field) == 0 {
+				continue
+			}
+
+			if !isBusField(field) {
+				return nil, errors.Errorf("\"%v\" is not a bus field", field)
+			}
+
+			fields = append(fields, field)
+		}
+	}
+
+	return fields, nil
+}
+
+func isBusField(field string) bool {
+	for _, f := range jsonapi.BusFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// busETag builds the entity tag of a bus, which changes every time the bus is
+// updated.
+func busETag(bus data.Bus) string {
+	return fmt.Sprintf("\"%v\"", strconv.FormatInt(bus.UpdatedAt.UnixNano(), 36))
+}
+
+// sparseETag changes an entity tag to depend on the sparse fieldset too (unless
+// fields is nil), as each fieldset has its own representation. The order of the
+// fields doesn't matter. Such tags never match the header "If-Match", because
+// they don't tag the whole bus.
+func sparseETag(etag string, fields []string) string {
+	if fields == nil {
+		return etag
+	}
+
+	sortedFields := make([]string, len(fields))
+	copy(sortedFields, fields)
+	sort.Strings(sortedFields)
+
+	h := fnv.New64a()
+	for i, f := range sortedFields {
+		if i > 0 && f == sortedFields[i-1] {
+			continue
+		}
+		fmt.Fprintf(h, "%v;", f)
+	}
+
+	return fmt.Sprintf("%v.%v\"", strings.TrimSuffix(etag, "\""), strconv.FormatUint(h.Sum64(), 36))
+}
+
+// parseIfMatch parses the entity tags from the HTTP header "If-Match" back to
+// bus update times. Weak and malformed tags are ignored because they can never
+// match a bus. It also returns whether the header contains "*".
+func parseIfMatch(header string) (updatedAts []time.Time, any bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			any = true
+			continue
+		}
+
+		if len(tag) < 2 || !strings.HasPrefix(tag, "\"") || !strings.HasSuffix(tag, "\"") {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(tag[1:len(tag)-1], 36, 64)
+		if err != nil {
+			continue
+		}
+
+		updatedAts = append(updatedAts, time.Unix(0, nanos))
+	}
+
+	return updatedAts, any
+}
+
+// busesETag builds the entity tag of a bus collection. Besides the update time
+// of the buses, it also depends on which buses are there and on the total
+// number of buses, so it changes when a bus is deleted.
+func busesETag(busesDoc jsonapi.BusesDocument) string {
+	h := fnv.New64a()
+
+	for _, d := range busesDoc.Data {
+		fmt.Fprintf(h, "%v:%v;", d.ID, d.Attributes.UpdatedAt.UnixNano())
+	}
+	if busesDoc.Meta != nil && busesDoc.Meta.Total != nil {
+		fmt.Fprintf(h, "total:%v", *busesDoc.Meta.Total)
+	}
+	if busesDoc.Meta != nil {
+		for _, id := range busesDoc.Meta.Deleted {
+			fmt.Fprintf(h, "deleted:%v;", id)
+		}
+	}
+
+	return fmt.Sprintf("\"%v\"", strconv.FormatUint(h.Sum64(), 36))
+}
+
+// checkNotModified sets the validators "ETag" and "Last-Modified" (unless
+// lastModified is zero) on the response, and then evaluates the conditional
+// headers "If-None-Match" and "If-Modified-Since". If the resource hasn't been
+// modified, it responds with 304 Not Modified and returns true.
+func checkNotModified(w http.ResponseWriter, req *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	notModified := false
+
+	// "If-Modified-Since" must be ignored when "If-None-Match" is present
+	if ifNoneMatch := req.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+
+			// "If-None-Match" uses the weak comparison
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				notModified = true
+				break
+			}
+		}
+	} else if ifModifiedSince := req.Header.Get("If-Modified-Since"); len(ifModifiedSince) > 0 && !lastModified.IsZero() {
+		// "Last-Modified" doesn't have fractions of a second
+		if t, err := http.ParseTime(ifModifiedSince); err == nil && !lastModified.Truncate(time.Second).After(t) {
+			notModified = true
+		}
+	}
+
+	if notModified {
+		w.WriteHeader(http.StatusNotModified) // 304 Not Modified
+	}
+
+	return notModified
+}
@@ -1,11 +1,17 @@
 package web
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
+
+	"github.com/cd1/motofretado-server/data"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRequestScheme(t *testing.T) {
@@ -21,3 +27,109 @@ func TestRequestScheme(t *testing.T) {
 		assert.Equal(subT, "https", scheme)
 	})
 }
+
+func TestParsePoint(t *testing.T) {
+	t.Run("valid", func(subT *testing.T) {
+		lat, lng, err := parsePoint("-23.5505, -46.6333")
+		require.NoError(subT, err)
+		assert.Equal(subT, -23.5505, lat, "latitude")
+		assert.Equal(subT, -46.6333, lng, "longitude")
+	})
+
+	for _, value := range []string{"", "1.23", "1.23,4.56,7.89", "foo,4.56", "1.23,bar"} {
+		t.Run(fmt.Sprintf("invalid %q", value), func(subT *testing.T) {
+			_, _, err := parsePoint(value)
+			assert.Error(subT, err)
+		})
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	t.Run("valid", func(subT *testing.T) {
+		keys, err := parseSort("-updated_at, id")
+		require.NoError(subT, err)
+		assert.Equal(subT, []data.SortKey{
+			{Field: "updated_at", Descending: true},
+			{Field: "id"},
+		}, keys)
+	})
+
+	for _, value := range []string{"", "id,", "-"} {
+		t.Run(fmt.Sprintf("invalid %q", value), func(subT *testing.T) {
+			_, err := parseSort(value)
+			assert.Error(subT, err)
+		})
+	}
+}
+
+func TestParseBusFields(t *testing.T) {
+	subTestFunc := func(query string, expectedFields []string, expectError bool) func(*testing.T) {
+		return func(subT *testing.T) {
+			values, err := url.ParseQuery(query)
+			require.NoError(subT, err, "failed to parse query")
+
+			fields, err := parseBusFields(values)
+			if expectError {
+				assert.Error(subT, err)
+			} else {
+				require.NoError(subT, err)
+				assert.Equal(subT, expectedFields, fields)
+			}
+		}
+	}
+
+	t.Run("missing", subTestFunc("", nil, false))
+	t.Run("empty", subTestFunc("fields[bus]=", []string{}, false))
+	t.Run("some", subTestFunc("fields[bus]=latitude,longitude", []string{"latitude", "longitude"}, false))
+	t.Run("unknown", subTestFunc("fields[bus]=latitude,foo", nil, true))
+}
+
+func TestParseIfMatch(t *testing.T) {
+	bus := data.Bus{
+		UpdatedAt: time.Now(),
+	}
+	tag := busETag(bus)
+
+	t.Run("single", func(subT *testing.T) {
+		updatedAts, any := parseIfMatch(tag)
+		assert.False(subT, any, "header shouldn't match any tag")
+		require.Len(subT, updatedAts, 1)
+		assert.True(subT, bus.UpdatedAt.Equal(updatedAts[0]), "update time should be the same")
+	})
+
+	t.Run("multiple", func(subT *testing.T) {
+		updatedAts, any := parseIfMatch(fmt.Sprintf("\"foo-bar\", W/%v, %v, *", tag, tag))
+		assert.True(subT, any, "header should match any tag")
+		assert.Len(subT, updatedAts, 1, "only the valid strong tags should be parsed")
+	})
+}
+
+func TestSparseETag(t *testing.T) {
+	const etag = "\"foo\""
+
+	assert.Equal(t, etag, sparseETag(etag, nil), "the tag shouldn't change without a fieldset")
+	assert.NotEqual(t, etag, sparseETag(etag, []string{}), "the empty fieldset should have its own tag")
+	assert.NotEqual(t, sparseETag(etag, []string{"latitude"}), sparseETag(etag, []string{"longitude"}), "each fieldset should have its own tag")
+	assert.Equal(t, sparseETag(etag, []string{"latitude", "longitude"}), sparseETag(etag, []string{"longitude", "latitude", "longitude"}), "the order of the fields shouldn't matter")
+
+	updatedAts, _ := parseIfMatch(sparseETag(busETag(data.Bus{UpdatedAt: time.Now()}), []string{"latitude"}))
+	assert.Empty(t, updatedAts, "a sparse tag shouldn't match a bus update")
+}
+
+func TestParseBox(t *testing.T) {
+	t.Run("valid", func(subT *testing.T) {
+		minLat, minLng, maxLat, maxLng, err := parseBox("-46.7, -23.6, -46.6, -23.5")
+		require.NoError(subT, err)
+		assert.Equal(subT, -23.6, minLat, "minimum latitude")
+		assert.Equal(subT, -46.7, minLng, "minimum longitude")
+		assert.Equal(subT, -23.5, maxLat, "maximum latitude")
+		assert.Equal(subT, -46.6, maxLng, "maximum longitude")
+	})
+
+	for _, value := range []string{"", "1,2,3", "1,2,3,4,5", "1,2,foo,4"} {
+		t.Run(fmt.Sprintf("invalid %q", value), func(subT *testing.T) {
+			_, _, _, _, err := parseBox(value)
+			assert.Error(subT, err)
+		})
+	}
+}
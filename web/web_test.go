@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -13,32 +14,43 @@ const busesCount = 3
 
 var repo *data.Repository
 
+// busTokens contains the tokens of the initial buses, by ID.
+var busTokens = make(map[string]string, busesCount)
+
 func setUp() {
 	var err error
 
-	env := os.Getenv("POSTGRES_URL")
-	repo, err = data.NewPostgresRepository(env)
-	if err != nil {
-		panic(err)
+	if env := os.Getenv("POSTGRES_URL"); len(env) > 0 {
+		repo, err = data.NewPostgresRepository(env)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		repo = data.NewMemoryRepository()
 	}
 
 	for n := 0; n < busesCount; n++ {
 		bus := data.Bus{
-			ID: fmt.Sprintf("initial-bus-%v", n),
+			ID:        fmt.Sprintf("initial-bus-%v", n),
+			Latitude:  1.23,
+			Longitude: 4.56,
 		}
 
-		if _, err = repo.CreateBus(bus); err != nil {
+		createdBus, err := repo.CreateBus(context.Background(), bus)
+		if err != nil {
 			panic(err)
 		}
+		busTokens[bus.ID] = createdBus.Token
 	}
 
 	busesHandler.repo = repo
 	busHandler.repo = repo
+	locationsHandler.repo = repo
 }
 
 func tearDown() {
 	for n := 0; n < busesCount; n++ {
-		if err := repo.DeleteBus(fmt.Sprintf("initial-bus-%v", n)); err != nil {
+		if err := repo.DeleteBus(context.Background(), fmt.Sprintf("initial-bus-%v", n)); err != nil {
 			logrus.WithError(err).Error("failed to delete bus")
 		}
 	}